@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// abiRegistry decodes event logs with the contract ABIs in a directory. An ABI
+// in a file named after a contract address, e.g. 0x6b17...1d0f.json, is only
+// used for logs of that contract. The events of every other file are used for
+// logs of any contract by their signature.
+type abiRegistry struct {
+	directory string
+
+	lock        sync.RWMutex
+	byAddress   map[common.Address]map[common.Hash]abi.Event
+	bySignature map[common.Hash]abi.Event
+}
+
+// decodedLog is a log decoded with a known ABI. It refers to the raw log by
+// transaction hash and log index.
+type decodedLog struct {
+	TransactionHash common.Hash    `json:"transactionHash"`
+	LogIndex        uint           `json:"logIndex"`
+	Address         common.Address `json:"address"`
+	Event           string         `json:"event"`
+	Signature       string         `json:"signature"`
+	Args            []*decodedArg  `json:"args"`
+}
+
+// decodedArg is a typed event argument. Integers are decimal strings and byte
+// values are hex strings. Indexed arguments of dynamic types only have their
+// hash in the log, so their value is that hash.
+type decodedArg struct {
+	Name    string      `json:"name"`
+	Type    string      `json:"type"`
+	Indexed bool        `json:"indexed"`
+	Value   interface{} `json:"value"`
+}
+
+func loadABIRegistry(directory string) (*abiRegistry, error) {
+	registry := &abiRegistry{directory: directory}
+
+	err := registry.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return registry, nil
+}
+
+// reload reads the ABIs from the directory again. If any of them cannot be
+// read the previous ABIs are kept.
+func (registry *abiRegistry) reload() error {
+	files, err := filepath.Glob(filepath.Join(registry.directory, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	byAddress := make(map[common.Address]map[common.Hash]abi.Event)
+	bySignature := make(map[common.Hash]abi.Event)
+
+	for _, file := range files {
+		events, err := readABIEvents(file)
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		if common.IsHexAddress(name) {
+			byAddress[common.HexToAddress(name)] = events
+			continue
+		}
+
+		for id, event := range events {
+			bySignature[id] = event
+		}
+	}
+
+	registry.lock.Lock()
+	registry.byAddress = byAddress
+	registry.bySignature = bySignature
+	registry.lock.Unlock()
+
+	return nil
+}
+
+func readABIEvents(file string) (map[common.Hash]abi.Event, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	contract, err := abi.JSON(f)
+	if err != nil {
+		return nil, err
+	}
+
+	// Anonymous events have no signature topic to find them by
+	events := make(map[common.Hash]abi.Event)
+	for _, event := range contract.Events {
+		if !event.Anonymous {
+			events[event.ID()] = event
+		}
+	}
+
+	return events, nil
+}
+
+// size returns the number of contracts and signatures in the registry.
+func (registry *abiRegistry) size() (int, int) {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	return len(registry.byAddress), len(registry.bySignature)
+}
+
+func (registry *abiRegistry) event(l *types.Log) (abi.Event, bool) {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	if events, ok := registry.byAddress[l.Address]; ok {
+		if event, ok := events[l.Topics[0]]; ok {
+			return event, true
+		}
+	}
+
+	event, ok := registry.bySignature[l.Topics[0]]
+	return event, ok
+}
+
+// decodeLogs decodes every log of a block that has a known ABI. Logs without
+// a known ABI, or that do not match it, are left out.
+func (registry *abiRegistry) decodeLogs(block *receiptsBlock) []*decodedLog {
+	var decoded []*decodedLog
+	for _, receipt := range block.Receipts {
+		for _, l := range receipt.Logs {
+			if len(l.Topics) == 0 {
+				continue
+			}
+
+			event, ok := registry.event(l)
+			if !ok {
+				continue
+			}
+
+			args, err := decodeLogArgs(event, l)
+			if err != nil {
+				continue
+			}
+
+			decoded = append(decoded, &decodedLog{
+				TransactionHash: l.TxHash,
+				LogIndex:        l.Index,
+				Address:         l.Address,
+				Event:           event.RawName,
+				Signature:       event.Sig(),
+				Args:            args,
+			})
+		}
+	}
+
+	return decoded
+}
+
+func decodeLogArgs(event abi.Event, l *types.Log) ([]*decodedArg, error) {
+	indexed := 0
+	for _, input := range event.Inputs {
+		if input.Indexed {
+			indexed++
+		}
+	}
+	if len(l.Topics) != indexed+1 {
+		return nil, fmt.Errorf("expected %d topics, got %d", indexed+1, len(l.Topics))
+	}
+
+	var values []interface{}
+	nonIndexed := event.Inputs.NonIndexed()
+	if len(nonIndexed) > 0 {
+		var err error
+		values, err = nonIndexed.UnpackValues(l.Data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var args []*decodedArg
+	topics := l.Topics[1:]
+	for _, input := range event.Inputs {
+		arg := &decodedArg{
+			Name:    input.Name,
+			Type:    input.Type.String(),
+			Indexed: input.Indexed,
+		}
+
+		if input.Indexed {
+			value, err := decodeTopic(input.Type, topics[0])
+			if err != nil {
+				return nil, err
+			}
+			arg.Value = value
+			topics = topics[1:]
+		} else {
+			arg.Value = abiValueJSON(values[0])
+			values = values[1:]
+		}
+
+		args = append(args, arg)
+	}
+
+	return args, nil
+}
+
+func decodeTopic(t abi.Type, topic common.Hash) (interface{}, error) {
+	switch t.T {
+	case abi.StringTy, abi.BytesTy, abi.SliceTy, abi.ArrayTy, abi.TupleTy:
+		return topic.Hex(), nil
+	}
+
+	values, err := abi.Arguments{{Type: t}}.UnpackValues(topic.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return abiValueJSON(values[0]), nil
+}
+
+// abiValueJSON converts a decoded value into a value that survives a JSON
+// round trip.
+func abiValueJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *big.Int:
+		return v.String()
+	case common.Address:
+		return v.Hex()
+	case common.Hash:
+		return v.Hex()
+	case []byte:
+		return hexutil.Encode(v)
+	case uint8, uint16, uint32, uint64, int8, int16, int32, int64:
+		return fmt.Sprint(v)
+	}
+
+	reflected := reflect.ValueOf(value)
+	switch reflected.Kind() {
+	case reflect.Array:
+		if reflected.Type().Elem().Kind() == reflect.Uint8 {
+			data := make([]byte, reflected.Len())
+			reflect.Copy(reflect.ValueOf(data), reflected)
+			return hexutil.Encode(data)
+		}
+		fallthrough
+	case reflect.Slice:
+		values := make([]interface{}, reflected.Len())
+		for i := range values {
+			values[i] = abiValueJSON(reflected.Index(i).Interface())
+		}
+		return values
+	}
+
+	return value
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+const testERC20ABI = `[{"anonymous":false,"inputs":[{"indexed":true,"name":"from","type":"address"},{"indexed":true,"name":"to","type":"address"},{"indexed":false,"name":"value","type":"uint256"}],"name":"Transfer","type":"event"}]`
+
+const testNameABI = `[{"anonymous":false,"inputs":[{"indexed":true,"name":"name","type":"string"},{"indexed":false,"name":"owner","type":"address"},{"indexed":false,"name":"tags","type":"bytes32[]"}],"name":"Registered","type":"event"}]`
+
+func TestABIRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingestr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "erc20.json"), []byte(testERC20ABI), 0644)
+	assert.NoError(t, err)
+
+	registry, err := loadABIRegistry(dir)
+	assert.NoError(t, err)
+
+	from := common.BytesToHash(testFrom.Bytes())
+	to := common.BytesToHash(testTo.Bytes())
+	registered := crypto.Keccak256Hash([]byte("Registered(string,address,bytes32[])"))
+	nameHash := crypto.Keccak256Hash([]byte("ingestr"))
+
+	var registeredData []byte
+	for _, word := range []int64{0, 64, 1, 7} {
+		registeredData = append(registeredData, testWord(word)...)
+	}
+	copy(registeredData[12:32], testFrom.Bytes())
+
+	block := testTransferBlock(
+		&types.Log{Topics: []common.Hash{transferTopic, from, to}, Data: testWord(1000)},
+		// An ERC-721 transfer does not match the ERC-20 ABI
+		&types.Log{Topics: []common.Hash{transferTopic, from, to, common.HexToHash("0x2a")}},
+		&types.Log{Topics: []common.Hash{registered, nameHash}, Data: registeredData},
+	)
+
+	decoded := registry.decodeLogs(block)
+	assert.Len(t, decoded, 1)
+	assert.Equal(t, "Transfer", decoded[0].Event)
+	assert.Equal(t, "Transfer(address,address,uint256)", decoded[0].Signature)
+	assert.Equal(t, uint(0), decoded[0].LogIndex)
+	assert.Equal(t, testFrom.Hex(), decoded[0].Args[0].Value)
+	assert.True(t, decoded[0].Args[0].Indexed)
+	assert.Equal(t, testTo.Hex(), decoded[0].Args[1].Value)
+	assert.Equal(t, "1000", decoded[0].Args[2].Value)
+	assert.Equal(t, "uint256", decoded[0].Args[2].Type)
+
+	// ABIs named after an address only decode logs of that contract
+	err = ioutil.WriteFile(filepath.Join(dir, testToken.Hex()+".json"), []byte(testNameABI), 0644)
+	assert.NoError(t, err)
+	err = registry.reload()
+	assert.NoError(t, err)
+
+	contracts, signatures := registry.size()
+	assert.Equal(t, 1, contracts)
+	assert.Equal(t, 1, signatures)
+
+	decoded = registry.decodeLogs(block)
+	assert.Len(t, decoded, 2)
+	assert.Equal(t, "Registered", decoded[1].Event)
+	assert.Equal(t, nameHash.Hex(), decoded[1].Args[0].Value)
+	assert.Equal(t, testFrom.Hex(), decoded[1].Args[1].Value)
+	assert.Equal(t, []interface{}{common.BigToHash(big.NewInt(7)).Hex()}, decoded[1].Args[2].Value)
+
+	// A broken ABI keeps the previous ABIs
+	err = ioutil.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0644)
+	assert.NoError(t, err)
+	assert.Error(t, registry.reload())
+	assert.Len(t, registry.decodeLogs(block), 2)
+}
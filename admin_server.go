@@ -0,0 +1,380 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	log "github.com/sirupsen/logrus"
+)
+
+type adminServer struct {
+	pipelines []*pipeline
+	token     string
+}
+
+type adminWorkingBlock struct {
+	*workingBlock
+	AgeSeconds int64 `json:"ageSeconds"`
+}
+
+type adminStatus struct {
+	Chain             string     `json:"chain"`
+	Head              *big.Int   `json:"head"`
+	FinalizedBlock    *big.Int   `json:"finalizedBlock,omitempty"`
+	LastFinishedBlock *big.Int   `json:"lastFinishedBlock"`
+	Paused            bool       `json:"paused"`
+	Requeued          int64      `json:"requeued"`
+	DeadLetters       []*big.Int `json:"deadLetters"`
+}
+
+type adminRange struct {
+	From *big.Int `json:"from"`
+	To   *big.Int `json:"to"`
+}
+
+type adminCursor struct {
+	Block *big.Int `json:"block"`
+}
+
+func createAdminServer(address string, token string, pipelines []*pipeline) *http.Server {
+	admin := &adminServer{
+		pipelines: pipelines,
+		token:     token,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", admin.authenticate(http.MethodGet, admin.handleStatus))
+	mux.HandleFunc("/working", admin.authenticate(http.MethodGet, admin.handleWorking))
+	mux.HandleFunc("/requeue", admin.authenticate(http.MethodPost, admin.handleRequeue))
+	mux.HandleFunc("/cursor", admin.authenticate(http.MethodPost, admin.handleCursor))
+	mux.HandleFunc("/pause", admin.authenticate(http.MethodPost, admin.handlePause(true)))
+	mux.HandleFunc("/resume", admin.authenticate(http.MethodPost, admin.handlePause(false)))
+	mux.HandleFunc("/contract", admin.authenticate(http.MethodGet, admin.handleContract))
+	mux.HandleFunc("/transaction", admin.authenticate(http.MethodGet, admin.handleTransaction))
+	mux.HandleFunc("/abis/reload", admin.authenticate(http.MethodPost, admin.handleReloadABIs))
+	mux.HandleFunc("/debug/vars", admin.authenticate(http.MethodGet, expvar.Handler().ServeHTTP))
+
+	return &http.Server{
+		Addr:    address,
+		Handler: mux,
+	}
+}
+
+// authenticate only lets requests through that use the given method and carry
+// the admin token as a bearer token.
+func (admin *adminServer) authenticate(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(admin.token)) != 1 {
+			log.WithField("remote", r.RemoteAddr).Warn("Unauthorized admin request")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// pipeline returns the pipeline selected by the chain query parameter and its
+// clients. The parameter may be left out if there is only one pipeline.
+func (admin *adminServer) pipeline(w http.ResponseWriter, r *http.Request) (*pipeline, *clients) {
+	var selected *pipeline
+	chain := r.URL.Query().Get("chain")
+	if chain == "" && len(admin.pipelines) == 1 {
+		selected = admin.pipelines[0]
+	}
+
+	for _, p := range admin.pipelines {
+		if p.name == chain {
+			selected = p
+		}
+	}
+
+	if selected == nil {
+		http.Error(w, "unknown chain, use ?chain=<name>", http.StatusBadRequest)
+		return nil, nil
+	}
+
+	clients := selected.connectedClients()
+	if clients == nil {
+		http.Error(w, "chain is not connected", http.StatusServiceUnavailable)
+		return nil, nil
+	}
+
+	return selected, clients
+}
+
+func (admin *adminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	p, clients := admin.pipeline(w, r)
+	if p == nil {
+		return
+	}
+
+	lastFinishedBlock, err := clients.redis.getLastFinishedBlock()
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	paused, err := clients.redis.isPaused()
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	requeued, err := clients.redis.getRequeuedCount()
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	deadLetters, err := clients.redis.getDeadLetters()
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	latestBlock, finalizedBlock := p.heads()
+	writeAdminJSON(w, &adminStatus{
+		Chain:             p.name,
+		Head:              latestBlock,
+		FinalizedBlock:    finalizedBlock,
+		LastFinishedBlock: lastFinishedBlock,
+		Paused:            paused,
+		Requeued:          requeued,
+		DeadLetters:       deadLetters,
+	})
+}
+
+func (admin *adminServer) handleWorking(w http.ResponseWriter, r *http.Request) {
+	p, clients := admin.pipeline(w, r)
+	if p == nil {
+		return
+	}
+
+	blocks, err := clients.redis.getWorkingBlocks()
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	now := time.Now()
+	var result []*adminWorkingBlock = make([]*adminWorkingBlock, 0)
+	for _, block := range blocks {
+		result = append(result, &adminWorkingBlock{
+			workingBlock: block,
+			AgeSeconds:   int64(now.Sub(block.ClaimedAt).Seconds()),
+		})
+	}
+
+	writeAdminJSON(w, result)
+}
+
+func (admin *adminServer) handleRequeue(w http.ResponseWriter, r *http.Request) {
+	p, clients := admin.pipeline(w, r)
+	if p == nil {
+		return
+	}
+
+	var body adminRange
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.From == nil {
+		http.Error(w, "expected {\"from\": <block>, \"to\": <block>}", http.StatusBadRequest)
+		return
+	}
+
+	if body.To == nil {
+		body.To = body.From
+	}
+
+	if body.To.Cmp(body.From) < 0 {
+		http.Error(w, "to must not be before from", http.StatusBadRequest)
+		return
+	}
+
+	err = checkRequeueRange(body.From, body.To)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = clients.redis.requeueBlocks(body.From, body.To)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	logAdminAudit(r, p, "requeue", log.Fields{
+		"from": body.From.String(),
+		"to":   body.To.String(),
+	})
+
+	writeAdminJSON(w, body)
+}
+
+func (admin *adminServer) handleCursor(w http.ResponseWriter, r *http.Request) {
+	p, clients := admin.pipeline(w, r)
+	if p == nil {
+		return
+	}
+
+	var body adminCursor
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Block == nil {
+		http.Error(w, "expected {\"block\": <block>}", http.StatusBadRequest)
+		return
+	}
+
+	previous, err := clients.redis.getLastFinishedBlock()
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	err = clients.redis.setLastFinishedBlock(body.Block)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	logAdminAudit(r, p, "cursor", log.Fields{
+		"previous": previous,
+		"block":    body.Block.String(),
+	})
+
+	writeAdminJSON(w, body)
+}
+
+func (admin *adminServer) handlePause(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, clients := admin.pipeline(w, r)
+		if p == nil {
+			return
+		}
+
+		err := clients.redis.setPaused(paused)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+
+		action := "resume"
+		if paused {
+			action = "pause"
+		}
+
+		logAdminAudit(r, p, action, log.Fields{})
+
+		writeAdminJSON(w, map[string]bool{"paused": paused})
+	}
+}
+
+func (admin *adminServer) handleContract(w http.ResponseWriter, r *http.Request) {
+	p, clients := admin.pipeline(w, r)
+	if p == nil {
+		return
+	}
+
+	address := r.URL.Query().Get("address")
+	if !common.IsHexAddress(address) {
+		http.Error(w, "expected ?address=<contract address>", http.StatusBadRequest)
+		return
+	}
+
+	creation, err := lookupContractCreation(clients.redis, common.HexToAddress(address))
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	if creation == nil {
+		http.Error(w, contractNotFound(common.HexToAddress(address), p.config), http.StatusNotFound)
+		return
+	}
+
+	writeAdminJSON(w, creation)
+}
+
+func (admin *adminServer) handleTransaction(w http.ResponseWriter, r *http.Request) {
+	p, clients := admin.pipeline(w, r)
+	if p == nil {
+		return
+	}
+
+	hash, err := hexutil.Decode(r.URL.Query().Get("hash"))
+	if err != nil || len(hash) != common.HashLength {
+		http.Error(w, "expected ?hash=<transaction hash>", http.StatusBadRequest)
+		return
+	}
+
+	lookup, err := lookupTransaction(clients.redis, clients.s3, common.BytesToHash(hash))
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	if lookup == nil {
+		http.Error(w, "transaction not found", http.StatusNotFound)
+		return
+	}
+
+	writeAdminJSON(w, lookup)
+}
+
+func (admin *adminServer) handleReloadABIs(w http.ResponseWriter, r *http.Request) {
+	p, _ := admin.pipeline(w, r)
+	if p == nil {
+		return
+	}
+
+	if p.abis == nil {
+		http.Error(w, "no ABI directory is configured", http.StatusBadRequest)
+		return
+	}
+
+	err := p.abis.reload()
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	contracts, signatures := p.abis.size()
+	logAdminAudit(r, p, "reload_abis", log.Fields{
+		"contracts":  contracts,
+		"signatures": signatures,
+	})
+
+	writeAdminJSON(w, map[string]int{"contracts": contracts, "signatures": signatures})
+}
+
+func logAdminAudit(r *http.Request, p *pipeline, action string, fields log.Fields) {
+	fields["audit"] = true
+	fields["chain"] = p.name
+	fields["action"] = action
+	fields["remote"] = r.RemoteAddr
+
+	log.WithFields(fields).Info("Admin action")
+}
+
+func writeAdminJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	log.Error(err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingestr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	embedded := testCreateEmbeddedClient(t, dir, 60)
+	defer embedded.close()
+
+	p := createPipeline(testConf)
+	p.clients = &clients{redis: embedded}
+	server := createAdminServer("", "secret", []*pipeline{p})
+
+	request := httptest.NewRequest(http.MethodGet, "/status", nil)
+	recorder := httptest.NewRecorder()
+	server.Handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	request = httptest.NewRequest(http.MethodPost, "/requeue", strings.NewReader(`{"from": 5, "to": 6}`))
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder = httptest.NewRecorder()
+	server.Handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	request = httptest.NewRequest(http.MethodPost, "/requeue", strings.NewReader(`{"from": 0, "to": 100000000}`))
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder = httptest.NewRecorder()
+	server.Handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	request = httptest.NewRequest(http.MethodPost, "/pause", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder = httptest.NewRecorder()
+	server.Handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	paused, err := embedded.isPaused()
+	assert.NoError(t, err)
+	assert.True(t, paused)
+
+	block, err := embedded.getNextWorkingBlock(big.NewInt(200))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), block.Int64())
+
+	request = httptest.NewRequest(http.MethodGet, "/working", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder = httptest.NewRecorder()
+	server.Handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"number":5`)
+	assert.Contains(t, recorder.Body.String(), testConf.instanceID)
+}
+
+func TestAdminServerConnecting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingestr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	embedded := testCreateEmbeddedClient(t, dir, 60)
+	defer embedded.close()
+
+	p := createPipeline(testConf)
+	server := createAdminServer("", "secret", []*pipeline{p})
+
+	status := func() int {
+		request := httptest.NewRequest(http.MethodGet, "/status", nil)
+		request.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		server.Handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	// The admin server reads the clients while the pipeline connects
+	connected := make(chan bool)
+	go func() {
+		p.lock.Lock()
+		p.clients = &clients{redis: embedded}
+		p.lock.Unlock()
+		close(connected)
+	}()
+	code := status()
+	assert.Contains(t, []int{http.StatusOK, http.StatusServiceUnavailable}, code)
+
+	<-connected
+	assert.Equal(t, http.StatusOK, status())
+}
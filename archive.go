@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+)
+
+// An archive packs a range of blocks into a single object so that historical
+// ranges can be stored and scanned with few requests. Every block is
+// compressed on its own and the object ends with an index of the blocks
+// followed by a trailer:
+//
+//   block 0 | block 1 | ... | index | trailer
+//
+// Every index entry is the offset (8 bytes) and length (4 bytes) of a block
+// and the SHA-256 of the uncompressed block (32 bytes). The trailer holds the
+// first block number (8 bytes), the number of blocks (4 bytes), the offset of
+// the index (8 bytes) and archiveMagic. Numbers are little endian. A single
+// block can be read with two range requests, one for the index and trailer
+// and one for the block.
+
+// archiveMagic ends every archive.
+var archiveMagic = []byte("IGA2")
+
+const (
+	archiveIndexEntrySize = 12 + sha256.Size
+	archiveTrailerSize    = 24
+)
+
+// archiveInterval is how often a pipeline checks for finished archives.
+var archiveInterval = 10 * time.Second
+
+// archiveIndex locates the blocks of an archive.
+type archiveIndex struct {
+	start   uint64
+	offsets []uint64
+	lengths []uint32
+
+	// checksums holds the SHA-256 of every uncompressed block.
+	checksums [][]byte
+}
+
+// archiveWriter writes an archive as its blocks are written. Only the index is
+// kept in memory.
+type archiveWriter struct {
+	w      io.Writer
+	start  uint64
+	count  uint32
+	offset uint64
+	index  []byte
+}
+
+func newArchiveWriter(w io.Writer, start uint64) *archiveWriter {
+	return &archiveWriter{w: w, start: start}
+}
+
+// writeBlock adds the next block to the archive. The block is written by
+// encode, which compresses it and returns the checksum of the uncompressed
+// block.
+func (archive *archiveWriter) writeBlock(encode func(w io.Writer) ([]byte, error)) error {
+	counter := &countingWriter{w: archive.w}
+	checksum, err := encode(counter)
+	if err != nil {
+		return err
+	}
+
+	archive.index = appendUint64(archive.index, archive.offset)
+	archive.index = appendUint32(archive.index, uint32(counter.n))
+	archive.index = append(archive.index, checksum...)
+	archive.offset += counter.n
+	archive.count++
+	return nil
+}
+
+// close writes the index and the trailer of the archive.
+func (archive *archiveWriter) close() error {
+	trailer := appendUint64(archive.index, archive.start)
+	trailer = appendUint32(trailer, archive.count)
+	trailer = appendUint64(trailer, archive.offset)
+	_, err := archive.w.Write(append(trailer, archiveMagic...))
+	return err
+}
+
+// countingWriter counts the bytes that are written to w.
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (writer *countingWriter) Write(p []byte) (int, error) {
+	n, err := writer.w.Write(p)
+	writer.n += uint64(n)
+	return n, err
+}
+
+// parseArchiveIndex parses the index of an archive from the end of the
+// archive. The data must contain at least the index and the trailer.
+func parseArchiveIndex(data []byte) (*archiveIndex, error) {
+	if len(data) < archiveTrailerSize || !bytes.Equal(data[len(data)-len(archiveMagic):], archiveMagic) {
+		return nil, errors.New("not an archive")
+	}
+
+	trailer := data[len(data)-archiveTrailerSize:]
+	start := binary.LittleEndian.Uint64(trailer)
+	count := int(binary.LittleEndian.Uint32(trailer[8:]))
+	indexOffset := binary.LittleEndian.Uint64(trailer[12:])
+
+	indexSize := count * archiveIndexEntrySize
+	if len(data) < indexSize+archiveTrailerSize {
+		return nil, fmt.Errorf("archive index of %d blocks is incomplete", count)
+	}
+
+	index := &archiveIndex{
+		start:     start,
+		offsets:   make([]uint64, count),
+		lengths:   make([]uint32, count),
+		checksums: make([][]byte, count),
+	}
+
+	entries := data[len(data)-archiveTrailerSize-indexSize:]
+	for i := 0; i < count; i++ {
+		entry := entries[i*archiveIndexEntrySize:]
+		index.offsets[i] = binary.LittleEndian.Uint64(entry)
+		index.lengths[i] = binary.LittleEndian.Uint32(entry[8:])
+		index.checksums[i] = entry[12:archiveIndexEntrySize]
+		if index.offsets[i]+uint64(index.lengths[i]) > indexOffset {
+			return nil, fmt.Errorf("archive block %d is out of bounds", start+uint64(i))
+		}
+	}
+
+	return index, nil
+}
+
+// locate returns the offset, length and checksum of a block, or false if it
+// is not in the archive.
+func (index *archiveIndex) locate(blockNumber uint64) (uint64, uint32, []byte, bool) {
+	if blockNumber < index.start || blockNumber-index.start >= uint64(len(index.offsets)) {
+		return 0, 0, nil, false
+	}
+
+	i := blockNumber - index.start
+	return index.offsets[i], index.lengths[i], index.checksums[i], true
+}
+
+func appendUint64(data []byte, value uint64) []byte {
+	var encoded [8]byte
+	binary.LittleEndian.PutUint64(encoded[:], value)
+	return append(data, encoded[:]...)
+}
+
+// archiveStart returns the first block of the archive that holds a block.
+// Archives are aligned to multiples of their size.
+func archiveStart(blockNumber *big.Int, size int) *big.Int {
+	start := new(big.Int).Div(blockNumber, big.NewInt(int64(size)))
+	return start.Mul(start, big.NewInt(int64(size)))
+}
+
+// archiveKey is the key of the archive of a range of blocks, e.g.
+// archives/8886000-8886999.
+func archiveKey(from *big.Int, to *big.Int) string {
+	return fmt.Sprintf("archives/%s-%s", from, to)
+}
+
+// archiveRange packs a range of cached blocks into an archive in the given
+// format. Blocks are read one at a time as the archive is written. If
+// deleteBlocks is set, the objects of the single blocks are deleted once the
+// archive is stored.
+func archiveRange(from *big.Int, to *big.Int, format string, deleteBlocks bool, s3Client s3Client) error {
+	var formats []string
+	count := int(new(big.Int).Sub(to, from).Int64()) + 1
+	err := s3Client.StoreArchive(from, count, format, func(blockNumber *big.Int, w io.Writer) error {
+		data, stored, err := s3Client.GetBlock(blockNumber)
+		if err == nil {
+			data, err = convertBlock(data, stored, format)
+		}
+		if err != nil {
+			return fmt.Errorf("block %s: %s", blockNumber, err)
+		}
+
+		formats = append(formats, stored)
+		_, err = io.WriteString(w, data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if !deleteBlocks {
+		return nil
+	}
+
+	for i, stored := range formats {
+		n := new(big.Int).Add(from, big.NewInt(int64(i)))
+		err = s3Client.DeleteBlock(n, stored)
+		if err != nil {
+			return fmt.Errorf("block %s: %s", n, err)
+		}
+	}
+
+	return nil
+}
+
+// archive packs every range of ARCHIVE_SIZE blocks whose blocks have all been
+// processed.
+func (p *pipeline) archive() error {
+	cursor, err := p.clients.redis.getArchiveCursor()
+	if err != nil {
+		return err
+	}
+	if cursor == nil {
+		cursor = firstBatch(p.config.workingBlockStart, p.config.archiveSize)
+	}
+
+	ready, err := p.processedBlock()
+	if err != nil || ready == nil {
+		return err
+	}
+
+	size := big.NewInt(int64(p.config.archiveSize))
+	for {
+		end := new(big.Int).Add(cursor, size)
+		end.Sub(end, big.NewInt(1))
+		if end.Cmp(ready) > 0 {
+			return nil
+		}
+
+		p.log.Infof("Archiving blocks %s to %s", cursor, end)
+		err = archiveRange(cursor, end, p.config.blockFormat, p.config.archiveDeleteBlocks, p.clients.s3)
+		if err != nil {
+			return err
+		}
+
+		cursor = new(big.Int).Add(end, big.NewInt(1))
+		err = p.clients.redis.setArchiveCursor(cursor)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// archiveLoop archives finished ranges until the process exits.
+func (p *pipeline) archiveLoop() {
+	for {
+		time.Sleep(archiveInterval)
+
+		err := p.archive()
+		if err != nil {
+			p.log.Error("Failed to archive blocks")
+			p.log.Error(err)
+			incrementMetric(p.name, "archive_errors")
+		}
+	}
+}
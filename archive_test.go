@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/prettymuchbryce/ingestr/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestArchiveIndex(t *testing.T) {
+	blocks := [][]byte{[]byte("first"), {}, []byte("third block")}
+	var checksums [][]byte
+	for _, block := range blocks {
+		checksums = append(checksums, blockChecksum(string(block)))
+	}
+	var buffer bytes.Buffer
+	writer := newArchiveWriter(&buffer, 1000)
+	for i, block := range blocks {
+		assert.NoError(t, writer.writeBlock(func(w io.Writer) ([]byte, error) {
+			_, err := w.Write(block)
+			return checksums[i], err
+		}))
+	}
+	assert.NoError(t, writer.close())
+	archive := buffer.Bytes()
+
+	// The index can be read from any suffix that holds it
+	suffix := archive[len(archive)-len(blocks)*archiveIndexEntrySize-archiveTrailerSize:]
+	for _, data := range [][]byte{archive, suffix} {
+		index, err := parseArchiveIndex(data)
+		assert.NoError(t, err)
+
+		for i, block := range blocks {
+			offset, length, checksum, ok := index.locate(uint64(1000 + i))
+			assert.True(t, ok)
+			assert.Equal(t, block, archive[offset:offset+uint64(length)])
+			assert.Equal(t, checksums[i], checksum)
+		}
+
+		_, _, _, ok := index.locate(999)
+		assert.False(t, ok)
+		_, _, _, ok = index.locate(1003)
+		assert.False(t, ok)
+	}
+
+	_, err := parseArchiveIndex(suffix[1:])
+	assert.EqualError(t, err, "archive index of 3 blocks is incomplete")
+
+	_, err = parseArchiveIndex(bytes.Repeat([]byte{0}, 100))
+	assert.EqualError(t, err, "not an archive")
+
+	assert.Equal(t, int64(8886000), archiveStart(big.NewInt(8886217), 1000).Int64())
+	assert.Equal(t, "archives/8886000-8886999", archiveKey(big.NewInt(8886000), big.NewInt(8886999)))
+}
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingestr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	embedded := testCreateEmbeddedClient(t, dir, 60)
+	defer embedded.close()
+
+	conf := *testConf
+	conf.archiveSize = 100
+	conf.archiveDeleteBlocks = true
+	conf.blockFormat = blockFormatCBOR
+	conf.workingBlockStart = big.NewInt(50)
+
+	cbor, err := convertBlock(testBlockReceipts, blockFormatJSON, blockFormatCBOR)
+	assert.NoError(t, err)
+
+	s3 := &mocks.S3Client{}
+	s3.On("GetBlock", mock.Anything).Return(testBlockReceipts, blockFormatJSON, nil)
+	var archived []string
+	s3.On("StoreArchive", mock.Anything, mock.Anything, blockFormatCBOR, mock.Anything).Return(func(from *big.Int, count int, format string, write func(*big.Int, io.Writer) error) error {
+		archived = nil
+		for i := 0; i < count; i++ {
+			var block bytes.Buffer
+			err := write(new(big.Int).Add(from, big.NewInt(int64(i))), &block)
+			if err != nil {
+				return err
+			}
+			archived = append(archived, block.String())
+		}
+		return nil
+	})
+	s3.On("DeleteBlock", mock.Anything, blockFormatJSON).Return(nil)
+
+	p := createPipeline(&conf)
+	p.clients = &clients{redis: embedded, s3: s3}
+
+	// Nothing is archived before a block has been finished
+	err = p.archive()
+	assert.NoError(t, err)
+	s3.AssertNotCalled(t, "GetBlock", mock.Anything)
+
+	// Only the range from 100 to 199 is complete
+	err = embedded.setLastFinishedBlock(big.NewInt(250))
+	assert.NoError(t, err)
+
+	err = p.archive()
+	assert.NoError(t, err)
+	s3.AssertNumberOfCalls(t, "GetBlock", 100)
+	s3.AssertCalled(t, "StoreArchive", big.NewInt(100), 100, blockFormatCBOR, mock.Anything)
+	assert.Len(t, archived, 100)
+	assert.Equal(t, cbor, archived[0])
+	s3.AssertNumberOfCalls(t, "DeleteBlock", 100)
+	s3.AssertCalled(t, "DeleteBlock", big.NewInt(199), blockFormatJSON)
+
+	cursor, err := embedded.getArchiveCursor()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(200), cursor.Int64())
+
+	// Archives that hold the requested range are packed
+	var out bytes.Buffer
+	conf.archiveDeleteBlocks = false
+	err = runArchiveCommand(&conf, s3, big.NewInt(250), big.NewInt(320), &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "archived blocks 200 to 299\narchived blocks 300 to 399\n", out.String())
+	s3.AssertNumberOfCalls(t, "StoreArchive", 3)
+	s3.AssertNumberOfCalls(t, "DeleteBlock", 100)
+
+	conf.archiveSize = 0
+	err = runArchiveCommand(&conf, s3, big.NewInt(250), big.NewInt(320), &out)
+	assert.EqualError(t, err, "ARCHIVE_SIZE must be set to archive blocks")
+}
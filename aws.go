@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// awsClientConfig configures how an S3 or SNS client connects. Empty values
+// fall back to the default configuration of the AWS SDK, i.e. the AWS_*
+// environment variables, the shared config files and the instance role.
+type awsClientConfig struct {
+	// endpoint is the URL of an S3 or SNS compatible service, such as MinIO.
+	endpoint string
+
+	// forcePathStyle addresses buckets as <endpoint>/<bucket> instead of
+	// <bucket>.<endpoint>. Only used by S3.
+	forcePathStyle bool
+
+	region string
+
+	// accessKeyID and secretAccessKey are static credentials.
+	accessKeyID     string
+	secretAccessKey string
+
+	// profile is a profile of the shared config files.
+	profile string
+
+	// roleARN is a role that is assumed with the credentials above.
+	roleARN string
+}
+
+// roleSessionName identifies ingestr in the sessions of assumed roles.
+const roleSessionName = "ingestr"
+
+// newAWSSession creates a session with the region and credentials of conf.
+// Roles are assumed with STS in that region, not at the endpoint of the
+// service.
+func newAWSSession(conf awsClientConfig) *session.Session {
+	options := session.Options{
+		Config:  *aws.NewConfig(),
+		Profile: conf.profile,
+	}
+
+	// Profiles may set their own region and role
+	if conf.profile != "" {
+		options.SharedConfigState = session.SharedConfigEnable
+	}
+	if conf.region != "" {
+		options.Config.Region = aws.String(conf.region)
+	}
+	if conf.accessKeyID != "" {
+		options.Config.Credentials = credentials.NewStaticCredentials(conf.accessKeyID, conf.secretAccessKey, "")
+	}
+
+	sess := session.Must(session.NewSessionWithOptions(options))
+	if conf.roleARN == "" {
+		return sess
+	}
+
+	role := stscreds.NewCredentials(sess, conf.roleARN, func(provider *stscreds.AssumeRoleProvider) {
+		provider.RoleSessionName = roleSessionName
+	})
+	return sess.Copy(&aws.Config{Credentials: role})
+}
+
+// serviceConfig is the configuration of the service client itself.
+func (conf awsClientConfig) serviceConfig() *aws.Config {
+	config := aws.NewConfig()
+	if conf.endpoint != "" {
+		config.Endpoint = aws.String(conf.endpoint)
+	}
+	if conf.forcePathStyle {
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	return config
+}
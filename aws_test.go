@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAWSClients(t *testing.T) {
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		if r.Method == http.MethodPost {
+			fmt.Fprint(w, `<PublishResponse><PublishResult><MessageId>1</MessageId></PublishResult></PublishResponse>`)
+			return
+		}
+		fmt.Fprint(w, `{"chainId":1}`)
+	}))
+	defer server.Close()
+
+	conf := awsClientConfig{
+		endpoint:        server.URL,
+		forcePathStyle:  true,
+		region:          "eu-west-1",
+		accessKeyID:     "minio",
+		secretAccessKey: "minio123",
+	}
+
+	s3Client := createRealS3Client(conf, "blocks", "mainnet/", nil, blockFormatJSON, false, compressionGzip, 6, 0, newEncryptor("", nil), 0, 10*time.Second)
+	network, err := s3Client.GetNetwork()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"chainId":1}`, network)
+
+	snsClient := createRealSnsClient(conf, "arn:aws:sns:eu-west-1:1:blocks", nil, 10*time.Second)
+	err = snsClient.Publish("8886217", nil)
+	assert.NoError(t, err)
+
+	assert.Len(t, requests, 2)
+
+	// Buckets are addressed by path on the configured endpoint
+	assert.Equal(t, "/blocks/mainnet/network.json", requests[0].URL.Path)
+	assert.Contains(t, requests[0].Header.Get("Authorization"), "Credential=minio/")
+	assert.Contains(t, requests[0].Header.Get("Authorization"), "/eu-west-1/s3/")
+
+	assert.Equal(t, "/", requests[1].URL.Path)
+	assert.Contains(t, requests[1].Header.Get("Authorization"), "/eu-west-1/sns/")
+
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/golang/protobuf/proto"
+)
+
+// Formats that blocks can be stored in.
+const (
+	blockFormatJSON     = "json"
+	blockFormatRLP      = "rlp"
+	blockFormatProtobuf = "protobuf"
+	blockFormatCBOR     = "cbor"
+)
+
+// blockFormats lists every format in the order they are looked up in.
+var blockFormats = []string{blockFormatJSON, blockFormatRLP, blockFormatProtobuf, blockFormatCBOR}
+
+// blockCodec encodes blocks for storage. encode and decode stream the block
+// where the format allows it.
+type blockCodec interface {
+	marshal(block *receiptsBlock) ([]byte, error)
+	unmarshal(data []byte) (*receiptsBlock, error)
+	encode(w io.Writer, block *receiptsBlock) error
+	decode(r io.Reader) (*receiptsBlock, error)
+}
+
+var blockCodecs = map[string]blockCodec{
+	blockFormatJSON:     jsonCodec{},
+	blockFormatRLP:      rlpCodec{},
+	blockFormatProtobuf: protobufCodec{},
+	blockFormatCBOR:     cborCodec{},
+}
+
+// blockFormatExtension is appended to the key of a block. JSON blocks have no
+// extension so that buckets written before formats were configurable can
+// still be read.
+func blockFormatExtension(format string) string {
+	switch format {
+	case blockFormatRLP:
+		return ".rlp"
+	case blockFormatProtobuf:
+		return ".pb"
+	case blockFormatCBOR:
+		return ".cbor"
+	default:
+		return ""
+	}
+}
+
+// encodeBlock encodes a block in the given format.
+func encodeBlock(format string, block *receiptsBlock) (string, error) {
+	data, err := encodeBlockBytes(format, block)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// encodeBlockBytes encodes a block like encodeBlock, without copying it into a
+// string.
+func encodeBlockBytes(format string, block *receiptsBlock) ([]byte, error) {
+	codec, ok := blockCodecs[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown block format %q", format)
+	}
+
+	return codec.marshal(block)
+}
+
+// writeBlock encodes a block in the given format into w.
+func writeBlock(w io.Writer, format string, block *receiptsBlock) error {
+	codec, ok := blockCodecs[format]
+	if !ok {
+		return fmt.Errorf("unknown block format %q", format)
+	}
+
+	return codec.encode(w, block)
+}
+
+// readBlock decodes a block in the given format as it is read from r.
+func readBlock(r io.Reader, format string) (*receiptsBlock, error) {
+	codec, ok := blockCodecs[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown block format %q", format)
+	}
+
+	return codec.decode(r)
+}
+
+// decodeBlock decodes a block that was stored in the given format.
+func decodeBlock(format string, data string) (*receiptsBlock, error) {
+	return decodeBlockBytes(format, []byte(data))
+}
+
+// decodeBlockBytes decodes a block like decodeBlock, without copying it into a
+// string first.
+func decodeBlockBytes(format string, data []byte) (*receiptsBlock, error) {
+	codec, ok := blockCodecs[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown block format %q", format)
+	}
+
+	return codec.unmarshal(data)
+}
+
+// convertBlock re-encodes a block that was stored in one format in another.
+func convertBlock(data string, from string, to string) (string, error) {
+	if from == to {
+		return data, nil
+	}
+
+	block, err := decodeBlock(from, data)
+	if err != nil {
+		return "", err
+	}
+
+	return encodeBlock(to, block)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) marshal(block *receiptsBlock) ([]byte, error) {
+	return json.Marshal(block)
+}
+
+func (jsonCodec) unmarshal(data []byte) (*receiptsBlock, error) {
+	return unmarshalReceiptBlock(string(data))
+}
+
+// encode writes the block like marshal, followed by a newline.
+func (jsonCodec) encode(w io.Writer, block *receiptsBlock) error {
+	return json.NewEncoder(w).Encode(block)
+}
+
+func (jsonCodec) decode(r io.Reader) (*receiptsBlock, error) {
+	var block *receiptsBlock
+	err := json.NewDecoder(r).Decode(&block)
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, errors.New("block is null")
+	}
+
+	return block, nil
+}
+
+// storedBlock is the compact form of a block shared by the binary formats.
+// The header, transactions and uncles keep their consensus RLP encoding so
+// that hashes can be recomputed, and fields that can be derived from the rest
+// of the block, such as the hashes and blooms of receipts, are left out. The
+// protobuf tags match block.proto.
+type storedBlock struct {
+	Version      uint64           `cbor:"version" protobuf:"varint,1,opt,name=version,proto3"`
+	Header       []byte           `cbor:"header" protobuf:"bytes,2,opt,name=header,proto3"`
+	Transactions [][]byte         `cbor:"transactions" protobuf:"bytes,3,rep,name=transactions,proto3"`
+	Uncles       [][]byte         `cbor:"uncles" protobuf:"bytes,4,rep,name=uncles,proto3"`
+	Receipts     []*storedReceipt `cbor:"receipts" protobuf:"bytes,5,rep,name=receipts,proto3"`
+	DecodedLogs  []byte           `cbor:"decoded_logs" protobuf:"bytes,6,opt,name=decoded_logs,json=decodedLogs,proto3"`
+}
+
+type storedReceipt struct {
+	PostState         []byte       `cbor:"post_state" protobuf:"bytes,1,opt,name=post_state,json=postState,proto3"`
+	Status            uint64       `cbor:"status" protobuf:"varint,2,opt,name=status,proto3"`
+	CumulativeGasUsed uint64       `cbor:"cumulative_gas_used" protobuf:"varint,3,opt,name=cumulative_gas_used,json=cumulativeGasUsed,proto3"`
+	TransactionHash   []byte       `cbor:"transaction_hash" protobuf:"bytes,4,opt,name=transaction_hash,json=transactionHash,proto3"`
+	ContractAddress   []byte       `cbor:"contract_address" protobuf:"bytes,5,opt,name=contract_address,json=contractAddress,proto3"`
+	GasUsed           uint64       `cbor:"gas_used" protobuf:"varint,6,opt,name=gas_used,json=gasUsed,proto3"`
+	Logs              []*storedLog `cbor:"logs" protobuf:"bytes,7,rep,name=logs,proto3"`
+}
+
+type storedLog struct {
+	Address []byte   `cbor:"address" protobuf:"bytes,1,opt,name=address,proto3"`
+	Topics  [][]byte `cbor:"topics" protobuf:"bytes,2,rep,name=topics,proto3"`
+	Data    []byte   `cbor:"data" protobuf:"bytes,3,opt,name=data,proto3"`
+	Index   uint64   `cbor:"index" protobuf:"varint,4,opt,name=index,proto3"`
+	Removed bool     `cbor:"removed" protobuf:"varint,5,opt,name=removed,proto3"`
+}
+
+func (m *storedBlock) Reset()         { *m = storedBlock{} }
+func (m *storedBlock) String() string { return proto.CompactTextString(m) }
+func (*storedBlock) ProtoMessage()    {}
+
+func (m *storedReceipt) Reset()         { *m = storedReceipt{} }
+func (m *storedReceipt) String() string { return proto.CompactTextString(m) }
+func (*storedReceipt) ProtoMessage()    {}
+
+func (m *storedLog) Reset()         { *m = storedLog{} }
+func (m *storedLog) String() string { return proto.CompactTextString(m) }
+func (*storedLog) ProtoMessage()    {}
+
+func newStoredBlock(block *receiptsBlock) (*storedBlock, error) {
+	header, err := rlp.EncodeToBytes(block.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := &storedBlock{Version: uint64(block.Version), Header: header}
+
+	for _, tx := range block.Transactions {
+		data, err := rlp.EncodeToBytes(tx)
+		if err != nil {
+			return nil, err
+		}
+		stored.Transactions = append(stored.Transactions, data)
+	}
+
+	for _, uncle := range block.Uncles {
+		data, err := rlp.EncodeToBytes(uncle)
+		if err != nil {
+			return nil, err
+		}
+		stored.Uncles = append(stored.Uncles, data)
+	}
+
+	for _, receipt := range block.Receipts {
+		storedReceipt := &storedReceipt{
+			PostState:         receipt.PostState,
+			Status:            receipt.Status,
+			CumulativeGasUsed: receipt.CumulativeGasUsed,
+			TransactionHash:   receipt.TxHash.Bytes(),
+			GasUsed:           receipt.GasUsed,
+		}
+		if receipt.ContractAddress != (common.Address{}) {
+			storedReceipt.ContractAddress = receipt.ContractAddress.Bytes()
+		}
+
+		for _, l := range receipt.Logs {
+			storedLog := &storedLog{
+				Address: l.Address.Bytes(),
+				Data:    l.Data,
+				Index:   uint64(l.Index),
+				Removed: l.Removed,
+			}
+			for _, topic := range l.Topics {
+				storedLog.Topics = append(storedLog.Topics, topic.Bytes())
+			}
+			storedReceipt.Logs = append(storedReceipt.Logs, storedLog)
+		}
+
+		stored.Receipts = append(stored.Receipts, storedReceipt)
+	}
+
+	if len(block.DecodedLogs) > 0 {
+		stored.DecodedLogs, err = json.Marshal(block.DecodedLogs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return stored, nil
+}
+
+// receiptsBlock restores the fields that were derived from the rest of the
+// block when it was stored.
+func (stored *storedBlock) receiptsBlock() (*receiptsBlock, error) {
+	block := &receiptsBlock{
+		Version:      int(stored.Version),
+		Header:       new(types.Header),
+		Receipts:     []*types.Receipt{},
+		Transactions: []*types.Transaction{},
+		Uncles:       []*types.Header{},
+	}
+
+	err := rlp.DecodeBytes(stored.Header, block.Header)
+	if err != nil {
+		return nil, fmt.Errorf("header: %s", err)
+	}
+	block.Hash = block.Header.Hash()
+
+	for i, data := range stored.Transactions {
+		tx := new(types.Transaction)
+		err = rlp.DecodeBytes(data, tx)
+		if err != nil {
+			return nil, fmt.Errorf("transaction %d: %s", i, err)
+		}
+		block.Transactions = append(block.Transactions, tx)
+	}
+
+	for i, data := range stored.Uncles {
+		uncle := new(types.Header)
+		err = rlp.DecodeBytes(data, uncle)
+		if err != nil {
+			return nil, fmt.Errorf("uncle %d: %s", i, err)
+		}
+		block.Uncles = append(block.Uncles, uncle)
+	}
+
+	for i, stored := range stored.Receipts {
+		receipt := &types.Receipt{
+			PostState:         stored.PostState,
+			Status:            stored.Status,
+			CumulativeGasUsed: stored.CumulativeGasUsed,
+			TxHash:            common.BytesToHash(stored.TransactionHash),
+			ContractAddress:   common.BytesToAddress(stored.ContractAddress),
+			GasUsed:           stored.GasUsed,
+			BlockHash:         block.Hash,
+			BlockNumber:       new(big.Int).Set(block.Header.Number),
+			TransactionIndex:  uint(i),
+			Logs:              []*types.Log{},
+		}
+
+		for _, stored := range stored.Logs {
+			l := &types.Log{
+				Address:     common.BytesToAddress(stored.Address),
+				Topics:      []common.Hash{},
+				Data:        stored.Data,
+				BlockNumber: block.Header.Number.Uint64(),
+				TxHash:      receipt.TxHash,
+				TxIndex:     uint(i),
+				BlockHash:   block.Hash,
+				Index:       uint(stored.Index),
+				Removed:     stored.Removed,
+			}
+			if l.Data == nil {
+				l.Data = []byte{}
+			}
+			for _, topic := range stored.Topics {
+				l.Topics = append(l.Topics, common.BytesToHash(topic))
+			}
+			receipt.Logs = append(receipt.Logs, l)
+		}
+
+		receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+		block.Receipts = append(block.Receipts, receipt)
+	}
+
+	if len(stored.DecodedLogs) > 0 {
+		err = json.Unmarshal(stored.DecodedLogs, &block.DecodedLogs)
+		if err != nil {
+			return nil, fmt.Errorf("decoded logs: %s", err)
+		}
+	}
+
+	return block, nil
+}
+
+type rlpCodec struct{}
+
+func (rlpCodec) marshal(block *receiptsBlock) ([]byte, error) {
+	stored, err := newStoredBlock(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return rlp.EncodeToBytes(stored)
+}
+
+func (rlpCodec) unmarshal(data []byte) (*receiptsBlock, error) {
+	stored := new(storedBlock)
+	err := rlp.DecodeBytes(data, stored)
+	if err != nil {
+		return nil, err
+	}
+
+	return stored.receiptsBlock()
+}
+
+func (rlpCodec) encode(w io.Writer, block *receiptsBlock) error {
+	stored, err := newStoredBlock(block)
+	if err != nil {
+		return err
+	}
+
+	return rlp.Encode(w, stored)
+}
+
+func (rlpCodec) decode(r io.Reader) (*receiptsBlock, error) {
+	stored := new(storedBlock)
+	err := rlp.NewStream(r, 0).Decode(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	return stored.receiptsBlock()
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) marshal(block *receiptsBlock) ([]byte, error) {
+	stored, err := newStoredBlock(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Marshal(stored)
+}
+
+func (protobufCodec) unmarshal(data []byte) (*receiptsBlock, error) {
+	stored := new(storedBlock)
+	err := proto.Unmarshal(data, stored)
+	if err != nil {
+		return nil, err
+	}
+
+	return stored.receiptsBlock()
+}
+
+// encode marshals the whole block first, protobuf messages cannot be
+// streamed.
+func (codec protobufCodec) encode(w io.Writer, block *receiptsBlock) error {
+	data, err := codec.marshal(block)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// decode reads the whole block first, protobuf messages cannot be streamed.
+func (codec protobufCodec) decode(r io.Reader) (*receiptsBlock, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return codec.unmarshal(data)
+}
+
+type cborCodec struct{}
+
+func (cborCodec) marshal(block *receiptsBlock) ([]byte, error) {
+	stored, err := newStoredBlock(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return cbor.Marshal(stored)
+}
+
+func (cborCodec) unmarshal(data []byte) (*receiptsBlock, error) {
+	stored := new(storedBlock)
+	err := cbor.Unmarshal(data, stored)
+	if err != nil {
+		return nil, err
+	}
+
+	return stored.receiptsBlock()
+}
+
+func (cborCodec) encode(w io.Writer, block *receiptsBlock) error {
+	stored, err := newStoredBlock(block)
+	if err != nil {
+		return err
+	}
+
+	return cbor.NewEncoder(w).Encode(stored)
+}
+
+func (cborCodec) decode(r io.Reader) (*receiptsBlock, error) {
+	stored := new(storedBlock)
+	err := cbor.NewDecoder(r).Decode(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	return stored.receiptsBlock()
+}
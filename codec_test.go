@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCodecBlock returns a block with the fields that the binary formats
+// derive on decoding filled in, as they are in blocks fetched from a node.
+func testCodecBlock(t testing.TB) *receiptsBlock {
+	block, _ := testExportBlock(t)
+	block.Version = receiptsBlockVersion
+	block.Uncles = []*types.Header{{Number: block.Header.Number, Difficulty: block.Header.Difficulty, Extra: []byte{}}}
+	block.DecodedLogs = []*decodedLog{{Event: "Transfer", Args: []*decodedArg{{Name: "value", Type: "uint256", Value: "1000"}}}}
+
+	for i, receipt := range block.Receipts {
+		receipt.BlockHash = block.Hash
+		receipt.BlockNumber = block.Header.Number
+		receipt.TransactionIndex = uint(i)
+		for _, l := range receipt.Logs {
+			l.BlockNumber = block.Header.Number.Uint64()
+			l.BlockHash = block.Hash
+			l.TxHash = receipt.TxHash
+			l.TxIndex = uint(i)
+		}
+		receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+	}
+
+	return block
+}
+
+func TestBlockCodecs(t *testing.T) {
+	block := testCodecBlock(t)
+	assert.Equal(t, block.Header.Hash(), block.Hash)
+
+	expected, err := marshalReceiptBlock(block)
+	assert.NoError(t, err)
+
+	for _, format := range blockFormats {
+		data, err := encodeBlock(format, block)
+		assert.NoError(t, err, format)
+		if format != blockFormatJSON {
+			assert.True(t, len(data) < len(expected), format)
+		}
+
+		decoded, err := decodeBlock(format, data)
+		assert.NoError(t, err, format)
+
+		actual, err := marshalReceiptBlock(decoded)
+		assert.NoError(t, err)
+		assert.JSONEq(t, expected, actual, format)
+	}
+
+	_, err = decodeBlock(blockFormatRLP, "{}")
+	assert.Error(t, err)
+
+	_, err = encodeBlock("xml", block)
+	assert.EqualError(t, err, `unknown block format "xml"`)
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	log "github.com/sirupsen/logrus"
+)
+
+var errUsage = errors.New(`usage:
+  ingestr                          run ingestr
+  ingestr status                   show head, cursor, lag and in-flight blocks
+  ingestr requeue <from> [to]      process a block or range of blocks again
+  ingestr cursor set <block>       move the last finished block
+  ingestr inspect <block>          print a block from the cache or the node
+  ingestr contract <address>       print the transaction that created a contract
+  ingestr transaction <hash>       print a transaction and its receipt from the cache
+  ingestr export <from> <to>       export a range of cached blocks as tables
+  ingestr archive <from> <to>      pack the archives that hold a range of cached blocks
+  ingestr verify -from <block> -to <block> [-requeue]
+                                   check a range of cached blocks and report missing,
+                                   corrupt and inconsistent blocks
+  ingestr dictionary train <from> <to>
+                                   train a zstd dictionary on a range of cached blocks
+  ingestr reencrypt <from> <to>    move the blocks, objects and archives of a range
+                                   of cached blocks to ENCRYPTION_KEY_ID
+  ingestr config                   print the effective configuration
+
+flags must come before the command, e.g. ingestr -config ingestr.yaml status.
+with several pipelines, select one with -chain-name.
+run ingestr -h for the list of flags`)
+
+// runCommand runs an operator subcommand instead of the ingestion loop. It
+// uses the same configuration as the main process.
+func runCommand(args []string, conf *config) error {
+	if args[0] == "config" {
+		printConfig(conf, os.Stdout)
+		return nil
+	}
+
+	// Commands act on a single pipeline, selected with -chain-name
+	conf, err := conf.pipelineConfig(conf.chainName)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "status":
+		return runStatusCommand(conf, os.Stdout)
+	case "requeue":
+		if len(args) < 2 || len(args) > 3 {
+			return errUsage
+		}
+		from, err := parseBlockNumber(args[1])
+		if err != nil {
+			return err
+		}
+		to := from
+		if len(args) == 3 {
+			to, err = parseBlockNumber(args[2])
+			if err != nil {
+				return err
+			}
+		}
+		return runRequeueCommand(conf, from, to, os.Stdout)
+	case "cursor":
+		if len(args) != 3 || args[1] != "set" {
+			return errUsage
+		}
+		block, err := parseBlockNumber(args[2])
+		if err != nil {
+			return err
+		}
+		return runCursorCommand(conf, block, os.Stdout)
+	case "inspect":
+		if len(args) != 2 {
+			return errUsage
+		}
+		block, err := parseBlockNumber(args[1])
+		if err != nil {
+			return err
+		}
+		return runInspectCommand(conf, createS3Client(conf, nil), block, os.Stdout)
+	case "contract":
+		if len(args) != 2 {
+			return errUsage
+		}
+		if !common.IsHexAddress(args[1]) {
+			return fmt.Errorf("invalid address: %s", args[1])
+		}
+		return runContractCommand(conf, common.HexToAddress(args[1]), os.Stdout)
+	case "transaction":
+		if len(args) != 2 {
+			return errUsage
+		}
+		hash, err := hexutil.Decode(args[1])
+		if err != nil || len(hash) != common.HashLength {
+			return fmt.Errorf("invalid transaction hash: %s", args[1])
+		}
+		return runTransactionCommand(conf, common.BytesToHash(hash), os.Stdout)
+	case "export":
+		if len(args) != 3 {
+			return errUsage
+		}
+		from, err := parseBlockNumber(args[1])
+		if err != nil {
+			return err
+		}
+		to, err := parseBlockNumber(args[2])
+		if err != nil {
+			return err
+		}
+		s3Client := createS3Client(conf, nil)
+		return runExportCommand(conf, s3Client, from, to, os.Stdout)
+	case "archive":
+		if len(args) != 3 {
+			return errUsage
+		}
+		from, err := parseBlockNumber(args[1])
+		if err != nil {
+			return err
+		}
+		to, err := parseBlockNumber(args[2])
+		if err != nil {
+			return err
+		}
+		return runArchiveCommand(conf, createS3Client(conf, nil), from, to, os.Stdout)
+	case "verify":
+		flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+		from := flags.String("from", "", "The first block to verify")
+		to := flags.String("to", "", "The last block to verify")
+		requeue := flags.Bool("requeue", false, "Requeue the missing, corrupt and inconsistent blocks")
+		if flags.Parse(args[1:]) != nil || flags.NArg() > 0 || *from == "" || *to == "" {
+			return errUsage
+		}
+		fromBlock, err := parseBlockNumber(*from)
+		if err != nil {
+			return err
+		}
+		toBlock, err := parseBlockNumber(*to)
+		if err != nil {
+			return err
+		}
+		return runVerifyCommand(conf, fromBlock, toBlock, *requeue, os.Stdout)
+	case "dictionary":
+		if len(args) != 4 || args[1] != "train" {
+			return errUsage
+		}
+		from, err := parseBlockNumber(args[2])
+		if err != nil {
+			return err
+		}
+		to, err := parseBlockNumber(args[3])
+		if err != nil {
+			return err
+		}
+		return runDictionaryCommand(conf, createS3Client(conf, nil), from, to, os.Stdout)
+	case "reencrypt":
+		if len(args) != 3 {
+			return errUsage
+		}
+		from, err := parseBlockNumber(args[1])
+		if err != nil {
+			return err
+		}
+		to, err := parseBlockNumber(args[2])
+		if err != nil {
+			return err
+		}
+		return runReencryptCommand(conf, createS3Client(conf, nil), from, to, os.Stdout)
+	default:
+		return errUsage
+	}
+}
+
+func parseBlockNumber(value string) (*big.Int, error) {
+	block, ok := new(big.Int).SetString(value, 10)
+	if !ok || block.Sign() < 0 {
+		return nil, fmt.Errorf("invalid block number: %s", value)
+	}
+
+	return block, nil
+}
+
+func runStatusCommand(conf *config, out io.Writer) error {
+	redisClient, err := createRedisClient(conf)
+	if err != nil {
+		return err
+	}
+	defer closeRedisClient(redisClient)
+
+	ethClient, err := createRealEthClient(conf.ethNodeHost, conf.ethNodePort)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), msToDuration(conf.httpReqTimeoutMS))
+	defer cancelFn()
+	head, err := ethClient.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	return writeStatus(head.Number, redisClient, out)
+}
+
+func writeStatus(head *big.Int, redisClient redisClient, out io.Writer) error {
+	lastFinishedBlock, err := redisClient.getLastFinishedBlock()
+	if err != nil {
+		return err
+	}
+
+	paused, err := redisClient.isPaused()
+	if err != nil {
+		return err
+	}
+
+	working, err := redisClient.getWorkingBlocks()
+	if err != nil {
+		return err
+	}
+
+	requeued, err := redisClient.getRequeuedCount()
+	if err != nil {
+		return err
+	}
+
+	deadLetters, err := redisClient.getDeadLetters()
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(writer, "head\t%s\n", head)
+	if lastFinishedBlock != nil {
+		fmt.Fprintf(writer, "cursor\t%s\n", lastFinishedBlock)
+		fmt.Fprintf(writer, "lag\t%s\n", new(big.Int).Sub(head, lastFinishedBlock))
+	} else {
+		fmt.Fprintf(writer, "cursor\tnone\n")
+	}
+	fmt.Fprintf(writer, "paused\t%t\n", paused)
+	fmt.Fprintf(writer, "in-flight\t%d\n", len(working))
+	for _, block := range working {
+		age := time.Since(block.ClaimedAt).Truncate(time.Second)
+		fmt.Fprintf(writer, "  %s\t%s\t%s\n", block.Number, block.Owner, age)
+	}
+	fmt.Fprintf(writer, "requeued\t%d\n", requeued)
+	fmt.Fprintf(writer, "dead letters\t%d\n", len(deadLetters))
+	for _, block := range deadLetters {
+		fmt.Fprintf(writer, "  %s\n", block)
+	}
+
+	return writer.Flush()
+}
+
+func runRequeueCommand(conf *config, from *big.Int, to *big.Int, out io.Writer) error {
+	err := checkRequeueRange(from, to)
+	if err != nil {
+		return err
+	}
+
+	redisClient, err := createRedisClient(conf)
+	if err != nil {
+		return err
+	}
+	defer closeRedisClient(redisClient)
+
+	err = redisClient.requeueBlocks(from, to)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "requeued blocks %s to %s\n", from, to)
+	return nil
+}
+
+func runCursorCommand(conf *config, block *big.Int, out io.Writer) error {
+	redisClient, err := createRedisClient(conf)
+	if err != nil {
+		return err
+	}
+	defer closeRedisClient(redisClient)
+
+	previous, err := redisClient.getLastFinishedBlock()
+	if err != nil {
+		return err
+	}
+
+	err = redisClient.setLastFinishedBlock(block)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "moved cursor from %v to %s\n", previous, block)
+	return nil
+}
+
+func runInspectCommand(conf *config, s3Client s3Client, blockNumber *big.Int, out io.Writer) error {
+	// Only missing blocks are fetched from the node, so that corrupt blocks
+	// and failing requests are reported
+	data, format, err := s3Client.GetBlock(blockNumber)
+	if err != nil && !isNoSuchKey(err) {
+		return err
+	}
+	if err != nil {
+		fmt.Fprintf(out, "block not in cache, fetching from node\n")
+
+		ethClient, err := createRealEthClient(conf.ethNodeHost, conf.ethNodePort)
+		if err != nil {
+			return err
+		}
+
+		receiptsBlock, err := fetchReceiptsBlock(blockNumber, conf, &clients{eth: ethClient}, log.NewEntry(log.StandardLogger()))
+		if err != nil {
+			return err
+		}
+
+		data, err = marshalReceiptBlock(receiptsBlock)
+		if err != nil {
+			return err
+		}
+	} else if format != blockFormatJSON {
+		// Blocks in binary formats are printed as JSON
+		block, err := decodeBlock(format, data)
+		if err != nil {
+			return err
+		}
+
+		data, err = marshalReceiptBlock(block)
+		if err != nil {
+			return err
+		}
+	}
+
+	var pretty bytes.Buffer
+	err = json.Indent(&pretty, []byte(data), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	pretty.WriteString("\n")
+	_, err = pretty.WriteTo(out)
+	return err
+}
+
+func runContractCommand(conf *config, address common.Address, out io.Writer) error {
+	redisClient, err := createRedisClient(conf)
+	if err != nil {
+		return err
+	}
+	defer closeRedisClient(redisClient)
+
+	creation, err := lookupContractCreation(redisClient, address)
+	if err != nil {
+		return err
+	}
+	if creation == nil {
+		return errors.New(contractNotFound(address, conf))
+	}
+
+	data, err := json.MarshalIndent(creation, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "%s\n", data)
+	return err
+}
+
+func runTransactionCommand(conf *config, hash common.Hash, out io.Writer) error {
+	redisClient, err := createRedisClient(conf)
+	if err != nil {
+		return err
+	}
+	defer closeRedisClient(redisClient)
+
+	s3Client := createS3Client(conf, nil)
+
+	lookup, err := lookupTransaction(redisClient, s3Client, hash)
+	if err != nil {
+		return err
+	}
+	if lookup == nil {
+		return fmt.Errorf("transaction %s is not in the index", hash.Hex())
+	}
+
+	data, err := json.MarshalIndent(lookup, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "%s\n", data)
+	return err
+}
+
+// runExportCommand exports a range of cached blocks in batches of
+// EXPORT_BATCH_SIZE, starting at the from block.
+func runExportCommand(conf *config, s3Client s3Client, from *big.Int, to *big.Int, out io.Writer) error {
+	if conf.exportFormat == exportFormatNone {
+		return errors.New("EXPORT_FORMAT must be set to export blocks")
+	}
+	if to.Cmp(from) < 0 {
+		return fmt.Errorf("to block %s is before from block %s", to, from)
+	}
+
+	size := big.NewInt(int64(conf.exportBatchSize))
+	for start := new(big.Int).Set(from); start.Cmp(to) <= 0; start = new(big.Int).Add(start, size) {
+		end := new(big.Int).Add(start, size)
+		end.Sub(end, big.NewInt(1))
+		if end.Cmp(to) > 0 {
+			end.Set(to)
+		}
+
+		err := exportRange(start, end, conf.exportFormat, s3Client)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "exported blocks %s to %s\n", start, end)
+	}
+
+	return nil
+}
+
+// runArchiveCommand packs every archive of ARCHIVE_SIZE blocks that holds a
+// block from the range. Archives are aligned to multiples of their size, so
+// blocks outside of the range may be archived too.
+func runArchiveCommand(conf *config, s3Client s3Client, from *big.Int, to *big.Int, out io.Writer) error {
+	if conf.archiveSize == 0 {
+		return errors.New("ARCHIVE_SIZE must be set to archive blocks")
+	}
+	if to.Cmp(from) < 0 {
+		return fmt.Errorf("to block %s is before from block %s", to, from)
+	}
+
+	size := big.NewInt(int64(conf.archiveSize))
+	for start := archiveStart(from, conf.archiveSize); start.Cmp(to) <= 0; start = new(big.Int).Add(start, size) {
+		end := new(big.Int).Add(start, size)
+		end.Sub(end, big.NewInt(1))
+
+		err := archiveRange(start, end, conf.blockFormat, conf.archiveDeleteBlocks, s3Client)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "archived blocks %s to %s\n", start, end)
+	}
+
+	return nil
+}
+
+// runVerifyCommand verifies a range of cached blocks and optionally requeues
+// the blocks that failed.
+func runVerifyCommand(conf *config, from *big.Int, to *big.Int, requeue bool, out io.Writer) error {
+	if to.Cmp(from) < 0 {
+		return fmt.Errorf("to block %s is before from block %s", to, from)
+	}
+
+	s3Client := createS3Client(conf, nil)
+	problems, err := verifyBlocks(from, to, s3Client)
+	if err != nil {
+		return err
+	}
+
+	err = writeVerifyReport(from, to, problems, out)
+	if err != nil || !requeue || len(problems) == 0 {
+		return err
+	}
+
+	redisClient, err := createRedisClient(conf)
+	if err != nil {
+		return err
+	}
+	defer closeRedisClient(redisClient)
+
+	return requeueProblems(problems, s3Client, redisClient, out)
+}
+
+// runDictionaryCommand trains a zstd dictionary on a range of cached blocks,
+// encoded in the configured format, and stores it in the bucket. Dictionaries
+// are never overwritten, so blocks compressed with an older dictionary can
+// still be read.
+func runDictionaryCommand(conf *config, s3Client s3Client, from *big.Int, to *big.Int, out io.Writer) error {
+	if to.Cmp(from) < 0 {
+		return fmt.Errorf("to block %s is before from block %s", to, from)
+	}
+
+	var samples [][]byte
+	for n := new(big.Int).Set(from); n.Cmp(to) <= 0; n.Add(n, big.NewInt(1)) {
+		data, format, err := s3Client.GetBlock(n)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("block %s: %s", n, err)
+		}
+
+		data, err = convertBlock(data, format, conf.blockFormat)
+		if err != nil {
+			return fmt.Errorf("block %s: %s", n, err)
+		}
+
+		samples = append(samples, []byte(data))
+	}
+
+	dictionary, id, err := trainZstdDictionary(samples, conf.zstdDictionarySize)
+	if err != nil {
+		return err
+	}
+
+	err = s3Client.StoreFile(dictionaryKey(id), string(dictionary), "application/octet-stream")
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "trained dictionary %d on %d blocks\n", id, len(samples))
+	fmt.Fprintf(out, "set COMPRESSION=zstd and ZSTD_DICTIONARY_ID=%d to use it\n", id)
+	return nil
+}
+
+// reencryptedObjects are the objects next to a block that are reencrypted with
+// it.
+var reencryptedObjects = []string{tracesObject, stateDiffsObject, tokenTransfersObject}
+
+// runReencryptCommand moves a range of cached blocks, the objects next to them
+// and the archives that hold them to the current master key, e.g. after
+// ENCRYPTION_KEY_ID was rotated. Encrypted objects only have their data key
+// wrapped again, objects that are not encrypted yet are encrypted.
+func runReencryptCommand(conf *config, s3Client s3Client, from *big.Int, to *big.Int, out io.Writer) error {
+	if conf.encryption == encryptionNone {
+		return errors.New("ENCRYPTION must be set to reencrypt blocks")
+	}
+	if to.Cmp(from) < 0 {
+		return fmt.Errorf("to block %s is before from block %s", to, from)
+	}
+
+	objects := 0
+	for n := new(big.Int).Set(from); n.Cmp(to) <= 0; n.Add(n, big.NewInt(1)) {
+		changed, err := s3Client.ReencryptBlock(n, reencryptedObjects)
+		objects += changed
+		if err != nil {
+			return fmt.Errorf("block %s: %s", n, err)
+		}
+	}
+
+	archives := 0
+	if conf.archiveSize > 0 {
+		size := big.NewInt(int64(conf.archiveSize))
+		for start := archiveStart(from, conf.archiveSize); start.Cmp(to) <= 0; start = new(big.Int).Add(start, size) {
+			changed, err := s3Client.ReencryptArchive(start)
+			if err != nil {
+				return err
+			}
+			if changed {
+				archives++
+			}
+		}
+	}
+
+	fmt.Fprintf(out, "reencrypted %d objects and %d archives of blocks %s to %s\n", objects, archives, from, to)
+	return nil
+}
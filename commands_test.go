@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/prettymuchbryce/ingestr/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBlockNumber(t *testing.T) {
+	block, err := parseBlockNumber("8886217")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8886217), block.Int64())
+
+	_, err = parseBlockNumber("-1")
+	assert.Error(t, err)
+
+	_, err = parseBlockNumber("0x10")
+	assert.Error(t, err)
+}
+
+func TestWriteStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingestr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	embedded := testCreateEmbeddedClient(t, dir, 60)
+	defer embedded.close()
+
+	assert.NoError(t, embedded.setLastFinishedBlock(big.NewInt(100)))
+	_, err = embedded.getNextWorkingBlock(big.NewInt(200))
+	assert.NoError(t, err)
+
+	assert.NoError(t, embedded.requeueBlocks(big.NewInt(90), big.NewInt(92)))
+	for i := 0; i < deadLetterFailures; i++ {
+		_, err = embedded.recordBlockFailure(big.NewInt(95))
+		assert.NoError(t, err)
+	}
+	_, err = embedded.recordBlockFailure(big.NewInt(96))
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	err = writeStatus(big.NewInt(150), embedded, &out)
+	assert.NoError(t, err)
+
+	assert.Contains(t, out.String(), "cursor        100")
+	assert.Contains(t, out.String(), "lag           50")
+	assert.Contains(t, out.String(), "in-flight     1")
+	assert.Contains(t, out.String(), "101")
+	assert.Contains(t, out.String(), "requeued      3")
+	assert.Contains(t, out.String(), "dead letters  1\n  95\n")
+}
+
+func TestInspectCommand(t *testing.T) {
+	blockNumber := big.NewInt(8816481)
+	s3 := &mocks.S3Client{}
+	s3.On("GetBlock", blockNumber).Return("", "", &corruptBlockError{blockNumber, "checksum does not match"}).Once()
+	s3.On("GetBlock", blockNumber).Return(testBlockReceipts, blockFormatJSON, nil).Once()
+
+	// A corrupt block is reported instead of fetching the block from the node
+	var out bytes.Buffer
+	err := runInspectCommand(testConf, s3, blockNumber, &out)
+	assert.IsType(t, &corruptBlockError{}, err)
+	assert.Empty(t, out.String())
+
+	err = runInspectCommand(testConf, s3, blockNumber, &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), `"hash": "0x5715f190c16d0b954ee2741b255cdb5930b738ef7edba01852df8a721c81409b"`)
+}
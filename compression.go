@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms of stored objects.
+const (
+	compressionGzip   = "gzip"
+	compressionZstd   = "zstd"
+	compressionSnappy = "snappy"
+	compressionNone   = "none"
+)
+
+// identityEncoding is the Content-Encoding of uncompressed objects. Objects
+// without a Content-Encoding were stored before compression was configurable
+// and are gzipped.
+const identityEncoding = "identity"
+
+// compressor compresses objects with the configured algorithm and
+// decompresses objects stored with any algorithm.
+type compressor struct {
+	algorithm    string
+	gzipLevel    int
+	dictionaryID uint32
+
+	// loadDictionary returns the zstd dictionary with the given ID.
+	loadDictionary func(id uint32) ([]byte, error)
+
+	lock         sync.Mutex
+	encoder      *zstd.Encoder
+	writers      sync.Pool
+	decoders     map[uint32]*zstd.Decoder
+	dictionaries map[uint32][]byte
+}
+
+func newCompressor(algorithm string, gzipLevel int, dictionaryID uint32, loadDictionary func(id uint32) ([]byte, error)) *compressor {
+	return &compressor{
+		algorithm:      algorithm,
+		gzipLevel:      gzipLevel,
+		dictionaryID:   dictionaryID,
+		loadDictionary: loadDictionary,
+		decoders:       make(map[uint32]*zstd.Decoder),
+		dictionaries:   make(map[uint32][]byte),
+	}
+}
+
+// contentEncoding is the Content-Encoding of the objects that are compressed.
+func (c *compressor) contentEncoding() string {
+	switch c.algorithm {
+	case compressionNone:
+		return identityEncoding
+	default:
+		return c.algorithm
+	}
+}
+
+func (c *compressor) compress(data []byte) ([]byte, error) {
+	switch c.algorithm {
+	case compressionGzip:
+		var buffer bytes.Buffer
+		gzipWriter, err := gzip.NewWriterLevel(&buffer, c.gzipLevel)
+		if err != nil {
+			return nil, err
+		}
+		gzipWriter.Write(data)
+		gzipWriter.Close()
+		return buffer.Bytes(), nil
+	case compressionZstd:
+		encoder, err := c.zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(data, nil), nil
+	case compressionSnappy:
+		return snappy.Encode(nil, data), nil
+	case compressionNone:
+		return data, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", c.algorithm)
+	}
+}
+
+// decompress decompresses an object with the given Content-Encoding. Zstd
+// objects compressed with a dictionary have its ID in dictionaryID.
+func (c *compressor) decompress(contentEncoding string, dictionaryID uint32, data []byte) ([]byte, error) {
+	switch contentEncoding {
+	case "", compressionGzip:
+		// HTTP clients may have decompressed the object already
+		if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+			return data, nil
+		}
+
+		gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+
+		return ioutil.ReadAll(gzipReader)
+	case compressionZstd:
+		decoder, err := c.zstdDecoder(dictionaryID)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.DecodeAll(data, nil)
+	case compressionSnappy:
+		return snappy.Decode(nil, data)
+	case identityEncoding:
+		return data, nil
+	default:
+		return nil, fmt.Errorf("unknown content encoding %q", contentEncoding)
+	}
+}
+
+// writer returns a writer that compresses everything written to it into w.
+// The compressed data is complete once the writer is closed. Snappy compresses
+// whole blocks, so snappy data is buffered until then.
+func (c *compressor) writer(w io.Writer) (io.WriteCloser, error) {
+	switch c.algorithm {
+	case compressionGzip:
+		return gzip.NewWriterLevel(w, c.gzipLevel)
+	case compressionZstd:
+		if encoder, ok := c.writers.Get().(*zstd.Encoder); ok {
+			encoder.Reset(w)
+			return &zstdWriter{encoder, c}, nil
+		}
+
+		options := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if c.dictionaryID != 0 {
+			dictionary, err := c.dictionary(c.dictionaryID)
+			if err != nil {
+				return nil, err
+			}
+			options = append(options, zstd.WithEncoderDict(dictionary))
+		}
+		encoder, err := zstd.NewWriter(w, options...)
+		if err != nil {
+			return nil, err
+		}
+		return &zstdWriter{encoder, c}, nil
+	case compressionSnappy:
+		return &snappyWriter{w: w}, nil
+	case compressionNone:
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", c.algorithm)
+	}
+}
+
+// reader returns a reader that decompresses r by its Content-Encoding, like
+// decompress.
+func (c *compressor) reader(contentEncoding string, dictionaryID uint32, r io.Reader) (io.ReadCloser, error) {
+	switch contentEncoding {
+	case "", compressionGzip:
+		buffered := bufio.NewReader(r)
+		magic, err := buffered.Peek(2)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		// HTTP clients may have decompressed the object already
+		if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+			return ioutil.NopCloser(buffered), nil
+		}
+		return gzip.NewReader(buffered)
+	case compressionZstd:
+		options := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+		if dictionaryID != 0 {
+			dictionary, err := c.dictionary(dictionaryID)
+			if err != nil {
+				return nil, err
+			}
+			options = append(options, zstd.WithDecoderDicts(dictionary))
+		}
+		decoder, err := zstd.NewReader(r, options...)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case compressionSnappy:
+		compressed, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		data, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	case identityEncoding:
+		return ioutil.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("unknown content encoding %q", contentEncoding)
+	}
+}
+
+// zstdWriter returns its encoder to the compressor once it is closed, so that
+// the buffers of encoders are reused by later streams.
+type zstdWriter struct {
+	*zstd.Encoder
+	c *compressor
+}
+
+func (writer *zstdWriter) Close() error {
+	err := writer.Encoder.Close()
+	writer.c.writers.Put(writer.Encoder)
+	return err
+}
+
+// snappyWriter buffers data until it is closed and then writes it as a single
+// snappy block.
+type snappyWriter struct {
+	w      io.Writer
+	buffer bytes.Buffer
+}
+
+func (writer *snappyWriter) Write(data []byte) (int, error) {
+	return writer.buffer.Write(data)
+}
+
+func (writer *snappyWriter) Close() error {
+	_, err := writer.w.Write(snappy.Encode(nil, writer.buffer.Bytes()))
+	return err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// dictionary returns a zstd dictionary. Dictionaries are loaded once.
+func (c *compressor) dictionary(id uint32) ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.loadDictionaryLocked(id)
+}
+
+func (c *compressor) loadDictionaryLocked(id uint32) ([]byte, error) {
+	if dictionary, ok := c.dictionaries[id]; ok {
+		return dictionary, nil
+	}
+
+	dictionary, err := c.loadDictionary(id)
+	if err != nil {
+		return nil, fmt.Errorf("zstd dictionary %d: %s", id, err)
+	}
+
+	c.dictionaries[id] = dictionary
+	return dictionary, nil
+}
+
+func (c *compressor) zstdEncoder() (*zstd.Encoder, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.encoder != nil {
+		return c.encoder, nil
+	}
+
+	var options []zstd.EOption
+	if c.dictionaryID != 0 {
+		dictionary, err := c.loadDictionaryLocked(c.dictionaryID)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, zstd.WithEncoderDict(dictionary))
+	}
+
+	encoder, err := zstd.NewWriter(nil, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	c.encoder = encoder
+	return encoder, nil
+}
+
+// zstdDecoder returns a decoder for objects compressed with the dictionary, or
+// without a dictionary if dictionaryID is 0. Every version of the dictionary
+// that has been used is kept, so that objects compressed before a new
+// dictionary was trained can still be read.
+func (c *compressor) zstdDecoder(dictionaryID uint32) (*zstd.Decoder, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if decoder, ok := c.decoders[dictionaryID]; ok {
+		return decoder, nil
+	}
+
+	var options []zstd.DOption
+	if dictionaryID != 0 {
+		dictionary, err := c.loadDictionaryLocked(dictionaryID)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, zstd.WithDecoderDicts(dictionary))
+	}
+
+	decoder, err := zstd.NewReader(nil, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	c.decoders[dictionaryID] = decoder
+	return decoder, nil
+}
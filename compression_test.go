@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"testing"
+	"testing/iotest"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/prettymuchbryce/ingestr/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func testDictionarySamples(t *testing.T, count int) [][]byte {
+	var samples [][]byte
+	for i := 0; i < count; i++ {
+		block := testCodecBlock(t)
+		block.Header.Number = big.NewInt(int64(8886217 + i))
+		data, err := encodeBlock(blockFormatJSON, block)
+		assert.NoError(t, err)
+		samples = append(samples, []byte(data))
+	}
+
+	return samples
+}
+
+func TestCompressor(t *testing.T) {
+	data := bytes.Repeat([]byte(testBlockReceipts), 3)
+
+	for _, algorithm := range []string{compressionGzip, compressionZstd, compressionSnappy, compressionNone} {
+		c := newCompressor(algorithm, 9, 0, nil)
+
+		compressed, err := c.compress(data)
+		assert.NoError(t, err, algorithm)
+		if algorithm != compressionNone {
+			assert.True(t, len(compressed) < len(data), algorithm)
+		}
+
+		// Objects are decompressed by their encoding, not the configuration
+		decompressed, err := newCompressor(compressionNone, 6, 0, nil).decompress(c.contentEncoding(), 0, compressed)
+		assert.NoError(t, err, algorithm)
+		assert.Equal(t, data, decompressed, algorithm)
+	}
+
+	c := newCompressor(compressionGzip, 6, 0, nil)
+	compressed, err := c.compress(data)
+	assert.NoError(t, err)
+
+	// Objects without an encoding were gzipped
+	decompressed, err := c.decompress("", 0, compressed)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decompressed)
+
+	// Objects that were decompressed in transit are returned as is
+	decompressed, err = c.decompress(compressionGzip, 0, data)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decompressed)
+
+	_, err = c.decompress("br", 0, compressed)
+	assert.EqualError(t, err, `unknown content encoding "br"`)
+}
+
+func TestCompressorStreams(t *testing.T) {
+	data := bytes.Repeat([]byte(testBlockReceipts), 3)
+
+	for _, algorithm := range []string{compressionGzip, compressionZstd, compressionSnappy, compressionNone} {
+		c := newCompressor(algorithm, 9, 0, nil)
+
+		var buffer bytes.Buffer
+		writer, err := c.writer(&buffer)
+		assert.NoError(t, err, algorithm)
+		for _, chunk := range [][]byte{data[:100], data[100:]} {
+			_, err = writer.Write(chunk)
+			assert.NoError(t, err, algorithm)
+		}
+		assert.NoError(t, writer.Close(), algorithm)
+
+		// Streams can be decompressed as a whole and the other way around
+		compressed, err := c.compress(data)
+		assert.NoError(t, err, algorithm)
+		decompressed, err := c.decompress(c.contentEncoding(), 0, buffer.Bytes())
+		assert.NoError(t, err, algorithm)
+		assert.Equal(t, data, decompressed, algorithm)
+
+		for _, stream := range [][]byte{buffer.Bytes(), compressed} {
+			reader, err := c.reader(c.contentEncoding(), 0, iotest.OneByteReader(bytes.NewReader(stream)))
+			assert.NoError(t, err, algorithm)
+			decompressed, err = ioutil.ReadAll(reader)
+			assert.NoError(t, err, algorithm)
+			assert.Equal(t, data, decompressed, algorithm)
+			assert.NoError(t, reader.Close(), algorithm)
+		}
+	}
+
+	c := newCompressor(compressionGzip, 6, 0, nil)
+
+	// Objects that were decompressed in transit are returned as is
+	for _, data := range [][]byte{data, {}, {'{'}} {
+		reader, err := c.reader(compressionGzip, 0, bytes.NewReader(data))
+		assert.NoError(t, err)
+		decompressed, err := ioutil.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, data, decompressed)
+	}
+
+	reader, err := c.reader(compressionZstd, 0, bytes.NewReader(data))
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(reader)
+	assert.Error(t, err)
+
+	_, err = c.reader("br", 0, bytes.NewReader(data))
+	assert.EqualError(t, err, `unknown content encoding "br"`)
+}
+
+func TestZstdDictionary(t *testing.T) {
+	samples := testDictionarySamples(t, 60)
+
+	dictionary, id, err := trainZstdDictionary(samples[:50], 16384)
+	assert.NoError(t, err)
+	assert.True(t, id >= dictionaryMinID)
+
+	loads := 0
+	loadDictionary := func(requested uint32) ([]byte, error) {
+		loads++
+		if requested != id {
+			return nil, errors.New("not found")
+		}
+		return dictionary, nil
+	}
+
+	withDictionary := newCompressor(compressionZstd, 6, id, loadDictionary)
+	withoutDictionary := newCompressor(compressionZstd, 6, 0, nil)
+
+	for _, sample := range samples[50:] {
+		compressed, err := withDictionary.compress(sample)
+		assert.NoError(t, err)
+
+		plain, err := withoutDictionary.compress(sample)
+		assert.NoError(t, err)
+		assert.True(t, len(compressed) < len(plain))
+
+		decompressed, err := withDictionary.decompress(compressionZstd, id, compressed)
+		assert.NoError(t, err)
+		assert.Equal(t, sample, decompressed)
+	}
+
+	// Streams use the same dictionary
+	var buffer bytes.Buffer
+	writer, err := withDictionary.writer(&buffer)
+	assert.NoError(t, err)
+	_, err = writer.Write(samples[59])
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+
+	reader, err := withDictionary.reader(compressionZstd, id, &buffer)
+	assert.NoError(t, err)
+	decompressed, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, samples[59], decompressed)
+	assert.NoError(t, reader.Close())
+
+	// The dictionary is loaded once
+	assert.Equal(t, 1, loads)
+
+	_, err = withDictionary.decompress(compressionZstd, id+1, nil)
+	assert.EqualError(t, err, fmt.Sprintf("zstd dictionary %d: not found", id+1))
+
+	_, _, err = trainZstdDictionary(nil, 16384)
+	assert.Error(t, err)
+}
+
+func TestDictionaryCommand(t *testing.T) {
+	samples := testDictionarySamples(t, 10)
+
+	s3Client := &mocks.S3Client{}
+	for i, sample := range samples {
+		s3Client.On("GetBlock", big.NewInt(int64(100+i))).Return(string(sample), blockFormatJSON, nil)
+	}
+	s3Client.On("GetBlock", big.NewInt(110)).Return("", "", awserr.New(s3.ErrCodeNoSuchKey, "", nil))
+	s3Client.On("StoreFile", mock.Anything, mock.Anything, "application/octet-stream").Return(nil)
+
+	conf := *testConf
+	conf.zstdDictionarySize = 4096
+
+	var out bytes.Buffer
+	err := runDictionaryCommand(&conf, s3Client, big.NewInt(100), big.NewInt(110), &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "on 10 blocks")
+
+	_, id, err := trainZstdDictionary(samples, conf.zstdDictionarySize)
+	assert.NoError(t, err)
+	s3Client.AssertCalled(t, "StoreFile", dictionaryKey(id), mock.Anything, "application/octet-stream")
+}
+
+// BenchmarkBlockStorage stores and loads a block through a real S3 client and
+// its uploader, against a test server. Run it with -benchmem: blocks are
+// encoded straight into the compressor, and objects that fit in a part are
+// stored with a single request, so no part buffers are allocated. The
+// pipe benchmark streams into the uploader as blocks were stored before.
+func BenchmarkBlockStorage(b *testing.B) {
+	block := testCodecBlock(b)
+	for i := 0; i < 10; i++ {
+		block.Transactions = append(block.Transactions, block.Transactions...)
+		block.Receipts = append(block.Receipts, block.Receipts...)
+	}
+	blockNumber := block.Header.Number
+
+	for _, format := range []string{blockFormatJSON, blockFormatCBOR} {
+		for _, algorithm := range []string{compressionGzip, compressionZstd} {
+			client, server := testS3Client(b, algorithm, newEncryptor("", nil), 0)
+			client.blockFormat = format
+			name := format + "/" + algorithm
+
+			encode := func(w io.Writer) error {
+				return writeBlock(w, format, block)
+			}
+			err := client.WriteBlock(blockNumber, format, encode)
+			assert.NoError(b, err)
+			object := server.object(client.blockKey(blockNumber, format))
+			b.Logf("%s: %d bytes stored", name, len(object.body))
+
+			b.Run(name+"/store", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					err := client.WriteBlock(blockNumber, format, encode)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+
+			b.Run(name+"/store/pipe", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					reader, writer := io.Pipe()
+					go func() {
+						writer.CloseWithError(client.writeObject(writer, nil, encode))
+					}()
+
+					_, err := client.uploader.Upload(&s3manager.UploadInput{
+						Bucket: &client.bucket,
+						Key:    aws.String(client.blockKey(blockNumber, format) + ".pipe"),
+						Body:   reader,
+					})
+					reader.Close()
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+
+			b.Run(name+"/load", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					_, _, err := readCachedBlock(blockNumber, client)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,744 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type config struct {
+	abiDirectory              string
+	contractIndex             bool
+	contractIndexBytecode     bool
+	adminAddress              string
+	adminToken                string
+	archiveDeleteBlocks       bool
+	archiveSize               int
+	blockFormat               string
+	chainID                   *big.Int
+	chainName                 string
+	compression               string
+	confirmationPolicy        string
+	embeddedDBPath            string
+	encryption                string
+	encryptionKeyID           string
+	encryptionKeys            keyfileKeys
+	ethNodeHost               string
+	ethNodePort               string
+	exportBatchSize           int
+	exportFormat              string
+	httpReqTimeoutMS          int
+	instanceID                string
+	kmsAWS                    awsClientConfig
+	maxConcurrency            int
+	minConfirmations          int
+	newBlockTimeoutMS         int
+	filters                   []*notificationFilter
+	gzipLevel                 int
+	redisAddress              string
+	redisArchiveCursorKey     string
+	redisDB                   int
+	redisExportCursorKey      string
+	redisIndexKey             string
+	redisLastFinishedBlockKey string
+	redisPassword             string
+	redisNetworkKey           string
+	redisPausedKey            string
+	redisRequeueBlockSetKey   string
+	redisWorkingBlockSetKey   string
+	redisWorkingOwnerKey      string
+	redisWorkingTimeSetKey    string
+	readAllBlockFormats       bool
+	s3AWS                     awsClientConfig
+	s3BucketURI               string
+	s3KeyPrefix               string
+	s3TimeoutMS               int
+	snsAWS                    awsClientConfig
+	snsTimeoutMS              int
+	snsTopic                  string
+	stateDiffMode             string
+	tokenTransfers            bool
+	tokenTransferSnsTopic     string
+	traceMode                 string
+	transactionIndex          bool
+	validateCacheHits         bool
+	traceRetries              int
+	traceRetryDelayMS         int
+	traceTimeoutMS            int
+	workingBlockStart         *big.Int
+	workingBlockTTLSeconds    int
+	zstdDictionaryID          uint32
+	zstdDictionarySize        int
+
+	// values holds the effective value of every setting after defaults, the
+	// config file, environment variables and flags have been applied.
+	values map[string]string
+
+	// pipelines holds the configuration of every chain. Without pipelines in
+	// the config file it only holds the top level configuration.
+	pipelines []*config
+}
+
+// setting describes a single configuration value. It is read from the config
+// file by its lower case name, from the environment by its name, and from the
+// command line by its lower case name with dashes, e.g. -max-concurrency.
+type setting struct {
+	name         string
+	defaultValue string
+	secret       bool
+	description  string
+}
+
+var settings = []setting{
+	{"ABI_DIRECTORY", "", false, "A directory of contract ABIs to decode event logs with. Logs are not decoded if empty"},
+	{"ADMIN_ADDRESS", "", false, "The address to serve the admin API on. Disabled if empty"},
+	{"ADMIN_TOKEN", "", true, "The bearer token required by the admin API"},
+	{"ARCHIVE_DELETE_BLOCKS", "false", false, "Whether to delete the objects of single blocks once they are archived"},
+	{"ARCHIVE_SIZE", "0", false, "The number of blocks in every archive object. Archiving is disabled if 0"},
+	{"BLOCK_FORMAT", "json", false, "The format to store blocks in: json, rlp, protobuf or cbor. Blocks in any format can be read"},
+	{"CHAIN_ID", "", false, "The chain ID the ETH node must serve. Not checked if empty"},
+	{"CHAIN_NAME", "ethereum", false, "The name of the chain. Used to label logs and metrics"},
+	{"COMPRESSION", "gzip", false, "How to compress stored objects: gzip, zstd, snappy or none. Objects compressed in any way can be read"},
+	{"CONFIRMATION_POLICY", "depth", false, "How blocks are confirmed: depth (MIN_CONFIRMATIONS behind the head), safe or finalized"},
+	{"CONTRACT_INDEX", "false", false, "Whether to index the contracts created by every block"},
+	{"CONTRACT_INDEX_BYTECODE", "false", false, "Whether to add the hash of the deployed bytecode to the contract index"},
+	{"EMBEDDED_DB_PATH", "ingestr.db", false, "The path of the embedded database used when no redis address is configured"},
+	{"ENCRYPTION", "none", false, "How to encrypt stored blocks on the client: none, keyfile or kms. Encrypted objects can only be read with their master key"},
+	{"ENCRYPTION_KEYFILE", "", false, "A file of master keys for ENCRYPTION=keyfile, with a key ID and a base64 encoded 32 byte key on every line"},
+	{"ENCRYPTION_KEY_ID", "", false, "The master key that wraps the data keys of new objects: a key ID of the keyfile, or a KMS key ID, ARN or alias"},
+	{"ETH_NODE_HOST", "", false, "Address of the Geth or Parity WebSocket host"},
+	{"ETH_NODE_PORT", "8546", false, "Port of the Geth or Parity WebSocket host"},
+	{"EXPORT_BATCH_SIZE", "100", false, "The number of blocks in every exported file"},
+	{"EXPORT_FORMAT", "none", false, "The format to export blocks, transactions, receipts, logs and token transfers in: none, parquet, csv or ndjson"},
+	{"GZIP_LEVEL", "6", false, "The gzip compression level, from 1 (fastest) to 9 (smallest)"},
+	{"HTTP_TIMEOUT_MS", "15000", false, "The timeout for HTTP requests"},
+	{"INSTANCE_ID", "", false, "The name of this instance. Defaults to the hostname and pid"},
+	{"KMS_ACCESS_KEY_ID", "", false, "The access key ID of static KMS credentials. The default AWS credentials are used if empty"},
+	{"KMS_ENDPOINT", "", false, "The URL of a KMS compatible service, e.g. http://localstack:4566. AWS is used if empty"},
+	{"KMS_PROFILE", "", false, "The profile of the shared AWS config files to connect to KMS with"},
+	{"KMS_REGION", "", false, "The region of the KMS keys. The default AWS region is used if empty"},
+	{"KMS_ROLE_ARN", "", false, "The ARN of a role to assume for KMS"},
+	{"KMS_SECRET_ACCESS_KEY", "", true, "The secret access key of static KMS credentials"},
+	{"MAX_CONCURRENCY", "3", false, "The maximum number of blocks that a single ingestr instance will work on at once"},
+	{"MIN_CONFIRMATIONS", "5", false, "The number of blocks to wait before storing/publishing"},
+	{"NEW_BLOCK_TIMEOUT_MS", "60000", false, "The timeout for requesting new blocks"},
+	{"NOTIFICATION_FILTERS_FILE", "", false, "A YAML file of filters that select which blocks are published. Every block is published if empty"},
+	{"READ_ALL_BLOCK_FORMATS", "false", false, "Whether the pipeline also looks up cached blocks in the formats other than BLOCK_FORMAT, e.g. while a bucket is migrated. Costs a request per format on every cache miss"},
+	{"REDIS_ADDRESS", "", false, "The host of the redis instance. If empty, an embedded database is used"},
+	{"REDIS_ARCHIVE_CURSOR_KEY", "ingestr/archive_cursor", false, "The key for the first block that has not been archived"},
+	{"REDIS_DB", "0", false, "The redis DB"},
+	{"REDIS_EXPORT_CURSOR_KEY", "ingestr/export_cursor", false, "The key for the first block that has not been exported"},
+	{"REDIS_INDEX_KEY", "ingestr/index", false, "The prefix of the keys of the contract and transaction indexes"},
+	{"REDIS_KEY_PREFIX", "", false, "A prefix for every redis key, e.g. mainnet/"},
+	{"REDIS_LAST_FINISHED_BLOCK_KEY", "ingestr/last_finished_block", false, "The key for the last finished block"},
+	{"REDIS_NETWORK_KEY", "ingestr/network", false, "The key for the chain ID and genesis hash of the ingested chain"},
+	{"REDIS_PASSWORD", "", true, "The password of the redis instance"},
+	{"REDIS_PAUSED_KEY", "ingestr/paused", false, "The key that pauses claiming of new blocks while it exists"},
+	{"REDIS_REQUEUE_BLOCK_SET_KEY", "ingestr/requeue_block_set", false, "The key for the requeue block set"},
+	{"REDIS_WORKING_BLOCK_SET_KEY", "ingestr/working_block_set", false, "The key for the working block set"},
+	{"REDIS_WORKING_OWNER_KEY", "ingestr/working_owner_hash", false, "The key for the working owner hash"},
+	{"REDIS_WORKING_TIME_SET_KEY", "ingestr/working_time_set", false, "The key for the working time set"},
+	{"S3_ACCESS_KEY_ID", "", false, "The access key ID of static S3 credentials. The default AWS credentials are used if empty"},
+	{"S3_BUCKET_URI", "", false, "S3 bucket to store blocks in"},
+	{"S3_ENDPOINT", "", false, "The URL of an S3 compatible store, e.g. http://minio:9000. AWS is used if empty"},
+	{"S3_FORCE_PATH_STYLE", "false", false, "Whether to address buckets by path instead of by host name, as most S3 compatible stores require"},
+	{"S3_KEY_PREFIX", "", false, "A prefix for every S3 key, e.g. mainnet/"},
+	{"S3_PROFILE", "", false, "The profile of the shared AWS config files to connect to S3 with"},
+	{"S3_REGION", "", false, "The region of the S3 bucket. The default AWS region is used if empty"},
+	{"S3_ROLE_ARN", "", false, "The ARN of a role to assume for S3"},
+	{"S3_SECRET_ACCESS_KEY", "", true, "The secret access key of static S3 credentials"},
+	{"S3_TIMEOUT_MS", "10000", false, "S3 timeout for storing or retrieving blocks"},
+	{"SNS_ACCESS_KEY_ID", "", false, "The access key ID of static SNS credentials. The default AWS credentials are used if empty"},
+	{"SNS_ENDPOINT", "", false, "The URL of an SNS compatible service, e.g. http://localstack:4566. AWS is used if empty"},
+	{"SNS_PROFILE", "", false, "The profile of the shared AWS config files to connect to SNS with"},
+	{"SNS_REGION", "", false, "The region of the SNS topics. The default AWS region is used if empty"},
+	{"SNS_ROLE_ARN", "", false, "The ARN of a role to assume for SNS"},
+	{"SNS_SECRET_ACCESS_KEY", "", true, "The secret access key of static SNS credentials"},
+	{"SNS_TIMEOUT_MS", "10000", false, "SNS timeout for publishing block numbers"},
+	{"SNS_TOPIC", "", false, "SNS topic ARN"},
+	{"STATE_DIFF_MODE", "none", false, "How to collect state diffs: none, debug (prestateTracer in diff mode) or trace (trace_replayBlockTransactions)"},
+	{"TOKEN_TRANSFERS", "false", false, "Whether to store the ERC-20, ERC-721 and ERC-1155 token transfers of every block"},
+	{"TOKEN_TRANSFER_SNS_TOPIC", "", false, "SNS topic ARN to publish every token transfer to. Disabled if empty"},
+	{"TRACE_MODE", "none", false, "How to trace blocks: none, debug (debug_traceBlockByNumber with callTracer) or trace (trace_block)"},
+	{"TRACE_RETRIES", "3", false, "The number of times a failed trace request is retried"},
+	{"TRACE_RETRY_DELAY_MS", "2000", false, "The delay before retrying a failed trace request"},
+	{"TRACE_TIMEOUT_MS", "120000", false, "The timeout for trace requests"},
+	{"TRANSACTION_INDEX", "false", false, "Whether to index the block and position of every transaction by its hash. Costs roughly 100 bytes of redis memory per transaction"},
+	{"VALIDATE_CACHE_HITS", "false", false, "Whether to compare cached blocks with the canonical hash from the ETH node and ingest orphaned blocks again"},
+	{"WORKING_BLOCK_START", "0", false, "The block to start at when running for the first time"},
+	{"WORKING_BLOCK_TTL_SECONDS", "30", false, "The amount of time before a working block is reconsidered for processing"},
+	{"ZSTD_DICTIONARY_ID", "0", false, "The ID of the zstd dictionary to compress with, as printed by ingestr dictionary train. No dictionary is used if 0"},
+	{"ZSTD_DICTIONARY_SIZE", "112640", false, "The size of the zstd dictionaries trained by ingestr dictionary train"},
+}
+
+// configError lists every problem found while loading the configuration.
+type configError struct {
+	problems []string
+}
+
+func (err *configError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(err.problems, "\n  ")
+}
+
+func settingFlagName(name string) string {
+	return strings.Replace(strings.ToLower(name), "_", "-", -1)
+}
+
+func findSetting(name string) *setting {
+	for i := range settings {
+		if settings[i].name == name {
+			return &settings[i]
+		}
+	}
+
+	return nil
+}
+
+// loadConfig loads the .env files and then the configuration. Flags are read
+// from args, and the arguments that follow the flags are returned.
+func loadConfig(args []string) (*config, []string, error) {
+	env := os.Getenv("ENV")
+
+	if env == "" {
+		godotenv.Load(".env.development")
+	}
+
+	err := godotenv.Load()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("error loading .env file: %s", err)
+	}
+
+	return parseConfig(args)
+}
+
+// parseConfig builds the configuration from defaults, the config file,
+// environment variables and flags, in that order. Empty environment variables
+// are treated as unset. Pipelines in the config file override these values for
+// a single chain.
+func parseConfig(args []string) (*config, []string, error) {
+	values := make(map[string]string)
+	for _, s := range settings {
+		values[s.name] = s.defaultValue
+	}
+
+	flags := flag.NewFlagSet("ingestr", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "A YAML config file")
+	for _, s := range settings {
+		flags.String(settingFlagName(s.name), "", s.description)
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parser := &configParser{}
+	var pipelineValues []map[string]string
+
+	if *configFile != "" {
+		file, err := readConfigFile(*configFile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		parser.prefix = *configFile + ": "
+		parser.override(values, file.values, false)
+
+		for _, overrides := range file.pipelines {
+			pipeline := make(map[string]string)
+			parser.override(pipeline, overrides, true)
+			pipelineValues = append(pipelineValues, pipeline)
+		}
+		parser.prefix = ""
+	}
+
+	for _, s := range settings {
+		if value := os.Getenv(s.name); value != "" {
+			values[s.name] = value
+		}
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if settingFlagName(s.name) == f.Name {
+				values[s.name] = f.Value.String()
+			}
+		}
+	})
+
+	if values["INSTANCE_ID"] == "" {
+		hostname, _ := os.Hostname()
+		values["INSTANCE_ID"] = hostname + "-" + strconv.Itoa(os.Getpid())
+	}
+
+	parser.values = values
+	conf := parser.config()
+
+	if conf.adminAddress != "" && conf.adminToken == "" {
+		parser.problem("ADMIN_TOKEN", "is required when ADMIN_ADDRESS is set")
+	}
+
+	if len(pipelineValues) == 0 {
+		conf.pipelines = []*config{conf}
+	}
+
+	chainNames := make(map[string]bool)
+	stores := make(map[string]string)
+	buckets := make(map[string]string)
+	for i, overrides := range pipelineValues {
+		pipelineParser := &configParser{
+			values: make(map[string]string),
+			prefix: fmt.Sprintf("pipeline %d (%s): ", i, overrides["CHAIN_NAME"]),
+		}
+		for name, value := range values {
+			pipelineParser.values[name] = value
+		}
+		for name, value := range overrides {
+			pipelineParser.values[name] = value
+		}
+
+		if _, ok := overrides["CHAIN_NAME"]; !ok {
+			pipelineParser.problem("CHAIN_NAME", "is required for every pipeline")
+		}
+
+		// Every pipeline has its own embedded database unless it sets one,
+		// e.g. ingestr-mainnet.db
+		if _, ok := overrides["EMBEDDED_DB_PATH"]; !ok {
+			path := pipelineParser.values["EMBEDDED_DB_PATH"]
+			extension := filepath.Ext(path)
+			pipelineParser.values["EMBEDDED_DB_PATH"] = strings.TrimSuffix(path, extension) + "-" + overrides["CHAIN_NAME"] + extension
+		}
+
+		pipelineConf := pipelineParser.config()
+		conf.pipelines = append(conf.pipelines, pipelineConf)
+
+		if chainNames[pipelineConf.chainName] {
+			pipelineParser.problem("CHAIN_NAME", "%q is used by more than one pipeline", pipelineConf.chainName)
+		}
+		chainNames[pipelineConf.chainName] = true
+
+		// Pipelines must not share their coordinator state
+		store, storeSetting := "embedded "+pipelineConf.embeddedDBPath, "EMBEDDED_DB_PATH"
+		if pipelineConf.redisAddress != "" {
+			store = fmt.Sprintf("redis %s/%d %s", pipelineConf.redisAddress, pipelineConf.redisDB, pipelineConf.redisLastFinishedBlockKey)
+			storeSetting = "REDIS_KEY_PREFIX"
+		}
+		if other, ok := stores[store]; ok {
+			pipelineParser.problem(storeSetting, "must differ from pipeline %s, both use %s", other, store)
+		}
+		stores[store] = pipelineConf.chainName
+
+		// or their blocks
+		bucket := fmt.Sprintf("s3 %s%s/%s", pipelineConf.s3AWS.endpoint, pipelineConf.s3BucketURI, pipelineConf.s3KeyPrefix)
+		if other, ok := buckets[bucket]; ok {
+			pipelineParser.problem("S3_KEY_PREFIX", "must differ from pipeline %s, both use %s", other, bucket)
+		}
+		buckets[bucket] = pipelineConf.chainName
+
+		parser.problems = append(parser.problems, pipelineParser.problems...)
+	}
+
+	if len(parser.problems) > 0 {
+		return nil, nil, &configError{problems: parser.problems}
+	}
+
+	return conf, flags.Args(), nil
+}
+
+// pipelineConfig returns the configuration of the pipeline with the given
+// chain name.
+func (conf *config) pipelineConfig(chainName string) (*config, error) {
+	var names []string
+	for _, pipeline := range conf.pipelines {
+		if pipeline.chainName == chainName {
+			return pipeline, nil
+		}
+		names = append(names, pipeline.chainName)
+	}
+
+	return nil, fmt.Errorf("unknown chain %q, use -chain-name to select one of: %s", chainName, strings.Join(names, ", "))
+}
+
+type configFile struct {
+	values    map[string]string
+	pipelines []map[string]string
+}
+
+func readConfigFile(path string) (*configFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw struct {
+		Values    map[string]interface{}   `yaml:",inline"`
+		Pipelines []map[string]interface{} `yaml:"pipelines"`
+	}
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	file := &configFile{values: configFileValues(raw.Values)}
+	for _, pipeline := range raw.Pipelines {
+		file.pipelines = append(file.pipelines, configFileValues(pipeline))
+	}
+
+	return file, nil
+}
+
+func configFileValues(raw map[string]interface{}) map[string]string {
+	values := make(map[string]string)
+	for key, value := range raw {
+		if value == nil {
+			values[key] = ""
+			continue
+		}
+		values[key] = fmt.Sprint(value)
+	}
+
+	return values
+}
+
+// printConfig writes the effective configuration with secrets redacted,
+// followed by the settings that each pipeline overrides.
+func printConfig(conf *config, out io.Writer) {
+	printSettings(conf.values, nil, out)
+
+	for _, pipeline := range conf.pipelines {
+		if pipeline == conf {
+			continue
+		}
+
+		fmt.Fprintf(out, "\n[%s]\n", pipeline.chainName)
+		printSettings(pipeline.values, conf.values, out)
+	}
+}
+
+func printSettings(values map[string]string, parent map[string]string, out io.Writer) {
+	for _, s := range settings {
+		value := values[s.name]
+		if parent != nil && parent[s.name] == value {
+			continue
+		}
+		if s.secret && value != "" {
+			value = "<redacted>"
+		}
+		fmt.Fprintf(out, "%s=%s\n", s.name, value)
+	}
+}
+
+// configParser converts setting values and collects every problem instead of
+// stopping at the first one.
+type configParser struct {
+	values   map[string]string
+	prefix   string
+	problems []string
+}
+
+// processSettings apply to the whole process and cannot be set per pipeline.
+var processSettings = map[string]bool{
+	"ADMIN_ADDRESS": true,
+	"ADMIN_TOKEN":   true,
+	"INSTANCE_ID":   true,
+}
+
+func (parser *configParser) problem(name string, format string, args ...interface{}) {
+	parser.problems = append(parser.problems, parser.prefix+name+" "+fmt.Sprintf(format, args...))
+}
+
+// override copies the values of a config file section into values.
+func (parser *configParser) override(values map[string]string, overrides map[string]string, pipeline bool) {
+	for key, value := range overrides {
+		name := strings.ToUpper(key)
+		if findSetting(name) == nil {
+			parser.problems = append(parser.problems, fmt.Sprintf("%sunknown setting %q", parser.prefix, key))
+			continue
+		}
+		if pipeline && processSettings[name] {
+			parser.problem(name, "cannot be set per pipeline")
+			continue
+		}
+		values[name] = value
+	}
+}
+
+// config converts the values into a config and validates them.
+func (parser *configParser) config() *config {
+	redisKeyPrefix := parser.string("REDIS_KEY_PREFIX")
+
+	conf := &config{
+		abiDirectory:              parser.string("ABI_DIRECTORY"),
+		adminAddress:              parser.string("ADMIN_ADDRESS"),
+		adminToken:                parser.string("ADMIN_TOKEN"),
+		archiveDeleteBlocks:       parser.bool("ARCHIVE_DELETE_BLOCKS"),
+		archiveSize:               parser.int("ARCHIVE_SIZE", 0, 100000),
+		blockFormat:               parser.oneOf("BLOCK_FORMAT", blockFormatJSON, blockFormatRLP, blockFormatProtobuf, blockFormatCBOR),
+		chainID:                   parser.optionalBigInt("CHAIN_ID"),
+		chainName:                 parser.required("CHAIN_NAME"),
+		contractIndex:             parser.bool("CONTRACT_INDEX"),
+		contractIndexBytecode:     parser.bool("CONTRACT_INDEX_BYTECODE"),
+		compression:               parser.oneOf("COMPRESSION", compressionGzip, compressionZstd, compressionSnappy, compressionNone),
+		confirmationPolicy:        parser.oneOf("CONFIRMATION_POLICY", confirmationDepth, confirmationSafe, confirmationFinalized),
+		embeddedDBPath:            parser.string("EMBEDDED_DB_PATH"),
+		encryption:                parser.oneOf("ENCRYPTION", encryptionNone, encryptionKeyfile, encryptionKMS),
+		encryptionKeyID:           parser.string("ENCRYPTION_KEY_ID"),
+		encryptionKeys:            parser.keyfile("ENCRYPTION_KEYFILE"),
+		ethNodeHost:               parser.url("ETH_NODE_HOST", "ws", "wss", "http", "https"),
+		ethNodePort:               strconv.Itoa(parser.int("ETH_NODE_PORT", 1, 65535)),
+		exportBatchSize:           parser.int("EXPORT_BATCH_SIZE", 1, 100000),
+		exportFormat:              parser.oneOf("EXPORT_FORMAT", exportFormatNone, exportFormatParquet, exportFormatCSV, exportFormatNDJSON),
+		httpReqTimeoutMS:          parser.int("HTTP_TIMEOUT_MS", 1, math.MaxInt32),
+		instanceID:                parser.string("INSTANCE_ID"),
+		kmsAWS:                    parser.awsClient("KMS"),
+		maxConcurrency:            parser.int("MAX_CONCURRENCY", 1, 10000),
+		minConfirmations:          parser.int("MIN_CONFIRMATIONS", 0, 100000),
+		newBlockTimeoutMS:         parser.int("NEW_BLOCK_TIMEOUT_MS", 1, math.MaxInt32),
+		filters:                   parser.filters("NOTIFICATION_FILTERS_FILE"),
+		gzipLevel:                 parser.int("GZIP_LEVEL", 1, 9),
+		redisAddress:              parser.string("REDIS_ADDRESS"),
+		redisArchiveCursorKey:     redisKeyPrefix + parser.required("REDIS_ARCHIVE_CURSOR_KEY"),
+		redisDB:                   parser.int("REDIS_DB", 0, 15),
+		redisExportCursorKey:      redisKeyPrefix + parser.required("REDIS_EXPORT_CURSOR_KEY"),
+		redisIndexKey:             redisKeyPrefix + parser.required("REDIS_INDEX_KEY"),
+		redisLastFinishedBlockKey: redisKeyPrefix + parser.required("REDIS_LAST_FINISHED_BLOCK_KEY"),
+		redisNetworkKey:           redisKeyPrefix + parser.required("REDIS_NETWORK_KEY"),
+		redisPassword:             parser.string("REDIS_PASSWORD"),
+		redisPausedKey:            redisKeyPrefix + parser.required("REDIS_PAUSED_KEY"),
+		redisRequeueBlockSetKey:   redisKeyPrefix + parser.required("REDIS_REQUEUE_BLOCK_SET_KEY"),
+		redisWorkingBlockSetKey:   redisKeyPrefix + parser.required("REDIS_WORKING_BLOCK_SET_KEY"),
+		redisWorkingOwnerKey:      redisKeyPrefix + parser.required("REDIS_WORKING_OWNER_KEY"),
+		redisWorkingTimeSetKey:    redisKeyPrefix + parser.required("REDIS_WORKING_TIME_SET_KEY"),
+		s3AWS:                     parser.awsClient("S3"),
+		s3BucketURI:               parser.required("S3_BUCKET_URI"),
+		s3KeyPrefix:               parser.string("S3_KEY_PREFIX"),
+		s3TimeoutMS:               parser.int("S3_TIMEOUT_MS", 1, math.MaxInt32),
+		snsAWS:                    parser.awsClient("SNS"),
+		snsTimeoutMS:              parser.int("SNS_TIMEOUT_MS", 1, math.MaxInt32),
+		snsTopic:                  parser.arn("SNS_TOPIC"),
+		stateDiffMode:             parser.oneOf("STATE_DIFF_MODE", traceModeNone, traceModeDebug, traceModeTrace),
+		tokenTransfers:            parser.bool("TOKEN_TRANSFERS"),
+		tokenTransferSnsTopic:     parser.optionalArn("TOKEN_TRANSFER_SNS_TOPIC"),
+		traceMode:                 parser.oneOf("TRACE_MODE", traceModeNone, traceModeDebug, traceModeTrace),
+		traceRetries:              parser.int("TRACE_RETRIES", 0, 100),
+		traceRetryDelayMS:         parser.int("TRACE_RETRY_DELAY_MS", 0, math.MaxInt32),
+		traceTimeoutMS:            parser.int("TRACE_TIMEOUT_MS", 1, math.MaxInt32),
+		transactionIndex:          parser.bool("TRANSACTION_INDEX"),
+		validateCacheHits:         parser.bool("VALIDATE_CACHE_HITS"),
+		readAllBlockFormats:       parser.bool("READ_ALL_BLOCK_FORMATS"),
+		workingBlockStart:         parser.block("WORKING_BLOCK_START"),
+		workingBlockTTLSeconds:    parser.int("WORKING_BLOCK_TTL_SECONDS", 1, math.MaxInt32),
+		zstdDictionaryID:          uint32(parser.int("ZSTD_DICTIONARY_ID", 0, math.MaxInt32)),
+		zstdDictionarySize:        parser.int("ZSTD_DICTIONARY_SIZE", 1024, 1<<24),
+		values:                    parser.values,
+	}
+
+	if conf.zstdDictionaryID != 0 && conf.compression != compressionZstd {
+		parser.problem("ZSTD_DICTIONARY_ID", "requires COMPRESSION=zstd")
+	}
+	if conf.archiveDeleteBlocks && conf.archiveSize == 0 {
+		parser.problem("ARCHIVE_DELETE_BLOCKS", "requires ARCHIVE_SIZE to be set")
+	}
+	if conf.encryption != encryptionNone && conf.encryptionKeyID == "" {
+		parser.problem("ENCRYPTION_KEY_ID", "is required with ENCRYPTION=%s", conf.encryption)
+	}
+	if conf.encryption == encryptionKeyfile && parser.values["ENCRYPTION_KEYFILE"] == "" {
+		parser.problem("ENCRYPTION_KEYFILE", "is required with ENCRYPTION=%s", encryptionKeyfile)
+	}
+	if conf.encryption == encryptionKeyfile && conf.encryptionKeys != nil && conf.encryptionKeyID != "" {
+		if _, ok := conf.encryptionKeys[conf.encryptionKeyID]; !ok {
+			parser.problem("ENCRYPTION_KEY_ID", "%q is not in ENCRYPTION_KEYFILE", conf.encryptionKeyID)
+		}
+	}
+	conf.s3AWS.forcePathStyle = parser.bool("S3_FORCE_PATH_STYLE")
+
+	return conf
+}
+
+func (parser *configParser) string(name string) string {
+	return parser.values[name]
+}
+
+func (parser *configParser) required(name string) string {
+	value := parser.values[name]
+	if value == "" {
+		parser.problem(name, "is required")
+	}
+
+	return value
+}
+
+func (parser *configParser) int(name string, min int, max int) int {
+	value, err := strconv.Atoi(parser.values[name])
+	if err != nil {
+		parser.problem(name, "must be an integer, got %q", parser.values[name])
+		return 0
+	}
+
+	if value < min || value > max {
+		parser.problem(name, "must be between %d and %d, got %d", min, max, value)
+	}
+
+	return value
+}
+
+func (parser *configParser) filters(name string) []*notificationFilter {
+	path := parser.values[name]
+	if path == "" {
+		return nil
+	}
+
+	filters, err := readFilterFile(path)
+	if err != nil {
+		parser.problem(name, "could not be read: %s", err)
+		return nil
+	}
+
+	for _, filter := range filters {
+		if filter.SNSTopic != "" && !strings.HasPrefix(filter.SNSTopic, "arn:") {
+			parser.problem(name, "filter %q must have an ARN as sns_topic, got %q", filter.Name, filter.SNSTopic)
+		}
+	}
+
+	return filters
+}
+
+// keyfile reads the master keys of a keyfile, or returns nil if the value is
+// empty.
+func (parser *configParser) keyfile(name string) keyfileKeys {
+	path := parser.values[name]
+	if path == "" {
+		return nil
+	}
+
+	keys, err := readKeyfile(path)
+	if err != nil {
+		parser.problem(name, "could not be read: %s", err)
+		return nil
+	}
+
+	return keys
+}
+
+func (parser *configParser) bool(name string) bool {
+	value, err := strconv.ParseBool(parser.values[name])
+	if err != nil {
+		parser.problem(name, "must be true or false, got %q", parser.values[name])
+		return false
+	}
+
+	return value
+}
+
+func (parser *configParser) block(name string) *big.Int {
+	value, ok := new(big.Int).SetString(parser.values[name], 10)
+	if !ok || value.Sign() < 0 {
+		parser.problem(name, "must be a block number, got %q", parser.values[name])
+		return big.NewInt(0)
+	}
+
+	return value
+}
+
+// optionalBigInt returns nil if the value is empty.
+func (parser *configParser) optionalBigInt(name string) *big.Int {
+	if parser.values[name] == "" {
+		return nil
+	}
+
+	value, ok := new(big.Int).SetString(parser.values[name], 10)
+	if !ok || value.Sign() <= 0 {
+		parser.problem(name, "must be a positive integer, got %q", parser.values[name])
+		return nil
+	}
+
+	return value
+}
+
+func (parser *configParser) oneOf(name string, options ...string) string {
+	value := parser.values[name]
+	for _, option := range options {
+		if value == option {
+			return value
+		}
+	}
+
+	parser.problem(name, "must be one of %s, got %q", strings.Join(options, ", "), value)
+	return value
+}
+
+func (parser *configParser) url(name string, schemes ...string) string {
+	parser.required(name)
+	return parser.optionalURL(name, schemes...)
+}
+
+// optionalURL returns an empty string if the value is empty.
+func (parser *configParser) optionalURL(name string, schemes ...string) string {
+	value := parser.values[name]
+	if value == "" {
+		return value
+	}
+
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.Host == "" {
+		parser.problem(name, "must be a URL, got %q", value)
+		return value
+	}
+
+	for _, scheme := range schemes {
+		if parsed.Scheme == scheme {
+			return value
+		}
+	}
+
+	parser.problem(name, "must use one of the schemes %s, got %q", strings.Join(schemes, ", "), parsed.Scheme)
+	return value
+}
+
+func (parser *configParser) arn(name string) string {
+	parser.required(name)
+	return parser.optionalArn(name)
+}
+
+// optionalArn returns an empty string if the value is empty.
+func (parser *configParser) optionalArn(name string) string {
+	value := parser.values[name]
+	if value != "" && !strings.HasPrefix(value, "arn:") {
+		parser.problem(name, "must be an ARN, got %q", value)
+	}
+
+	return value
+}
+
+// awsClient reads the settings of an AWS client, such as S3_ENDPOINT, by the
+// prefix of their names.
+func (parser *configParser) awsClient(prefix string) awsClientConfig {
+	conf := awsClientConfig{
+		endpoint:        parser.optionalURL(prefix+"_ENDPOINT", "http", "https"),
+		region:          parser.string(prefix + "_REGION"),
+		accessKeyID:     parser.string(prefix + "_ACCESS_KEY_ID"),
+		secretAccessKey: parser.string(prefix + "_SECRET_ACCESS_KEY"),
+		profile:         parser.string(prefix + "_PROFILE"),
+		roleARN:         parser.optionalArn(prefix + "_ROLE_ARN"),
+	}
+
+	if (conf.accessKeyID == "") != (conf.secretAccessKey == "") {
+		parser.problem(prefix+"_ACCESS_KEY_ID", "and %s_SECRET_ACCESS_KEY must be set together", prefix)
+	}
+	if conf.accessKeyID != "" && conf.profile != "" {
+		parser.problem(prefix+"_PROFILE", "cannot be used with %s_ACCESS_KEY_ID", prefix)
+	}
+
+	return conf
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConfigPrecedence(t *testing.T) {
+	file, err := ioutil.TempFile("", "ingestr*.yaml")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	file.WriteString("max_concurrency: 7\nadmin_address: ':8080'\nadmin_token: from-file\n")
+	file.Close()
+
+	conf, args, err := parseConfig([]string{"-config", file.Name(), "status"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"status"}, args)
+	assert.Equal(t, ":8080", conf.adminAddress)
+
+	// The environment overrides the file
+	assert.Equal(t, os.Getenv("MAX_CONCURRENCY"), conf.values["MAX_CONCURRENCY"])
+
+	// Flags override the environment
+	conf, _, err = parseConfig([]string{"-config", file.Name(), "-max-concurrency", "9"})
+	assert.NoError(t, err)
+	assert.Equal(t, 9, conf.maxConcurrency)
+
+	var out bytes.Buffer
+	printConfig(conf, &out)
+	assert.Contains(t, out.String(), "ADMIN_TOKEN=<redacted>")
+	assert.NotContains(t, out.String(), "from-file")
+}
+
+func TestParseConfigValidation(t *testing.T) {
+	_, _, err := parseConfig([]string{
+		"-max-concurrency", "three",
+		"-eth-node-port", "70000",
+		"-eth-node-host", "ftp://localhost",
+		"-working-block-start", "-5",
+		"-admin-address", ":8080",
+	})
+
+	configErr, ok := err.(*configError)
+	assert.True(t, ok)
+	assert.Equal(t, []string{
+		"ETH_NODE_HOST must use one of the schemes ws, wss, http, https, got \"ftp\"",
+		"ETH_NODE_PORT must be between 1 and 65535, got 70000",
+		"MAX_CONCURRENCY must be an integer, got \"three\"",
+		"WORKING_BLOCK_START must be a block number, got \"-5\"",
+		"ADMIN_TOKEN is required when ADMIN_ADDRESS is set",
+	}, configErr.problems)
+}
+
+func TestParseConfigPipelines(t *testing.T) {
+	file, err := ioutil.TempFile("", "ingestr*.yaml")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	file.WriteString(`
+min_confirmations: 12
+pipelines:
+  - chain_name: mainnet
+    redis_key_prefix: mainnet/
+    s3_key_prefix: mainnet/
+  - chain_name: goerli
+    redis_key_prefix: goerli/
+    eth_node_host: ws://goerli.local
+    working_block_start: 100
+`)
+	file.Close()
+
+	conf, _, err := parseConfig([]string{"-config", file.Name()})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(conf.pipelines))
+
+	mainnet, err := conf.pipelineConfig("mainnet")
+	assert.NoError(t, err)
+	assert.Equal(t, "mainnet/"+testConf.redisLastFinishedBlockKey, mainnet.redisLastFinishedBlockKey)
+	assert.Equal(t, "mainnet/", mainnet.s3KeyPrefix)
+	assert.Equal(t, testConf.ethNodeHost, mainnet.ethNodeHost)
+	assert.Equal(t, "ingestr-mainnet.db", mainnet.embeddedDBPath)
+
+	goerli, err := conf.pipelineConfig("goerli")
+	assert.NoError(t, err)
+	assert.Equal(t, "ws://goerli.local", goerli.ethNodeHost)
+	assert.Equal(t, int64(100), goerli.workingBlockStart.Int64())
+
+	_, err = conf.pipelineConfig("ethereum")
+	assert.Error(t, err)
+}
+
+func TestParseConfigPipelineConflicts(t *testing.T) {
+	file, err := ioutil.TempFile("", "ingestr*.yaml")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	file.WriteString(`
+pipelines:
+  - chain_name: mainnet
+  - chain_name: mainnet
+    admin_token: secret
+`)
+	file.Close()
+
+	_, _, err = parseConfig([]string{"-config", file.Name()})
+	configErr, ok := err.(*configError)
+	assert.True(t, ok)
+	assert.Equal(t, 4, len(configErr.problems))
+	assert.Contains(t, configErr.problems[0], "ADMIN_TOKEN cannot be set per pipeline")
+	assert.Contains(t, configErr.problems[1], "CHAIN_NAME \"mainnet\" is used by more than one pipeline")
+	assert.Contains(t, configErr.problems[2], "REDIS_KEY_PREFIX must differ from pipeline mainnet")
+	assert.Contains(t, configErr.problems[3], "S3_KEY_PREFIX must differ from pipeline mainnet")
+
+	file, err = ioutil.TempFile("", "ingestr*.yaml")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	file.WriteString(`
+pipelines:
+  - chain_name: mainnet
+    redis_address: ""
+    s3_key_prefix: mainnet/
+  - chain_name: goerli
+    redis_address: ""
+    s3_key_prefix: goerli/
+    embedded_db_path: ingestr-mainnet.db
+`)
+	file.Close()
+
+	_, _, err = parseConfig([]string{"-config", file.Name()})
+	configErr, ok = err.(*configError)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(configErr.problems))
+	assert.Contains(t, configErr.problems[0], "EMBEDDED_DB_PATH must differ from pipeline mainnet")
+}
+
+func TestParseConfigAWSClients(t *testing.T) {
+	conf, _, err := parseConfig([]string{
+		"-s3-endpoint", "http://minio:9000",
+		"-s3-force-path-style", "true",
+		"-s3-access-key-id", "minio",
+		"-s3-secret-access-key", "minio123",
+		"-sns-region", "eu-west-1",
+		"-sns-profile", "ingestr",
+		"-sns-role-arn", "arn:aws:iam::1:role/ingestr",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, awsClientConfig{
+		endpoint:        "http://minio:9000",
+		forcePathStyle:  true,
+		accessKeyID:     "minio",
+		secretAccessKey: "minio123",
+	}, conf.s3AWS)
+	assert.Equal(t, awsClientConfig{
+		region:  "eu-west-1",
+		profile: "ingestr",
+		roleARN: "arn:aws:iam::1:role/ingestr",
+	}, conf.snsAWS)
+
+	var out bytes.Buffer
+	printConfig(conf, &out)
+	assert.Contains(t, out.String(), "S3_SECRET_ACCESS_KEY=<redacted>")
+
+	_, _, err = parseConfig([]string{
+		"-s3-endpoint", "minio:9000",
+		"-s3-secret-access-key", "minio123",
+		"-sns-access-key-id", "key",
+		"-sns-secret-access-key", "secret",
+		"-sns-profile", "ingestr",
+		"-sns-role-arn", "ingestr",
+	})
+	configErr, ok := err.(*configError)
+	assert.True(t, ok)
+	assert.Equal(t, []string{
+		"S3_ENDPOINT must be a URL, got \"minio:9000\"",
+		"S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY must be set together",
+		"SNS_ROLE_ARN must be an ARN, got \"ingestr\"",
+		"SNS_PROFILE cannot be used with SNS_ACCESS_KEY_ID",
+	}, configErr.problems)
+}
+
+func TestParseConfigEncryption(t *testing.T) {
+	file, err := ioutil.TempFile("", "ingestr")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	file.WriteString("2021-01 " + base64.StdEncoding.EncodeToString(make([]byte, dataKeySize)) + "\n")
+	file.Close()
+
+	conf, _, err := parseConfig([]string{
+		"-encryption", "keyfile",
+		"-encryption-keyfile", file.Name(),
+		"-encryption-key-id", "2021-01",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, encryptionKeyfile, conf.encryption)
+	assert.Len(t, conf.encryptionKeys, 1)
+
+	_, _, err = parseConfig([]string{
+		"-encryption", "keyfile",
+		"-encryption-keyfile", file.Name(),
+		"-encryption-key-id", "2020-01",
+	})
+	configErr, ok := err.(*configError)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"ENCRYPTION_KEY_ID \"2020-01\" is not in ENCRYPTION_KEYFILE"}, configErr.problems)
+
+	_, _, err = parseConfig([]string{
+		"-encryption", "keyfile",
+	})
+	configErr, ok = err.(*configError)
+	assert.True(t, ok)
+	assert.Equal(t, []string{
+		"ENCRYPTION_KEY_ID is required with ENCRYPTION=keyfile",
+		"ENCRYPTION_KEYFILE is required with ENCRYPTION=keyfile",
+	}, configErr.problems)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// contractIndex is the name of the index of contracts by address.
+const contractIndex = "contracts"
+
+// contractCreation records the transaction that deployed a contract. The
+// creator of a contract deployed by another contract is the deploying
+// contract. Contracts deployed by other contracts are only indexed from
+// traces.
+type contractCreation struct {
+	Address         common.Address `json:"address"`
+	Creator         common.Address `json:"creator"`
+	TransactionHash common.Hash    `json:"transactionHash"`
+	BlockNumber     *big.Int       `json:"blockNumber"`
+	BytecodeHash    *common.Hash   `json:"bytecodeHash,omitempty"`
+}
+
+// encodeIndexEntry prefixes an index entry with the block that added it.
+func encodeIndexEntry(blockNumber *big.Int, value []byte) []byte {
+	return append(encodeUint64(blockNumber.Uint64()), value...)
+}
+
+// decodeIndexEntry returns nil if the entry is too short to hold a block.
+func decodeIndexEntry(data []byte) (*big.Int, []byte) {
+	if len(data) < 8 {
+		return nil, nil
+	}
+
+	return new(big.Int).SetBytes(data[:8]), data[8:]
+}
+
+func extractContractCreations(blockNumber *big.Int, block *receiptsBlock) ([]*contractCreation, error) {
+	transactions := make(map[common.Hash]*types.Transaction)
+	for _, tx := range block.Transactions {
+		transactions[tx.Hash()] = tx
+	}
+
+	var creations []*contractCreation
+	for _, receipt := range block.Receipts {
+		if receipt.ContractAddress == (common.Address{}) || !receiptSucceeded(receipt) {
+			continue
+		}
+
+		tx, ok := transactions[receipt.TxHash]
+		if !ok {
+			continue
+		}
+
+		creator, err := transactionSender(tx)
+		if err != nil {
+			return nil, err
+		}
+
+		creations = append(creations, &contractCreation{
+			Address:         receipt.ContractAddress,
+			Creator:         creator,
+			TransactionHash: receipt.TxHash,
+			BlockNumber:     blockNumber,
+		})
+	}
+
+	return creations, nil
+}
+
+// receiptSucceeded returns whether the transaction of a receipt succeeded. The
+// receipt of a failed deployment still has the contract address. Receipts
+// from before Byzantium have a state root instead of a status, and are
+// assumed to have succeeded.
+func receiptSucceeded(receipt *types.Receipt) bool {
+	return receipt.Status == types.ReceiptStatusSuccessful || len(receipt.PostState) > 0
+}
+
+// callFrame is a call frame of geth's callTracer.
+type callFrame struct {
+	Type  string         `json:"type"`
+	From  common.Address `json:"from"`
+	To    common.Address `json:"to"`
+	Error string         `json:"error"`
+	Calls []*callFrame   `json:"calls"`
+}
+
+// debugTrace is the trace of a transaction returned by
+// debug_traceBlockByNumber. Older versions of geth leave out the hash.
+type debugTrace struct {
+	TxHash *common.Hash `json:"txHash"`
+	Result *callFrame   `json:"result"`
+}
+
+// parityTrace is a frame returned by trace_block. Its trace address is the
+// path to the frame from the top level frame of its transaction, and frames
+// come before the frames that they call.
+type parityTrace struct {
+	Type   string `json:"type"`
+	Action struct {
+		From common.Address `json:"from"`
+	} `json:"action"`
+	Result *struct {
+		Address common.Address `json:"address"`
+	} `json:"result"`
+	Error           string       `json:"error"`
+	TransactionHash *common.Hash `json:"transactionHash"`
+	TraceAddress    []int        `json:"traceAddress"`
+}
+
+// extractFactoryCreations returns the contracts that other contracts deployed,
+// from the CREATE and CREATE2 frames in the traces of a block. Frames that
+// failed, or that a frame above them reverted, created nothing. Top level
+// frames are skipped, since their contracts are in the receipts.
+func extractFactoryCreations(blockNumber *big.Int, block *receiptsBlock, traces json.RawMessage, mode string) ([]*contractCreation, error) {
+	var creations []*contractCreation
+	switch mode {
+	case traceModeDebug:
+		var transactions []*debugTrace
+		err := json.Unmarshal(traces, &transactions)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, trace := range transactions {
+			if trace.Result == nil {
+				continue
+			}
+
+			if trace.TxHash == nil {
+				if i >= len(block.Transactions) {
+					return nil, fmt.Errorf("trace %d has no transaction", i)
+				}
+				hash := block.Transactions[i].Hash()
+				trace.TxHash = &hash
+			}
+			creations = appendFrameCreations(creations, blockNumber, *trace.TxHash, trace.Result, 0)
+		}
+	case traceModeTrace:
+		var frames []*parityTrace
+		err := json.Unmarshal(traces, &frames)
+		if err != nil {
+			return nil, err
+		}
+
+		reverted := make(map[string]bool)
+		for _, frame := range frames {
+			// Block rewards belong to no transaction
+			if frame.TransactionHash == nil {
+				continue
+			}
+
+			depth := len(frame.TraceAddress)
+			if frame.Error != "" || (depth > 0 && reverted[traceFramePath(*frame.TransactionHash, frame.TraceAddress[:depth-1])]) {
+				reverted[traceFramePath(*frame.TransactionHash, frame.TraceAddress)] = true
+				continue
+			}
+
+			if frame.Type != "create" || depth == 0 || frame.Result == nil {
+				continue
+			}
+
+			creations = append(creations, &contractCreation{
+				Address:         frame.Result.Address,
+				Creator:         frame.Action.From,
+				TransactionHash: *frame.TransactionHash,
+				BlockNumber:     blockNumber,
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unknown trace mode %q", mode)
+	}
+
+	return creations, nil
+}
+
+// appendFrameCreations appends the contracts that a call frame of a
+// transaction and the frames it called deployed.
+func appendFrameCreations(creations []*contractCreation, blockNumber *big.Int, hash common.Hash, frame *callFrame, depth int) []*contractCreation {
+	if frame.Error != "" {
+		return creations
+	}
+
+	if depth > 0 && (frame.Type == "CREATE" || frame.Type == "CREATE2") {
+		creations = append(creations, &contractCreation{
+			Address:         frame.To,
+			Creator:         frame.From,
+			TransactionHash: hash,
+			BlockNumber:     blockNumber,
+		})
+	}
+
+	for _, call := range frame.Calls {
+		creations = appendFrameCreations(creations, blockNumber, hash, call, depth+1)
+	}
+
+	return creations
+}
+
+// traceFramePath identifies a frame of trace_block.
+func traceFramePath(hash common.Hash, traceAddress []int) string {
+	return fmt.Sprint(hash.Hex(), traceAddress)
+}
+
+// indexContractCreations replaces the contracts that the block added to the
+// contract index. Processing a block again, e.g. after a reorg or during a
+// backfill, removes the contracts it no longer creates. Contracts deployed by
+// other contracts are indexed if the traces of the block are given.
+func indexContractCreations(blockNumber *big.Int, block *receiptsBlock, traces json.RawMessage, p *pipeline) error {
+	creations, err := extractContractCreations(blockNumber, block)
+	if err != nil {
+		return err
+	}
+
+	if traces != nil {
+		factoryCreations, err := extractFactoryCreations(blockNumber, block, traces, p.config.traceMode)
+		if err != nil {
+			return err
+		}
+		creations = append(creations, factoryCreations...)
+	}
+
+	entries := make(map[string][]byte)
+	for _, creation := range creations {
+		if p.config.contractIndexBytecode {
+			ctx, cancelFn := context.WithTimeout(context.Background(), msToDuration(p.config.httpReqTimeoutMS))
+			code, err := p.clients.eth.CodeAt(ctx, creation.Address, blockNumber)
+			cancelFn()
+			if err != nil {
+				return err
+			}
+
+			if len(code) > 0 {
+				hash := crypto.Keccak256Hash(code)
+				creation.BytecodeHash = &hash
+			}
+		}
+
+		data, err := json.Marshal(creation)
+		if err != nil {
+			return err
+		}
+		entries[creation.Address.Hex()] = data
+	}
+
+	return p.clients.redis.setBlockIndex(contractIndex, blockNumber, entries)
+}
+
+// contractNotFound describes a contract that is not in the index. Without
+// traces, contracts deployed by other contracts are never in it.
+func contractNotFound(address common.Address, conf *config) string {
+	if conf.traceMode == traceModeNone {
+		return fmt.Sprintf("contract %s is not in the index, contracts deployed by other contracts are only indexed when TRACE_MODE is set", address.Hex())
+	}
+	return fmt.Sprintf("contract %s is not in the index", address.Hex())
+}
+
+// lookupContractCreation returns nil if the contract is not in the index.
+func lookupContractCreation(redisClient redisClient, address common.Address) (*contractCreation, error) {
+	data, _, err := redisClient.getIndexEntry(contractIndex, address.Hex())
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var creation *contractCreation
+	err = json.Unmarshal(data, &creation)
+	return creation, err
+}
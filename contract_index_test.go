@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func testContractBlock(t testing.TB, nonce uint64) (*receiptsBlock, common.Address, common.Address) {
+	key, err := crypto.GenerateKey()
+	assert.NoError(t, err)
+	creator := crypto.PubkeyToAddress(key.PublicKey)
+
+	tx := types.NewContractCreation(nonce, big.NewInt(0), 100000, big.NewInt(1), []byte{0x60, 0x00})
+	tx, err = types.SignTx(tx, types.NewEIP155Signer(big.NewInt(1)), key)
+	assert.NoError(t, err)
+
+	address := crypto.CreateAddress(creator, nonce)
+	receipt := &types.Receipt{TxHash: tx.Hash(), ContractAddress: address, Status: types.ReceiptStatusSuccessful, Logs: []*types.Log{}}
+
+	return &receiptsBlock{
+		Transactions: []*types.Transaction{tx},
+		Receipts:     []*types.Receipt{receipt},
+	}, creator, address
+}
+
+func testContractIndex(t *testing.T, redisClient redisClient) {
+	conf := *testConf
+	conf.contractIndex = true
+
+	p := createPipeline(&conf)
+	p.clients = &clients{redis: redisClient}
+
+	block, creator, address := testContractBlock(t, 0)
+	err := indexContractCreations(big.NewInt(10), block, nil, p)
+	assert.NoError(t, err)
+
+	creation, err := lookupContractCreation(redisClient, address)
+	assert.NoError(t, err)
+	assert.Equal(t, creator, creation.Creator)
+	assert.Equal(t, block.Transactions[0].Hash(), creation.TransactionHash)
+	assert.Equal(t, int64(10), creation.BlockNumber.Int64())
+
+	// After a reorg the contract is created in block 11 instead
+	err = indexContractCreations(big.NewInt(11), block, nil, p)
+	assert.NoError(t, err)
+	err = indexContractCreations(big.NewInt(10), &receiptsBlock{}, nil, p)
+	assert.NoError(t, err)
+
+	creation, err = lookupContractCreation(redisClient, address)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(11), creation.BlockNumber.Int64())
+
+	// Processing block 11 again without the contract removes it
+	err = indexContractCreations(big.NewInt(11), &receiptsBlock{}, nil, p)
+	assert.NoError(t, err)
+
+	creation, err = lookupContractCreation(redisClient, address)
+	assert.NoError(t, err)
+	assert.Nil(t, creation)
+}
+
+func TestContractIndexRedis(t *testing.T) {
+	defer testClearRedis(redisClientTest)
+	testContractIndex(t, testClients.redis)
+}
+
+func TestContractIndexEmbedded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingestr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	embedded := testCreateEmbeddedClient(t, dir, 60)
+	defer embedded.close()
+
+	testContractIndex(t, embedded)
+}
+
+func TestExtractContractCreations(t *testing.T) {
+	block, creator, address := testContractBlock(t, 0)
+	creations, err := extractContractCreations(big.NewInt(10), block)
+	assert.NoError(t, err)
+	assert.Len(t, creations, 1)
+	assert.Equal(t, address, creations[0].Address)
+	assert.Equal(t, creator, creations[0].Creator)
+
+	// Failed deployments have a contract address, but create no contract
+	block.Receipts[0].Status = types.ReceiptStatusFailed
+	creations, err = extractContractCreations(big.NewInt(10), block)
+	assert.NoError(t, err)
+	assert.Empty(t, creations)
+
+	// Receipts before Byzantium have no status
+	block.Receipts[0].PostState = common.HexToHash("0x01").Bytes()
+	creations, err = extractContractCreations(big.NewInt(10), block)
+	assert.NoError(t, err)
+	assert.Len(t, creations, 1)
+}
+
+func TestExtractFactoryCreations(t *testing.T) {
+	block, creator, address := testContractBlock(t, 0)
+	hash := block.Transactions[0].Hash()
+	factory := common.HexToAddress("0x01")
+	child := common.HexToAddress("0x02")
+	reverted := common.HexToAddress("0x03")
+	failed := common.HexToAddress("0x04")
+
+	// The top level deployment is in the receipts, and frames below a
+	// reverted frame created nothing
+	debug := `[{"result": {"type": "CREATE", "from": "` + creator.Hex() + `", "to": "` + address.Hex() + `", "calls": [
+		{"type": "CALL", "from": "` + address.Hex() + `", "to": "` + factory.Hex() + `", "calls": [
+			{"type": "CREATE2", "from": "` + factory.Hex() + `", "to": "` + child.Hex() + `"}
+		]},
+		{"type": "CALL", "from": "` + address.Hex() + `", "to": "` + factory.Hex() + `", "error": "execution reverted", "calls": [
+			{"type": "CREATE", "from": "` + factory.Hex() + `", "to": "` + reverted.Hex() + `"}
+		]},
+		{"type": "CREATE", "from": "` + address.Hex() + `", "to": "` + failed.Hex() + `", "error": "out of gas"}
+	]}}]`
+	creations, err := extractFactoryCreations(big.NewInt(10), block, json.RawMessage(debug), traceModeDebug)
+	assert.NoError(t, err)
+	assert.Equal(t, []*contractCreation{{
+		Address:         child,
+		Creator:         factory,
+		TransactionHash: hash,
+		BlockNumber:     big.NewInt(10),
+	}}, creations)
+
+	trace := `[
+		{"type": "create", "action": {"from": "` + creator.Hex() + `"}, "result": {"address": "` + address.Hex() + `"}, "transactionHash": "` + hash.Hex() + `", "traceAddress": []},
+		{"type": "call", "action": {"from": "` + address.Hex() + `"}, "result": {}, "transactionHash": "` + hash.Hex() + `", "traceAddress": [0]},
+		{"type": "create", "action": {"from": "` + factory.Hex() + `"}, "result": {"address": "` + child.Hex() + `"}, "transactionHash": "` + hash.Hex() + `", "traceAddress": [0, 0]},
+		{"type": "call", "action": {"from": "` + address.Hex() + `"}, "error": "Reverted", "transactionHash": "` + hash.Hex() + `", "traceAddress": [1]},
+		{"type": "create", "action": {"from": "` + factory.Hex() + `"}, "result": {"address": "` + reverted.Hex() + `"}, "transactionHash": "` + hash.Hex() + `", "traceAddress": [1, 0]},
+		{"type": "create", "action": {"from": "` + address.Hex() + `"}, "error": "Out of gas", "transactionHash": "` + hash.Hex() + `", "traceAddress": [2]},
+		{"type": "reward", "action": {"author": "` + creator.Hex() + `"}, "traceAddress": []}
+	]`
+	creations, err = extractFactoryCreations(big.NewInt(10), block, json.RawMessage(trace), traceModeTrace)
+	assert.NoError(t, err)
+	assert.Equal(t, []*contractCreation{{
+		Address:         child,
+		Creator:         factory,
+		TransactionHash: hash,
+		BlockNumber:     big.NewInt(10),
+	}}, creations)
+
+	// Contracts deployed by a factory are indexed with the block
+	dir, err := ioutil.TempDir("", "ingestr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	embedded := testCreateEmbeddedClient(t, dir, 60)
+	defer embedded.close()
+
+	conf := *testConf
+	conf.traceMode = traceModeDebug
+	p := createPipeline(&conf)
+	p.clients = &clients{redis: embedded}
+
+	err = indexContractCreations(big.NewInt(10), block, json.RawMessage(debug), p)
+	assert.NoError(t, err)
+
+	for _, contract := range []common.Address{address, child} {
+		creation, err := lookupContractCreation(embedded, contract)
+		assert.NoError(t, err)
+		assert.NotNil(t, creation)
+	}
+
+	// Without traces, lookups point out that they are needed
+	assert.Equal(t, "contract "+child.Hex()+" is not in the index", contractNotFound(child, &conf))
+	conf.traceMode = traceModeNone
+	assert.Contains(t, contractNotFound(child, &conf), "only indexed when TRACE_MODE is set")
+}
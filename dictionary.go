@@ -0,0 +1,302 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/klauspost/compress/huff0"
+)
+
+// zstdDictionaryMagic starts every zstd dictionary.
+var zstdDictionaryMagic = []byte{0x37, 0xa4, 0x30, 0xec}
+
+// The default distributions of the sequence codes from the zstd format. The
+// trained dictionaries only tune the literals and the content, so these tables
+// are used for the sequences.
+var (
+	zstdOffsetNorm = []int16{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}
+
+	zstdMatchLengthNorm = []int16{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1}
+
+	zstdLiteralLengthNorm = []int16{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1}
+)
+
+const (
+	// dictionaryDmerSize is the length of the substrings that are counted
+	// across samples.
+	dictionaryDmerSize = 8
+
+	// dictionarySegmentSize is the length of the pieces of samples that the
+	// dictionary content is made of.
+	dictionarySegmentSize = 256
+
+	// dictionaryHashLog is the size of the table that dmers are counted in.
+	dictionaryHashLog = 22
+
+	// dictionaryMinID is the first dictionary ID that is not reserved.
+	dictionaryMinID = 32768
+)
+
+// trainZstdDictionary builds a zstd dictionary from samples of stored blocks.
+// The content is made of the segments of the samples whose substrings occur
+// in the most samples, similar to the COVER algorithm of the zstd CLI, and the
+// literals table is built from the byte frequencies of the samples. The ID of
+// the dictionary is derived from its content.
+func trainZstdDictionary(samples [][]byte, size int) ([]byte, uint32, error) {
+	content := selectDictionaryContent(samples, size)
+	if len(content) < dictionaryDmerSize {
+		return nil, 0, errors.New("not enough samples to train a dictionary")
+	}
+
+	literals, err := literalsTable(samples)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	id := dictionaryMinID + crc32.ChecksumIEEE(content)%(1<<31-dictionaryMinID)
+
+	dictionary := append([]byte{}, zstdDictionaryMagic...)
+	dictionary = appendUint32(dictionary, id)
+	dictionary = append(dictionary, literals...)
+	dictionary = appendNormalizedCounts(dictionary, zstdOffsetNorm, 5)
+	dictionary = appendNormalizedCounts(dictionary, zstdMatchLengthNorm, 6)
+	dictionary = appendNormalizedCounts(dictionary, zstdLiteralLengthNorm, 6)
+
+	// The default repeat offsets
+	for _, offset := range []uint32{1, 4, 8} {
+		dictionary = appendUint32(dictionary, offset)
+	}
+
+	return append(dictionary, content...), id, nil
+}
+
+func appendUint32(data []byte, value uint32) []byte {
+	var encoded [4]byte
+	binary.LittleEndian.PutUint32(encoded[:], value)
+	return append(data, encoded[:]...)
+}
+
+func dmerHash(data []byte) uint32 {
+	return uint32((binary.LittleEndian.Uint64(data) * 0x9e3779b185ebca87) >> (64 - dictionaryHashLog))
+}
+
+type dictionarySegment struct {
+	data  []byte
+	score int
+}
+
+type segmentHeap []*dictionarySegment
+
+func (h segmentHeap) Len() int            { return len(h) }
+func (h segmentHeap) Less(i, j int) bool  { return h[i].score > h[j].score }
+func (h segmentHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *segmentHeap) Push(x interface{}) { *h = append(*h, x.(*dictionarySegment)) }
+func (h *segmentHeap) Pop() interface{} {
+	old := *h
+	segment := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return segment
+}
+
+// selectDictionaryContent greedily picks the segments that cover the most
+// frequent dmers that are not covered yet. Dmers that occur in a single
+// sample do not help compressing other blocks and are ignored.
+func selectDictionaryContent(samples [][]byte, size int) []byte {
+	frequencies := make([]int32, 1<<dictionaryHashLog)
+	lastSample := make([]int32, 1<<dictionaryHashLog)
+	for i := range lastSample {
+		lastSample[i] = -1
+	}
+
+	for i, sample := range samples {
+		for j := 0; j+dictionaryDmerSize <= len(sample); j++ {
+			h := dmerHash(sample[j:])
+			if lastSample[h] != int32(i) {
+				lastSample[h] = int32(i)
+				frequencies[h]++
+			}
+		}
+	}
+
+	covered := make([]bool, 1<<dictionaryHashLog)
+	score := func(data []byte) int {
+		total := 0
+		for j := 0; j+dictionaryDmerSize <= len(data); j++ {
+			h := dmerHash(data[j:])
+			if !covered[h] && frequencies[h] > 1 {
+				total += int(frequencies[h])
+			}
+		}
+		return total
+	}
+
+	segments := &segmentHeap{}
+	for _, sample := range samples {
+		for j := 0; j < len(sample); j += dictionarySegmentSize {
+			end := j + dictionarySegmentSize
+			if end > len(sample) {
+				end = len(sample)
+			}
+			segment := &dictionarySegment{data: sample[j:end]}
+			segment.score = score(segment.data)
+			if segment.score > 0 {
+				*segments = append(*segments, segment)
+			}
+		}
+	}
+	heap.Init(segments)
+
+	var picked [][]byte
+	total := 0
+	for segments.Len() > 0 && total < size {
+		segment := heap.Pop(segments).(*dictionarySegment)
+
+		// Scores only go down as dmers are covered, so a segment whose
+		// updated score is still the best can be picked
+		segment.score = score(segment.data)
+		if segment.score == 0 {
+			continue
+		}
+		if segments.Len() > 0 && segment.score < (*segments)[0].score {
+			heap.Push(segments, segment)
+			continue
+		}
+
+		for j := 0; j+dictionaryDmerSize <= len(segment.data); j++ {
+			covered[dmerHash(segment.data[j:])] = true
+		}
+		picked = append(picked, segment.data)
+		total += len(segment.data)
+	}
+
+	// The best segments go last, where their offsets are the smallest
+	content := make([]byte, 0, total)
+	for i := len(picked) - 1; i >= 0; i-- {
+		content = append(content, picked[i]...)
+	}
+	if len(content) > size {
+		content = content[len(content)-size:]
+	}
+
+	return content
+}
+
+// literalsTable builds the Huffman table of the literals from the byte
+// frequencies of the samples. Every byte value is counted at least once so
+// that the table can encode any literal.
+func literalsTable(samples [][]byte) ([]byte, error) {
+	total := 0
+	for _, sample := range samples {
+		total += len(sample)
+	}
+
+	// Huffman blocks are limited in size, so large samples are strided
+	limit := huff0.BlockSizeMax - 256
+	stride := total/limit + 1
+
+	input := make([]byte, 0, limit+256)
+	position := 0
+	for _, sample := range samples {
+		for ; position < len(sample); position += stride {
+			input = append(input, sample[position])
+		}
+		position -= len(sample)
+	}
+	for i := 0; i < 256; i++ {
+		input = append(input, byte(i))
+	}
+
+	scratch := &huff0.Scratch{}
+	_, _, err := huff0.Compress1X(input, scratch)
+	if err != nil {
+		return nil, fmt.Errorf("literals table: %s", err)
+	}
+
+	return append([]byte{}, scratch.OutTable...), nil
+}
+
+// appendNormalizedCounts writes a table of normalized counts in the FSE table
+// description format of zstd.
+func appendNormalizedCounts(out []byte, norm []int16, tableLog uint) []byte {
+	var (
+		tableSize = int16(1) << tableLog
+		bitStream = uint32(tableLog - 5)
+		bitCount  = uint(4)
+		remaining = tableSize + 1
+		threshold = tableSize
+		nbBits    = tableLog + 1
+		symbol    = 0
+		previous0 = false
+	)
+
+	flush := func() {
+		for bitCount >= 16 {
+			out = append(out, byte(bitStream), byte(bitStream>>8))
+			bitStream >>= 16
+			bitCount -= 16
+		}
+	}
+
+	for remaining > 1 {
+		if previous0 {
+			start := symbol
+			for norm[symbol] == 0 {
+				symbol++
+			}
+			for symbol >= start+24 {
+				start += 24
+				bitStream += uint32(0xffff) << bitCount
+				bitCount += 16
+				flush()
+			}
+			for symbol >= start+3 {
+				start += 3
+				bitStream += 3 << bitCount
+				bitCount += 2
+			}
+			bitStream += uint32(symbol-start) << bitCount
+			bitCount += 2
+			flush()
+		}
+
+		count := norm[symbol]
+		symbol++
+		max := (2*threshold - 1) - remaining
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		count++ // +1 for extra accuracy
+		if count >= threshold {
+			count += max
+		}
+		bitStream += uint32(count) << bitCount
+		bitCount += nbBits
+		if count < max {
+			bitCount--
+		}
+
+		previous0 = count == 1
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+		flush()
+	}
+
+	for bitCount > 0 {
+		out = append(out, byte(bitStream))
+		bitStream >>= 8
+		if bitCount < 8 {
+			bitCount = 0
+		} else {
+			bitCount -= 8
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// embeddedClient is a single node replacement for realRedisClient. It keeps
+// the working set and the last finished block in a local leveldb database so
+// that a restarted process resumes where it left off.
+type embeddedClient struct {
+	db                   *leveldb.DB
+	lock                 sync.Mutex
+	owner                string
+	workingBlockStart    *big.Int
+	workingBlockSetKey   string
+	requeueBlockSetKey   string
+	lastFinishedBlockKey string
+	pausedKey            string
+	networkKey           string
+	indexKey             string
+	exportCursorKey      string
+	archiveCursorKey     string
+	ttlSeconds           int
+}
+
+// embeddedLockedError is returned when another process, usually the running
+// ingestr, has the embedded database open. Only one process can open it at a
+// time, so commands have to go through the admin API of that process instead.
+type embeddedLockedError struct {
+	path string
+}
+
+func (err *embeddedLockedError) Error() string {
+	return fmt.Sprintf("embedded database %s is in use by another ingestr process, use its admin API instead, e.g. GET /status, POST /requeue or POST /cursor", err.path)
+}
+
+func createEmbeddedClient(
+	path string,
+	owner string,
+	workingBlockStart *big.Int,
+	workingBlockSetKey string,
+	requeueBlockSetKey string,
+	lastFinishedBlockKey string,
+	pausedKey string,
+	networkKey string,
+	indexKey string,
+	exportCursorKey string,
+	archiveCursorKey string,
+	ttlSeconds int,
+) (*embeddedClient, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err == syscall.EWOULDBLOCK || err == storage.ErrLocked {
+		return nil, &embeddedLockedError{path}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &embeddedClient{
+		db:                   db,
+		owner:                owner,
+		workingBlockStart:    workingBlockStart,
+		workingBlockSetKey:   workingBlockSetKey,
+		requeueBlockSetKey:   requeueBlockSetKey,
+		lastFinishedBlockKey: lastFinishedBlockKey,
+		pausedKey:            pausedKey,
+		networkKey:           networkKey,
+		indexKey:             indexKey,
+		exportCursorKey:      exportCursorKey,
+		archiveCursorKey:     archiveCursorKey,
+		ttlSeconds:           ttlSeconds,
+	}, nil
+}
+
+func (client *embeddedClient) close() error {
+	return client.db.Close()
+}
+
+// blockKey returns the key of a block in the set with the given prefix. Block
+// numbers are stored big endian so that iteration order matches numeric order.
+func blockKey(prefix string, blockNumber *big.Int) []byte {
+	key := []byte(prefix + "/")
+	return append(key, encodeUint64(blockNumber.Uint64())...)
+}
+
+func blockFromKey(prefix string, key []byte) *big.Int {
+	return new(big.Int).SetUint64(binary.BigEndian.Uint64(key[len(prefix)+1:]))
+}
+
+func blockPrefix(prefix string) *util.Range {
+	return util.BytesPrefix([]byte(prefix + "/"))
+}
+
+// claimValue is stored for every working block. It holds the claim time
+// followed by the owner.
+func (client *embeddedClient) claimValue() []byte {
+	return append(encodeUint64(uint64(time.Now().Unix())), []byte(client.owner)...)
+}
+
+func (client *embeddedClient) getStaleWorkingBlock() (*big.Int, error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	now := time.Now().Unix()
+	staleBefore := uint64(now - int64(client.ttlSeconds))
+
+	var staleKey []byte
+	var staleTime uint64
+	iter := client.db.NewIterator(blockPrefix(client.workingBlockSetKey), nil)
+	for iter.Next() {
+		claimTime := binary.BigEndian.Uint64(iter.Value()[:8])
+		if claimTime > staleBefore {
+			continue
+		}
+		if staleKey == nil || claimTime < staleTime {
+			staleKey = append([]byte{}, iter.Key()...)
+			staleTime = claimTime
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	if staleKey == nil {
+		return nil, nil
+	}
+
+	// Reset stale member TTL
+	err := client.db.Put(staleKey, client.claimValue(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return blockFromKey(client.workingBlockSetKey, staleKey), nil
+}
+
+func (client *embeddedClient) getNextWorkingBlock(nextAllowedBlock *big.Int) (*big.Int, error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	// Requeued blocks take priority over new blocks
+	requeueIter := client.db.NewIterator(blockPrefix(client.requeueBlockSetKey), nil)
+	var requeued *big.Int
+	if requeueIter.First() {
+		requeued = blockFromKey(client.requeueBlockSetKey, requeueIter.Key())
+	}
+	requeueIter.Release()
+	if err := requeueIter.Error(); err != nil {
+		return nil, err
+	}
+
+	if requeued != nil && requeued.Cmp(nextAllowedBlock) <= 0 {
+		batch := new(leveldb.Batch)
+		batch.Delete(blockKey(client.requeueBlockSetKey, requeued))
+		batch.Put(blockKey(client.workingBlockSetKey, requeued), client.claimValue())
+		err := client.db.Write(batch, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return requeued, nil
+	}
+
+	block := new(big.Int).Set(client.workingBlockStart)
+
+	iter := client.db.NewIterator(blockPrefix(client.workingBlockSetKey), nil)
+	if iter.Last() {
+		block.Add(blockFromKey(client.workingBlockSetKey, iter.Key()), big.NewInt(1))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	// Check where we previously left off
+	lastFinishedBlock, err := client.getLastFinishedBlock()
+	if err != nil {
+		return nil, err
+	}
+	if lastFinishedBlock != nil && lastFinishedBlock.Cmp(block) >= 0 {
+		block.Add(lastFinishedBlock, big.NewInt(1))
+	}
+
+	if block.Cmp(nextAllowedBlock) > 0 {
+		return block, nil
+	}
+
+	err = client.db.Put(blockKey(client.workingBlockSetKey, block), client.claimValue(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+func (client *embeddedClient) removeFromWorkingSet(blockNumber *big.Int) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	lastFinishedBlock, err := client.getLastFinishedBlock()
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	if lastFinishedBlock == nil || blockNumber.Cmp(lastFinishedBlock) == 1 {
+		batch.Put([]byte(client.lastFinishedBlockKey), encodeUint64(blockNumber.Uint64()))
+	}
+	batch.Delete(blockKey(client.workingBlockSetKey, blockNumber))
+	batch.Delete(blockKey(client.failuresKey(), blockNumber))
+
+	return client.db.Write(batch, nil)
+}
+
+func (client *embeddedClient) getWorkingBlocks() ([]*workingBlock, error) {
+	var blocks []*workingBlock = make([]*workingBlock, 0)
+
+	iter := client.db.NewIterator(blockPrefix(client.workingBlockSetKey), nil)
+	defer iter.Release()
+	for iter.Next() {
+		value := iter.Value()
+		blocks = append(blocks, &workingBlock{
+			Number:    blockFromKey(client.workingBlockSetKey, iter.Key()),
+			ClaimedAt: time.Unix(int64(binary.BigEndian.Uint64(value[:8])), 0),
+			Owner:     string(value[8:]),
+		})
+	}
+
+	return blocks, iter.Error()
+}
+
+// getLastFinishedBlock returns nil if no block has been finished yet.
+func (client *embeddedClient) getLastFinishedBlock() (*big.Int, error) {
+	value, err := client.db.Get([]byte(client.lastFinishedBlockKey), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetUint64(binary.BigEndian.Uint64(value)), nil
+}
+
+func (client *embeddedClient) setLastFinishedBlock(blockNumber *big.Int) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	return client.db.Put([]byte(client.lastFinishedBlockKey), encodeUint64(blockNumber.Uint64()), nil)
+}
+
+// getExportCursor returns the first block that has not been exported yet, or
+// nil if nothing has been exported.
+func (client *embeddedClient) getExportCursor() (*big.Int, error) {
+	value, err := client.db.Get([]byte(client.exportCursorKey), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetUint64(binary.BigEndian.Uint64(value)), nil
+}
+
+func (client *embeddedClient) setExportCursor(blockNumber *big.Int) error {
+	return client.db.Put([]byte(client.exportCursorKey), encodeUint64(blockNumber.Uint64()), nil)
+}
+
+// getArchiveCursor returns the first block that has not been archived yet, or
+// nil if nothing has been archived.
+func (client *embeddedClient) getArchiveCursor() (*big.Int, error) {
+	value, err := client.db.Get([]byte(client.archiveCursorKey), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetUint64(binary.BigEndian.Uint64(value)), nil
+}
+
+func (client *embeddedClient) setArchiveCursor(blockNumber *big.Int) error {
+	return client.db.Put([]byte(client.archiveCursorKey), encodeUint64(blockNumber.Uint64()), nil)
+}
+
+func (client *embeddedClient) requeueBlocks(from *big.Int, to *big.Int) error {
+	err := checkRequeueRange(from, to)
+	if err != nil {
+		return err
+	}
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	batch := new(leveldb.Batch)
+	for i := new(big.Int).Set(from); i.Cmp(to) <= 0; i.Add(i, big.NewInt(1)) {
+		batch.Put(blockKey(client.requeueBlockSetKey, i), []byte{})
+
+		if batch.Len() == requeueBatchSize || i.Cmp(to) == 0 {
+			err := client.db.Write(batch, nil)
+			if err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+
+	return nil
+}
+
+// getRequeuedCount returns how many requeued blocks have not been claimed yet.
+func (client *embeddedClient) getRequeuedCount() (int64, error) {
+	var count int64
+	iter := client.db.NewIterator(blockPrefix(client.requeueBlockSetKey), nil)
+	defer iter.Release()
+	for iter.Next() {
+		count++
+	}
+
+	return count, iter.Error()
+}
+
+// failuresKey is the prefix of how often every block that has not been
+// processed yet failed.
+func (client *embeddedClient) failuresKey() string {
+	return client.workingBlockSetKey + "_failures"
+}
+
+// recordBlockFailure counts a failure of a block. See
+// realRedisClient.recordBlockFailure.
+func (client *embeddedClient) recordBlockFailure(blockNumber *big.Int) (int64, error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	key := blockKey(client.failuresKey(), blockNumber)
+	var failures uint64
+	value, err := client.db.Get(key, nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		return 0, err
+	}
+	if err == nil {
+		failures = binary.BigEndian.Uint64(value)
+	}
+	failures++
+
+	err = client.db.Put(key, encodeUint64(failures), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(failures), nil
+}
+
+// getDeadLetters returns the blocks that failed at least deadLetterFailures
+// times.
+func (client *embeddedClient) getDeadLetters() ([]*big.Int, error) {
+	var blocks []*big.Int = make([]*big.Int, 0)
+
+	iter := client.db.NewIterator(blockPrefix(client.failuresKey()), nil)
+	defer iter.Release()
+	for iter.Next() {
+		if binary.BigEndian.Uint64(iter.Value()) >= deadLetterFailures {
+			blocks = append(blocks, blockFromKey(client.failuresKey(), iter.Key()))
+		}
+	}
+
+	return blocks, iter.Error()
+}
+
+func (client *embeddedClient) isPaused() (bool, error) {
+	return client.db.Has([]byte(client.pausedKey), nil)
+}
+
+func (client *embeddedClient) setPaused(paused bool) error {
+	if paused {
+		return client.db.Put([]byte(client.pausedKey), []byte{1}, nil)
+	}
+
+	return client.db.Delete([]byte(client.pausedKey), nil)
+}
+
+// getNetwork returns nil if no network has been recorded yet.
+func (client *embeddedClient) getNetwork() (*network, error) {
+	data, err := client.db.Get([]byte(client.networkKey), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var n *network
+	err = json.Unmarshal(data, &n)
+	return n, err
+}
+
+func (client *embeddedClient) setNetwork(n *network) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	return client.db.Put([]byte(client.networkKey), data, nil)
+}
+
+// setBlockIndex replaces the entries that a block added to an index. See
+// realRedisClient.setBlockIndex.
+func (client *embeddedClient) setBlockIndex(index string, blockNumber *big.Int, entries map[string][]byte) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	entriesPrefix := client.indexKey + "/" + index + "/entries/"
+	blocksPrefix := client.indexKey + "/" + index + "/blocks"
+
+	var previousKeys []string
+	previous, err := client.db.Get(blockKey(blocksPrefix, blockNumber), nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		return err
+	}
+	if err == nil {
+		err = json.Unmarshal(previous, &previousKeys)
+		if err != nil {
+			return err
+		}
+	}
+
+	batch := new(leveldb.Batch)
+	for _, key := range previousKeys {
+		if _, ok := entries[key]; ok {
+			continue
+		}
+
+		value, err := client.db.Get([]byte(entriesPrefix+key), nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if owner, _ := decodeIndexEntry(value); owner != nil && owner.Cmp(blockNumber) == 0 {
+			batch.Delete([]byte(entriesPrefix + key))
+		}
+	}
+
+	keys := make([]string, 0, len(entries))
+	for key, value := range entries {
+		keys = append(keys, key)
+		batch.Put([]byte(entriesPrefix+key), encodeIndexEntry(blockNumber, value))
+	}
+
+	if len(keys) == 0 {
+		batch.Delete(blockKey(blocksPrefix, blockNumber))
+	} else {
+		data, err := json.Marshal(keys)
+		if err != nil {
+			return err
+		}
+		batch.Put(blockKey(blocksPrefix, blockNumber), data)
+	}
+
+	return client.db.Write(batch, nil)
+}
+
+// setIndexEntries adds entries to an index without recording which keys the
+// block added. See realRedisClient.setIndexEntries.
+func (client *embeddedClient) setIndexEntries(index string, blockNumber *big.Int, entries map[string][]byte) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	entriesPrefix := client.indexKey + "/" + index + "/entries/"
+
+	batch := new(leveldb.Batch)
+	for key, value := range entries {
+		batch.Put([]byte(entriesPrefix+key), encodeIndexEntry(blockNumber, value))
+	}
+
+	return client.db.Write(batch, nil)
+}
+
+func (client *embeddedClient) getIndexEntry(index string, key string) ([]byte, *big.Int, error) {
+	value, err := client.db.Get([]byte(client.indexKey+"/"+index+"/entries/"+key), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	blockNumber, entry := decodeIndexEntry(value)
+	if blockNumber == nil {
+		return nil, nil, fmt.Errorf("invalid %s index entry: %s", index, key)
+	}
+
+	return entry, blockNumber, nil
+}
+
+func encodeUint64(value uint64) []byte {
+	result := make([]byte, 8)
+	binary.BigEndian.PutUint64(result, value)
+	return result
+}
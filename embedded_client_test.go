@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testCreateEmbeddedClient(t *testing.T, path string, ttlSeconds int) *embeddedClient {
+	client, err := createEmbeddedClient(
+		path,
+		testConf.instanceID,
+		big.NewInt(100),
+		testConf.redisWorkingBlockSetKey,
+		testConf.redisRequeueBlockSetKey,
+		testConf.redisLastFinishedBlockKey,
+		testConf.redisPausedKey,
+		testConf.redisNetworkKey,
+		testConf.redisIndexKey,
+		testConf.redisExportCursorKey,
+		testConf.redisArchiveCursorKey,
+		ttlSeconds,
+	)
+	assert.NoError(t, err)
+
+	return client
+}
+
+func TestEmbeddedClientClaimAndComplete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingestr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	client := testCreateEmbeddedClient(t, dir, 60)
+
+	block, err := client.getNextWorkingBlock(big.NewInt(200))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), block.Int64())
+
+	block, err = client.getNextWorkingBlock(big.NewInt(200))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(101), block.Int64())
+
+	// Blocks past the allowed block are not claimed
+	block, err = client.getNextWorkingBlock(big.NewInt(101))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(102), block.Int64())
+
+	stale, err := client.getStaleWorkingBlock()
+	assert.NoError(t, err)
+	assert.Nil(t, stale)
+
+	assert.NoError(t, client.removeFromWorkingSet(big.NewInt(101)))
+	assert.NoError(t, client.removeFromWorkingSet(big.NewInt(100)))
+
+	lastFinished, err := client.getLastFinishedBlock()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(101), lastFinished.Int64())
+
+	// State survives a restart
+	assert.NoError(t, client.close())
+	client = testCreateEmbeddedClient(t, dir, 60)
+	defer client.close()
+
+	block, err = client.getNextWorkingBlock(big.NewInt(200))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(102), block.Int64())
+}
+
+func TestEmbeddedClientStaleBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingestr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	client := testCreateEmbeddedClient(t, dir, -1)
+	defer client.close()
+
+	block, err := client.getNextWorkingBlock(big.NewInt(200))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), block.Int64())
+
+	stale, err := client.getStaleWorkingBlock()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), stale.Int64())
+
+	// A stale block stays claimed so the next block moves forward
+	block, err = client.getNextWorkingBlock(big.NewInt(200))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(101), block.Int64())
+}
+
+func TestCloseRedisClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingestr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := *testConf
+	conf.redisAddress = ""
+	conf.embeddedDBPath = dir
+
+	client, err := createRedisClient(&conf)
+	assert.NoError(t, err)
+
+	// The database is locked until the client that failed to start is closed,
+	// and commands are pointed to the admin API while it is
+	_, err = createRedisClient(&conf)
+	assert.IsType(t, &embeddedLockedError{}, err)
+	assert.Contains(t, err.Error(), "admin API")
+
+	closeRedisClient(client)
+	client, err = createRedisClient(&conf)
+	assert.NoError(t, err)
+	closeRedisClient(client)
+}
+
+func TestEmbeddedClientRequeueBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingestr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	client := testCreateEmbeddedClient(t, dir, 60)
+	defer client.close()
+
+	// Large ranges are written in batches
+	err = client.requeueBlocks(big.NewInt(1000), big.NewInt(1000+2*requeueBatchSize))
+	assert.NoError(t, err)
+	for _, expected := range []int64{1000, 1001} {
+		block, err := client.getNextWorkingBlock(big.NewInt(1000000))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, block.Int64())
+	}
+
+	err = client.requeueBlocks(big.NewInt(0), big.NewInt(maxRequeueBlocks))
+	assert.Error(t, err)
+	err = client.requeueBlocks(big.NewInt(10), big.NewInt(9))
+	assert.EqualError(t, err, "to block 9 is before from block 10")
+}
+
+func TestEmbeddedClientDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingestr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	client := testCreateEmbeddedClient(t, dir, 60)
+	defer client.close()
+
+	block, err := client.getNextWorkingBlock(big.NewInt(200))
+	assert.NoError(t, err)
+
+	for i := int64(1); i <= deadLetterFailures; i++ {
+		failures, err := client.recordBlockFailure(block)
+		assert.NoError(t, err)
+		assert.Equal(t, i, failures)
+	}
+
+	deadLetters, err := client.getDeadLetters()
+	assert.NoError(t, err)
+	assert.Equal(t, []*big.Int{block}, deadLetters)
+
+	// A block that is processed is no longer a dead letter
+	assert.NoError(t, client.removeFromWorkingSet(block))
+	deadLetters, err = client.getDeadLetters()
+	assert.NoError(t, err)
+	assert.Empty(t, deadLetters)
+
+	failures, err := client.recordBlockFailure(block)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), failures)
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// Stored objects can be encrypted on the client with envelope encryption.
+// Every object is encrypted with its own random data key, and the data key is
+// stored in the metadata of the object, wrapped by a master key from a local
+// keyfile or from KMS. Master keys are rotated by wrapping the data keys again,
+// which does not touch the objects themselves.
+//
+// Objects are encrypted after they are compressed, with AES-256-GCM in
+// segments of 64 KiB so that they can be streamed. Segment i of a stream is
+// sealed with the nonce
+//
+//   stream (4 bytes) | 0 (3 bytes) | i (4 bytes) | last (1 byte)
+//
+// in big endian, where stream is 0 for objects and the index of a block in
+// archives, and last is 1 for the final segment so that a truncated stream
+// cannot be decrypted.
+
+// Ways of encrypting stored objects.
+const (
+	encryptionNone    = "none"
+	encryptionKeyfile = "keyfile"
+	encryptionKMS     = "kms"
+)
+
+// encryptionAlgorithm is recorded in the Encryption metadata of encrypted
+// objects.
+const encryptionAlgorithm = "AES256-GCM-64K"
+
+const (
+	encryptionSegmentSize = 64 << 10
+	dataKeySize           = 32
+)
+
+// dataKeyCacheSize is the number of unwrapped data keys that are kept in
+// memory, so that blocks read again do not unwrap their key again.
+const dataKeyCacheSize = 1024
+
+// keyProvider wraps data keys with master keys.
+type keyProvider interface {
+	// encryptDataKey wraps a data key with the master key with the given ID,
+	// and returns the resolved ID of the master key that wrapped it.
+	encryptDataKey(keyID string, dataKey []byte) ([]byte, string, error)
+
+	// decryptDataKey unwraps a data key that was wrapped with the master key
+	// with the given ID.
+	decryptDataKey(keyID string, wrapped []byte) ([]byte, error)
+
+	// resolveKeyID returns the ID that encryptDataKey records for the master
+	// key with the given ID, such as the ARN of a KMS alias.
+	resolveKeyID(keyID string) (string, error)
+}
+
+// encryptor encrypts objects with data keys wrapped by the master key keyID,
+// and decrypts objects wrapped by any master key that keys holds. Objects are
+// stored unencrypted if keys is nil.
+type encryptor struct {
+	keyID string
+	keys  keyProvider
+
+	lock     sync.Mutex
+	dataKeys map[string][]byte
+
+	// resolvedKeyID is the resolved ID of the current master key, once it is
+	// known.
+	resolvedKeyID string
+}
+
+func newEncryptor(keyID string, keys keyProvider) *encryptor {
+	return &encryptor{
+		keyID:    keyID,
+		keys:     keys,
+		dataKeys: make(map[string][]byte),
+	}
+}
+
+func (e *encryptor) enabled() bool {
+	return e.keys != nil
+}
+
+// newDataKey returns a data key for a new object and the metadata that
+// records it.
+func (e *encryptor) newDataKey() ([]byte, map[string]*string, error) {
+	dataKey := make([]byte, dataKeySize)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrapped, keyID, err := e.keys.encryptDataKey(e.keyID, dataKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encryption key %s: %s", e.keyID, err)
+	}
+
+	return dataKey, e.dataKeyMetadata(keyID, wrapped), nil
+}
+
+// dataKeyMetadata is the metadata of an object whose data key was wrapped
+// with the master key keyID.
+func (e *encryptor) dataKeyMetadata(keyID string, wrapped []byte) map[string]*string {
+	return map[string]*string{
+		encryptionMetadata:      aws.String(encryptionAlgorithm),
+		encryptionKeyIDMetadata: aws.String(keyID),
+		dataKeyMetadata:         aws.String(base64.StdEncoding.EncodeToString(wrapped)),
+	}
+}
+
+// objectDataKey returns the data key of an object from its metadata, or nil
+// if the object is not encrypted.
+func (e *encryptor) objectDataKey(metadata map[string]*string) ([]byte, error) {
+	algorithm := aws.StringValue(metadata[encryptionMetadata])
+	if algorithm == "" {
+		return nil, nil
+	}
+	if algorithm != encryptionAlgorithm {
+		return nil, fmt.Errorf("unknown encryption %q", algorithm)
+	}
+
+	keyID := aws.StringValue(metadata[encryptionKeyIDMetadata])
+	if !e.enabled() {
+		return nil, fmt.Errorf("object is encrypted with key %s, but ENCRYPTION is %s", keyID, encryptionNone)
+	}
+
+	encoded := aws.StringValue(metadata[dataKeyMetadata])
+	wrapped, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key %q", encoded)
+	}
+
+	e.lock.Lock()
+	dataKey, ok := e.dataKeys[encoded]
+	e.lock.Unlock()
+	if ok {
+		return dataKey, nil
+	}
+
+	dataKey, err = e.keys.decryptDataKey(keyID, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key %s: %s", keyID, err)
+	}
+	if len(dataKey) != dataKeySize {
+		return nil, fmt.Errorf("encryption key %s: data key has %d bytes", keyID, len(dataKey))
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if len(e.dataKeys) >= dataKeyCacheSize {
+		for cached := range e.dataKeys {
+			delete(e.dataKeys, cached)
+			break
+		}
+	}
+	e.dataKeys[encoded] = dataKey
+
+	return dataKey, nil
+}
+
+// currentKeyID returns the resolved ID of the current master key.
+func (e *encryptor) currentKeyID() (string, error) {
+	e.lock.Lock()
+	keyID := e.resolvedKeyID
+	e.lock.Unlock()
+	if keyID != "" {
+		return keyID, nil
+	}
+
+	keyID, err := e.keys.resolveKeyID(e.keyID)
+	if err != nil {
+		return "", fmt.Errorf("encryption key %s: %s", e.keyID, err)
+	}
+
+	e.lock.Lock()
+	e.resolvedKeyID = keyID
+	e.lock.Unlock()
+
+	return keyID, nil
+}
+
+// rewrapMetadata returns the metadata of an object with its data key wrapped
+// by the current master key, or nil if it already is. Key IDs are compared
+// once they are resolved, so objects recorded with an alias are rewrapped.
+// The object must be encrypted.
+func (e *encryptor) rewrapMetadata(metadata map[string]*string) (map[string]*string, error) {
+	currentKeyID, err := e.currentKeyID()
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(metadata[encryptionKeyIDMetadata]) == currentKeyID {
+		return nil, nil
+	}
+
+	dataKey, err := e.objectDataKey(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, keyID, err := e.keys.encryptDataKey(e.keyID, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key %s: %s", e.keyID, err)
+	}
+
+	rewrapped := make(map[string]*string)
+	for name, value := range metadata {
+		rewrapped[name] = value
+	}
+	for name, value := range e.dataKeyMetadata(keyID, wrapped) {
+		rewrapped[name] = value
+	}
+
+	return rewrapped, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(stream uint32, segment uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce, stream)
+	binary.BigEndian.PutUint32(nonce[7:], segment)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// segmentWriter encrypts a stream in segments. The last segment is written
+// when the writer is closed.
+type segmentWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	stream  uint32
+	segment uint32
+	buffer  []byte
+}
+
+// encryptWriter returns a writer that encrypts everything written to it into
+// w. The encrypted stream is complete once the writer is closed.
+func encryptWriter(w io.Writer, dataKey []byte, stream uint32) (io.WriteCloser, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &segmentWriter{
+		w:      w,
+		aead:   aead,
+		stream: stream,
+		buffer: make([]byte, 0, encryptionSegmentSize),
+	}, nil
+}
+
+func (writer *segmentWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full segment is only written once more data follows, so that the
+		// last segment is never empty unless the stream is
+		if len(writer.buffer) == encryptionSegmentSize {
+			err := writer.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(writer.buffer[len(writer.buffer):encryptionSegmentSize], p)
+		writer.buffer = writer.buffer[:len(writer.buffer)+n]
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+func (writer *segmentWriter) Close() error {
+	return writer.seal(true)
+}
+
+func (writer *segmentWriter) seal(last bool) error {
+	sealed := writer.aead.Seal(nil, segmentNonce(writer.stream, writer.segment, last), writer.buffer, nil)
+	writer.segment++
+	writer.buffer = writer.buffer[:0]
+
+	_, err := writer.w.Write(sealed)
+	return err
+}
+
+// segmentReader decrypts a stream that was encrypted by a segmentWriter.
+type segmentReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	stream  uint32
+	segment uint32
+	sealed  []byte
+	plain   []byte
+	done    bool
+}
+
+// decryptReader returns a reader that decrypts r. Reading fails if the stream
+// was modified or truncated.
+func decryptReader(r io.Reader, dataKey []byte, stream uint32) (io.Reader, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &segmentReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		stream: stream,
+		sealed: make([]byte, encryptionSegmentSize+aead.Overhead()),
+	}, nil
+}
+
+func (reader *segmentReader) Read(p []byte) (int, error) {
+	for len(reader.plain) == 0 {
+		if reader.done {
+			return 0, io.EOF
+		}
+
+		err := reader.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, reader.plain)
+	reader.plain = reader.plain[n:]
+	return n, nil
+}
+
+func (reader *segmentReader) open() error {
+	n, err := io.ReadFull(reader.r, reader.sealed)
+	last := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !last {
+		return err
+	}
+
+	// A full segment is the last one if nothing follows it
+	if !last {
+		_, err = reader.r.Peek(1)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		last = err == io.EOF
+	}
+
+	nonce := segmentNonce(reader.stream, reader.segment, last)
+	plain, err := reader.aead.Open(reader.sealed[:0], nonce, reader.sealed[:n], nil)
+	if err != nil {
+		return fmt.Errorf("segment %d cannot be decrypted: %s", reader.segment, err)
+	}
+
+	reader.segment++
+	reader.plain = plain
+	reader.done = last
+	return nil
+}
+
+// encryptBytes encrypts data like encryptWriter.
+func encryptBytes(dataKey []byte, stream uint32, data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer, err := encryptWriter(&buffer, dataKey, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	writer.Write(data)
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// decryptBytes decrypts data like decryptReader.
+func decryptBytes(dataKey []byte, stream uint32, data []byte) ([]byte, error) {
+	reader, err := decryptReader(bytes.NewReader(data), dataKey, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(reader)
+}
+
+// keyfileKeys are master keys read from a keyfile, by their IDs.
+type keyfileKeys map[string][]byte
+
+// readKeyfile reads a file of master keys. Every line holds the ID of a key
+// and the base64 encoded 32 byte key, separated by whitespace. Empty lines and
+// lines starting with # are ignored.
+func readKeyfile(path string) (keyfileKeys, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(keyfileKeys)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a key ID and a key", i+1)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != dataKeySize {
+			return nil, fmt.Errorf("line %d: key %s must be %d base64 encoded bytes", i+1, fields[0], dataKeySize)
+		}
+		if _, ok := keys[fields[0]]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %s", i+1, fields[0])
+		}
+
+		keys[fields[0]] = key
+	}
+
+	return keys, nil
+}
+
+// encryptDataKey seals a data key with AES-256-GCM under a random nonce,
+// which is prepended to the wrapped key. The key ID is authenticated with it.
+func (keys keyfileKeys) encryptDataKey(keyID string, dataKey []byte) ([]byte, string, error) {
+	aead, err := keys.aead(keyID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return aead.Seal(nonce, nonce, dataKey, []byte(keyID)), keyID, nil
+}
+
+func (keys keyfileKeys) decryptDataKey(keyID string, wrapped []byte) ([]byte, error) {
+	aead, err := keys.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped data key is too short")
+	}
+
+	return aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyID))
+}
+
+// resolveKeyID returns the key ID as it is, keys of a keyfile have no aliases.
+func (keys keyfileKeys) resolveKeyID(keyID string) (string, error) {
+	_, err := keys.aead(keyID)
+	return keyID, err
+}
+
+func (keys keyfileKeys) aead(keyID string) (cipher.AEAD, error) {
+	key, ok := keys[keyID]
+	if !ok {
+		return nil, errors.New("not in the keyfile")
+	}
+
+	return newAEAD(key)
+}
+
+// kmsKeys wraps data keys with KMS, or with a service with a KMS compatible
+// API.
+type kmsKeys struct {
+	kms     *kms.KMS
+	timeout time.Duration
+}
+
+// createKMSKeys creates a KMS client that connects as configured by
+// awsConfig.
+func createKMSKeys(awsConfig awsClientConfig, timeout time.Duration) *kmsKeys {
+	return &kmsKeys{
+		kms:     kms.New(newAWSSession(awsConfig), awsConfig.serviceConfig()),
+		timeout: timeout,
+	}
+}
+
+// encryptDataKey returns the ARN of the master key that KMS used, which differs
+// from keyID if keyID is an alias.
+func (keys *kmsKeys) encryptDataKey(keyID string, dataKey []byte) ([]byte, string, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), keys.timeout)
+	defer cancelFn()
+
+	input := &kms.EncryptInput{
+		KeyId:     aws.String(keyID),
+		Plaintext: dataKey,
+	}
+
+	result, err := keys.kms.EncryptWithContext(ctx, input)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return result.CiphertextBlob, aws.StringValue(result.KeyId), nil
+}
+
+// decryptDataKey ignores the key ID because KMS finds the master key from the
+// wrapped key.
+func (keys *kmsKeys) decryptDataKey(keyID string, wrapped []byte) ([]byte, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), keys.timeout)
+	defer cancelFn()
+
+	input := &kms.DecryptInput{
+		CiphertextBlob: wrapped,
+	}
+
+	result, err := keys.kms.DecryptWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Plaintext, nil
+}
+
+// resolveKeyID returns the ARN of a master key, which is also the current
+// master key of an alias.
+func (keys *kmsKeys) resolveKeyID(keyID string) (string, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), keys.timeout)
+	defer cancelFn()
+
+	input := &kms.DescribeKeyInput{
+		KeyId: aws.String(keyID),
+	}
+
+	result, err := keys.kms.DescribeKeyWithContext(ctx, input)
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(result.KeyMetadata.Arn), nil
+}
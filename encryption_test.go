@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/prettymuchbryce/ingestr/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func testDataKey(t *testing.T) []byte {
+	dataKey := make([]byte, dataKeySize)
+	_, err := rand.Read(dataKey)
+	assert.NoError(t, err)
+	return dataKey
+}
+
+func TestEncryptionStreams(t *testing.T) {
+	dataKey := testDataKey(t)
+
+	for _, size := range []int{0, 1, encryptionSegmentSize, encryptionSegmentSize + 1, 3*encryptionSegmentSize + 100} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		var buffer bytes.Buffer
+		writer, err := encryptWriter(&buffer, dataKey, 7)
+		assert.NoError(t, err)
+		_, err = writer.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Close())
+
+		encrypted := buffer.Bytes()
+		assert.False(t, size > 0 && bytes.Contains(encrypted, data))
+
+		reader, err := decryptReader(iotest.OneByteReader(bytes.NewReader(encrypted)), dataKey, 7)
+		assert.NoError(t, err)
+		decrypted, err := ioutil.ReadAll(reader)
+		assert.NoError(t, err, "size %d", size)
+		assert.True(t, bytes.Equal(data, decrypted), "size %d", size)
+
+		// Streams cannot be read with another key or as another stream
+		_, err = decryptBytes(dataKey, 8, encrypted)
+		assert.Error(t, err)
+		_, err = decryptBytes(testDataKey(t), 7, encrypted)
+		assert.Error(t, err)
+
+		// Nor when they were modified or truncated, even by whole segments
+		modified := append([]byte(nil), encrypted...)
+		modified[len(modified)/2] ^= 1
+		_, err = decryptBytes(dataKey, 7, modified)
+		assert.Error(t, err)
+
+		_, err = decryptBytes(dataKey, 7, encrypted[:len(encrypted)-1])
+		assert.Error(t, err)
+
+		if size > encryptionSegmentSize {
+			_, err = decryptBytes(dataKey, 7, encrypted[:encryptionSegmentSize+16])
+			assert.Error(t, err)
+		}
+	}
+}
+
+func TestKeyfileEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingestr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys")
+	key := base64.StdEncoding.EncodeToString(testDataKey(t))
+	err = ioutil.WriteFile(path, []byte("# master keys\n2020-01 "+key+"\n\n2021-01 "+base64.StdEncoding.EncodeToString(testDataKey(t))+"\n"), 0600)
+	assert.NoError(t, err)
+
+	keys, err := readKeyfile(path)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	// New objects use the current key
+	old := newEncryptor("2020-01", keys)
+	dataKey, metadata, err := old.newDataKey()
+	assert.NoError(t, err)
+	assert.Len(t, dataKey, dataKeySize)
+	assert.Equal(t, encryptionAlgorithm, aws.StringValue(metadata[encryptionMetadata]))
+	assert.Equal(t, "2020-01", aws.StringValue(metadata[encryptionKeyIDMetadata]))
+
+	// Objects are read with the key they were stored with
+	current := newEncryptor("2021-01", keys)
+	objectKey, err := current.objectDataKey(metadata)
+	assert.NoError(t, err)
+	assert.Equal(t, dataKey, objectKey)
+
+	// Rotation wraps the same data key with the current key
+	rewrapped, err := current.rewrapMetadata(metadata)
+	assert.NoError(t, err)
+	assert.Equal(t, "2021-01", aws.StringValue(rewrapped[encryptionKeyIDMetadata]))
+	assert.NotEqual(t, aws.StringValue(metadata[dataKeyMetadata]), aws.StringValue(rewrapped[dataKeyMetadata]))
+	objectKey, err = newEncryptor("2021-01", keys).objectDataKey(rewrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, dataKey, objectKey)
+
+	rewrapped, err = current.rewrapMetadata(rewrapped)
+	assert.NoError(t, err)
+	assert.Nil(t, rewrapped)
+
+	// Objects that are not encrypted have no data key
+	objectKey, err = current.objectDataKey(map[string]*string{formatMetadata: aws.String(blockFormatJSON)})
+	assert.NoError(t, err)
+	assert.Nil(t, objectKey)
+
+	_, err = newEncryptor("", nil).objectDataKey(metadata)
+	assert.EqualError(t, err, "object is encrypted with key 2020-01, but ENCRYPTION is none")
+
+	delete(keys, "2020-01")
+	_, err = newEncryptor("2021-01", keys).objectDataKey(metadata)
+	assert.EqualError(t, err, "encryption key 2020-01: not in the keyfile")
+
+	// The key ID is authenticated with the data key
+	metadata[encryptionKeyIDMetadata] = aws.String("2021-01")
+	_, err = newEncryptor("2021-01", keys).objectDataKey(metadata)
+	assert.Error(t, err)
+
+	err = ioutil.WriteFile(path, []byte("2020-01 "+key+"\n2020-01 "+key+"\n"), 0600)
+	assert.NoError(t, err)
+	_, err = readKeyfile(path)
+	assert.EqualError(t, err, "line 2: duplicate key 2020-01")
+
+	err = ioutil.WriteFile(path, []byte("2020-01 c2VjcmV0\n"), 0600)
+	assert.NoError(t, err)
+	_, err = readKeyfile(path)
+	assert.EqualError(t, err, "line 1: key 2020-01 must be 32 base64 encoded bytes")
+}
+
+func TestKMSEncryption(t *testing.T) {
+	var targets []string
+	currentARN := "arn:aws:kms:eu-west-1:111122223333:key/1"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.Header.Get("X-Amz-Target")
+		targets = append(targets, target)
+
+		var request map[string]string
+		json.NewDecoder(r.Body).Decode(&request)
+
+		// The alias resolves to the key of the current ARN, and the wrapped key
+		// is the key ARN and the reversed data key
+		arn := request["KeyId"]
+		if arn == "alias/ingestr" {
+			arn = currentARN
+		}
+		switch target {
+		case "TrentService.Encrypt":
+			plaintext, _ := base64.StdEncoding.DecodeString(request["Plaintext"])
+			wrapped := append([]byte(arn+"|"), reverseBytes(plaintext)...)
+			json.NewEncoder(w).Encode(map[string]string{"CiphertextBlob": base64.StdEncoding.EncodeToString(wrapped), "KeyId": arn})
+		case "TrentService.DescribeKey":
+			json.NewEncoder(w).Encode(map[string]map[string]string{"KeyMetadata": {"KeyId": arn, "Arn": arn}})
+		case "TrentService.Decrypt":
+			wrapped, _ := base64.StdEncoding.DecodeString(request["CiphertextBlob"])
+			i := bytes.IndexByte(wrapped, '|')
+			json.NewEncoder(w).Encode(map[string]string{"Plaintext": base64.StdEncoding.EncodeToString(reverseBytes(wrapped[i+1:])), "KeyId": string(wrapped[:i])})
+		}
+	}))
+	defer server.Close()
+
+	keys := createKMSKeys(awsClientConfig{
+		endpoint:        server.URL,
+		region:          "eu-west-1",
+		accessKeyID:     "key",
+		secretAccessKey: "secret",
+	}, 10*time.Second)
+
+	e := newEncryptor("alias/ingestr", keys)
+	dataKey, metadata, err := e.newDataKey()
+	assert.NoError(t, err)
+
+	// Unwrapped data keys are cached
+	for i := 0; i < 2; i++ {
+		objectKey, err := e.objectDataKey(metadata)
+		assert.NoError(t, err)
+		assert.Equal(t, dataKey, objectKey)
+	}
+	assert.Equal(t, []string{"TrentService.Encrypt", "TrentService.Decrypt"}, targets)
+
+	// Objects record the ARN of the key that the alias points to
+	assert.Equal(t, currentARN, aws.StringValue(metadata[encryptionKeyIDMetadata]))
+	rewrapped, err := e.rewrapMetadata(metadata)
+	assert.NoError(t, err)
+	assert.Nil(t, rewrapped)
+
+	aliased := make(map[string]*string)
+	for name, value := range metadata {
+		aliased[name] = value
+	}
+	aliased[encryptionKeyIDMetadata] = aws.String("alias/ingestr")
+	rewrapped, err = e.rewrapMetadata(aliased)
+	assert.NoError(t, err)
+	assert.Equal(t, currentARN, aws.StringValue(rewrapped[encryptionKeyIDMetadata]))
+
+	// Once the alias points to another key, objects are rewrapped with it
+	currentARN = "arn:aws:kms:eu-west-1:111122223333:key/2"
+	e = newEncryptor("alias/ingestr", keys)
+	rewrapped, err = e.rewrapMetadata(metadata)
+	assert.NoError(t, err)
+	assert.Equal(t, currentARN, aws.StringValue(rewrapped[encryptionKeyIDMetadata]))
+	objectKey, err := e.objectDataKey(rewrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, dataKey, objectKey)
+}
+
+func reverseBytes(data []byte) []byte {
+	reversed := make([]byte, len(data))
+	for i, b := range data {
+		reversed[len(data)-1-i] = b
+	}
+	return reversed
+}
+
+func TestReencryptCommand(t *testing.T) {
+	conf := *testConf
+	conf.archiveSize = 100
+
+	s3 := &mocks.S3Client{}
+	s3.On("ReencryptBlock", mock.Anything, reencryptedObjects).Return(2, nil)
+	s3.On("ReencryptArchive", big.NewInt(200)).Return(true, nil)
+	s3.On("ReencryptArchive", big.NewInt(300)).Return(false, nil)
+
+	var out bytes.Buffer
+	err := runReencryptCommand(&conf, s3, big.NewInt(250), big.NewInt(320), &out)
+	assert.EqualError(t, err, "ENCRYPTION must be set to reencrypt blocks")
+
+	conf.encryption = encryptionKMS
+	err = runReencryptCommand(&conf, s3, big.NewInt(250), big.NewInt(320), &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "reencrypted 142 objects and 1 archives of blocks 250 to 320\n", out.String())
+	s3.AssertNumberOfCalls(t, "ReencryptBlock", 71)
+	s3.AssertNumberOfCalls(t, "ReencryptArchive", 2)
+
+	err = runReencryptCommand(&conf, s3, big.NewInt(320), big.NewInt(250), &out)
+	assert.EqualError(t, err, "to block 250 is before from block 320")
+}
@@ -2,25 +2,209 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"math/big"
+	"sync"
+	"time"
 
 	ethereum "github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
 )
 
 type ethClient interface {
 	SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error)
+	ChainID(ctx context.Context) (*big.Int, error)
 	BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error)
+	CodeAt(ctx context.Context, account common.Address, blockNumber *big.Int) ([]byte, error)
+	BlockNumberByTag(ctx context.Context, tag string) (*big.Int, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
 	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+	TraceBlock(ctx context.Context, number *big.Int, mode string) (json.RawMessage, error)
+	StateDiffs(ctx context.Context, number *big.Int, mode string) (json.RawMessage, error)
+}
+
+// realEthClient adds the calls that ethclient does not support to
+// ethclient.Client.
+type realEthClient struct {
+	*ethclient.Client
+	rpc *rpc.Client
 }
 
 func createRealEthClient(host string, port string) (ethClient, error) {
-	client, err := ethclient.Dial(host + ":" + port)
+	client, err := rpc.Dial(host + ":" + port)
 	if err != nil {
 		return nil, err
 	}
 
-	return client, nil
+	return &realEthClient{
+		Client: ethclient.NewClient(client),
+		rpc:    client,
+	}, nil
+}
+
+// reconnectingEthClient is an ethClient that can connect to its node again,
+// e.g. after a subscription failed because the connection was lost. Calls
+// that are in flight keep the connection they started with.
+type reconnectingEthClient struct {
+	host string
+	port string
+
+	lock   sync.RWMutex
+	client *realEthClient
+}
+
+func createReconnectingEthClient(host string, port string) (*reconnectingEthClient, error) {
+	client, err := createRealEthClient(host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reconnectingEthClient{
+		host:   host,
+		port:   port,
+		client: client.(*realEthClient),
+	}, nil
+}
+
+// reconnect connects to the node again and closes the previous connection.
+func (c *reconnectingEthClient) reconnect() error {
+	client, err := createRealEthClient(c.host, c.port)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	previous := c.client
+	c.client = client.(*realEthClient)
+	c.lock.Unlock()
+
+	previous.Close()
+	return nil
+}
+
+func (c *reconnectingEthClient) current() *realEthClient {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.client
+}
+
+func (c *reconnectingEthClient) SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
+	return c.current().SubscribeNewHead(ctx, ch)
+}
+
+func (c *reconnectingEthClient) ChainID(ctx context.Context) (*big.Int, error) {
+	return c.current().ChainID(ctx)
+}
+
+func (c *reconnectingEthClient) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	return c.current().BlockByNumber(ctx, number)
+}
+
+func (c *reconnectingEthClient) CodeAt(ctx context.Context, account common.Address, blockNumber *big.Int) ([]byte, error) {
+	return c.current().CodeAt(ctx, account, blockNumber)
+}
+
+func (c *reconnectingEthClient) BlockNumberByTag(ctx context.Context, tag string) (*big.Int, error) {
+	return c.current().BlockNumberByTag(ctx, tag)
+}
+
+func (c *reconnectingEthClient) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return c.current().HeaderByNumber(ctx, number)
+}
+
+func (c *reconnectingEthClient) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	return c.current().TransactionReceipt(ctx, txHash)
+}
+
+func (c *reconnectingEthClient) TraceBlock(ctx context.Context, number *big.Int, mode string) (json.RawMessage, error) {
+	return c.current().TraceBlock(ctx, number, mode)
+}
+
+func (c *reconnectingEthClient) StateDiffs(ctx context.Context, number *big.Int, mode string) (json.RawMessage, error) {
+	return c.current().StateDiffs(ctx, number, mode)
+}
+
+// BlockNumberByTag returns the number of the block that a tag such as "safe"
+// or "finalized" points to.
+func (client *realEthClient) BlockNumberByTag(ctx context.Context, tag string) (*big.Int, error) {
+	var head *struct {
+		Number *hexutil.Big `json:"number"`
+	}
+	err := client.rpc.CallContext(ctx, &head, "eth_getBlockByNumber", tag, false)
+	if err != nil {
+		return nil, err
+	}
+	if head == nil || head.Number == nil {
+		return nil, ethereum.NotFound
+	}
+
+	return head.Number.ToInt(), nil
+}
+
+// TraceBlock returns the call traces of every transaction in a block. The
+// debug mode uses geth's callTracer and the trace mode uses the trace_block
+// call of OpenEthereum and Erigon.
+func (client *realEthClient) TraceBlock(ctx context.Context, number *big.Int, mode string) (json.RawMessage, error) {
+	var traces json.RawMessage
+	var err error
+
+	switch mode {
+	case traceModeDebug:
+		options := debugTraceOptions(ctx, "callTracer")
+		err = client.rpc.CallContext(ctx, &traces, "debug_traceBlockByNumber", hexutil.EncodeBig(number), options)
+	case traceModeTrace:
+		err = client.rpc.CallContext(ctx, &traces, "trace_block", hexutil.EncodeBig(number))
+	default:
+		return nil, fmt.Errorf("unknown trace mode %q", mode)
+	}
+
+	return checkTraceResult(traces, err)
+}
+
+// StateDiffs returns the state changes of every transaction in a block. The
+// debug mode uses geth's prestateTracer in diff mode and the trace mode uses
+// trace_replayBlockTransactions with stateDiff.
+func (client *realEthClient) StateDiffs(ctx context.Context, number *big.Int, mode string) (json.RawMessage, error) {
+	var diffs json.RawMessage
+	var err error
+
+	switch mode {
+	case traceModeDebug:
+		options := debugTraceOptions(ctx, "prestateTracer")
+		options["tracerConfig"] = map[string]interface{}{"diffMode": true}
+		err = client.rpc.CallContext(ctx, &diffs, "debug_traceBlockByNumber", hexutil.EncodeBig(number), options)
+	case traceModeTrace:
+		err = client.rpc.CallContext(ctx, &diffs, "trace_replayBlockTransactions", hexutil.EncodeBig(number), []string{"stateDiff"})
+	default:
+		return nil, fmt.Errorf("unknown state diff mode %q", mode)
+	}
+
+	return checkTraceResult(diffs, err)
+}
+
+func debugTraceOptions(ctx context.Context, tracer string) map[string]interface{} {
+	options := map[string]interface{}{"tracer": tracer}
+	if deadline, ok := ctx.Deadline(); ok {
+		// The node stops tracing after 5s unless it is told otherwise
+		options["timeout"] = time.Until(deadline).String()
+	}
+
+	return options
+}
+
+func checkTraceResult(result json.RawMessage, err error) (json.RawMessage, error) {
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 || string(result) == "null" {
+		return nil, ethereum.NotFound
+	}
+
+	return result, nil
 }
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Export formats of the flattened tables.
+const (
+	exportFormatNone    = "none"
+	exportFormatParquet = "parquet"
+	exportFormatCSV     = "csv"
+	exportFormatNDJSON  = "ndjson"
+)
+
+// exportInterval is how often a pipeline checks for finished batches.
+var exportInterval = 10 * time.Second
+
+// The export tables follow the column names of ethereum-etl. Quantities that
+// may not fit into an int64, such as values and difficulties, are decimal
+// strings, and hashes, addresses and byte values are hex strings.
+
+type exportBlock struct {
+	Number           int64  `json:"number" parquet:"name=number, type=INT64"`
+	Hash             string `json:"hash" parquet:"name=hash, type=UTF8"`
+	ParentHash       string `json:"parent_hash" parquet:"name=parent_hash, type=UTF8"`
+	Nonce            string `json:"nonce" parquet:"name=nonce, type=UTF8"`
+	Sha3Uncles       string `json:"sha3_uncles" parquet:"name=sha3_uncles, type=UTF8"`
+	LogsBloom        string `json:"logs_bloom" parquet:"name=logs_bloom, type=UTF8"`
+	TransactionsRoot string `json:"transactions_root" parquet:"name=transactions_root, type=UTF8"`
+	StateRoot        string `json:"state_root" parquet:"name=state_root, type=UTF8"`
+	ReceiptsRoot     string `json:"receipts_root" parquet:"name=receipts_root, type=UTF8"`
+	Miner            string `json:"miner" parquet:"name=miner, type=UTF8"`
+	Difficulty       string `json:"difficulty" parquet:"name=difficulty, type=UTF8"`
+	Size             int64  `json:"size" parquet:"name=size, type=INT64"`
+	ExtraData        string `json:"extra_data" parquet:"name=extra_data, type=UTF8"`
+	GasLimit         int64  `json:"gas_limit" parquet:"name=gas_limit, type=INT64"`
+	GasUsed          int64  `json:"gas_used" parquet:"name=gas_used, type=INT64"`
+	Timestamp        int64  `json:"timestamp" parquet:"name=timestamp, type=INT64"`
+	TransactionCount int64  `json:"transaction_count" parquet:"name=transaction_count, type=INT64"`
+}
+
+type exportTransaction struct {
+	Hash             string  `json:"hash" parquet:"name=hash, type=UTF8"`
+	Nonce            int64   `json:"nonce" parquet:"name=nonce, type=INT64"`
+	BlockHash        string  `json:"block_hash" parquet:"name=block_hash, type=UTF8"`
+	BlockNumber      int64   `json:"block_number" parquet:"name=block_number, type=INT64"`
+	TransactionIndex int64   `json:"transaction_index" parquet:"name=transaction_index, type=INT64"`
+	FromAddress      string  `json:"from_address" parquet:"name=from_address, type=UTF8"`
+	ToAddress        *string `json:"to_address" parquet:"name=to_address, type=UTF8, repetitiontype=OPTIONAL"`
+	Value            string  `json:"value" parquet:"name=value, type=UTF8"`
+	Gas              int64   `json:"gas" parquet:"name=gas, type=INT64"`
+	GasPrice         string  `json:"gas_price" parquet:"name=gas_price, type=UTF8"`
+	Input            string  `json:"input" parquet:"name=input, type=UTF8"`
+	BlockTimestamp   int64   `json:"block_timestamp" parquet:"name=block_timestamp, type=INT64"`
+}
+
+type exportReceipt struct {
+	TransactionHash   string  `json:"transaction_hash" parquet:"name=transaction_hash, type=UTF8"`
+	TransactionIndex  int64   `json:"transaction_index" parquet:"name=transaction_index, type=INT64"`
+	BlockHash         string  `json:"block_hash" parquet:"name=block_hash, type=UTF8"`
+	BlockNumber       int64   `json:"block_number" parquet:"name=block_number, type=INT64"`
+	CumulativeGasUsed int64   `json:"cumulative_gas_used" parquet:"name=cumulative_gas_used, type=INT64"`
+	GasUsed           int64   `json:"gas_used" parquet:"name=gas_used, type=INT64"`
+	ContractAddress   *string `json:"contract_address" parquet:"name=contract_address, type=UTF8, repetitiontype=OPTIONAL"`
+	Root              *string `json:"root" parquet:"name=root, type=UTF8, repetitiontype=OPTIONAL"`
+	Status            *int64  `json:"status" parquet:"name=status, type=INT64, repetitiontype=OPTIONAL"`
+}
+
+type exportLog struct {
+	LogIndex         int64  `json:"log_index" parquet:"name=log_index, type=INT64"`
+	TransactionHash  string `json:"transaction_hash" parquet:"name=transaction_hash, type=UTF8"`
+	TransactionIndex int64  `json:"transaction_index" parquet:"name=transaction_index, type=INT64"`
+	BlockHash        string `json:"block_hash" parquet:"name=block_hash, type=UTF8"`
+	BlockNumber      int64  `json:"block_number" parquet:"name=block_number, type=INT64"`
+	Address          string `json:"address" parquet:"name=address, type=UTF8"`
+	Data             string `json:"data" parquet:"name=data, type=UTF8"`
+	Topics           string `json:"topics" parquet:"name=topics, type=UTF8"`
+}
+
+type exportTokenTransfer struct {
+	TokenAddress    string `json:"token_address" parquet:"name=token_address, type=UTF8"`
+	FromAddress     string `json:"from_address" parquet:"name=from_address, type=UTF8"`
+	ToAddress       string `json:"to_address" parquet:"name=to_address, type=UTF8"`
+	Value           string `json:"value" parquet:"name=value, type=UTF8"`
+	TransactionHash string `json:"transaction_hash" parquet:"name=transaction_hash, type=UTF8"`
+	LogIndex        int64  `json:"log_index" parquet:"name=log_index, type=INT64"`
+	BlockNumber     int64  `json:"block_number" parquet:"name=block_number, type=INT64"`
+}
+
+// exportTables holds the rows of a batch of blocks.
+type exportTables struct {
+	blocks         []*exportBlock
+	transactions   []*exportTransaction
+	receipts       []*exportReceipt
+	logs           []*exportLog
+	tokenTransfers []*exportTokenTransfer
+}
+
+func optionalString(value string) *string {
+	return &value
+}
+
+// exportAddress formats an address in lowercase, like the hashes, so the
+// columns can be joined without normalising the case first.
+func exportAddress(address common.Address) string {
+	return strings.ToLower(address.Hex())
+}
+
+// add flattens a block into the tables.
+func (tables *exportTables) add(block *receiptsBlock) error {
+	header := block.Header
+	number := header.Number.Int64()
+	hash := header.Hash().Hex()
+	size := types.NewBlockWithHeader(header).WithBody(block.Transactions, block.Uncles).Size()
+
+	tables.blocks = append(tables.blocks, &exportBlock{
+		Number:           number,
+		Hash:             hash,
+		ParentHash:       header.ParentHash.Hex(),
+		Nonce:            hexutil.Encode(header.Nonce[:]),
+		Sha3Uncles:       header.UncleHash.Hex(),
+		LogsBloom:        hexutil.Encode(header.Bloom.Bytes()),
+		TransactionsRoot: header.TxHash.Hex(),
+		StateRoot:        header.Root.Hex(),
+		ReceiptsRoot:     header.ReceiptHash.Hex(),
+		Miner:            exportAddress(header.Coinbase),
+		Difficulty:       header.Difficulty.String(),
+		Size:             int64(size),
+		ExtraData:        hexutil.Encode(header.Extra),
+		GasLimit:         int64(header.GasLimit),
+		GasUsed:          int64(header.GasUsed),
+		Timestamp:        int64(header.Time),
+		TransactionCount: int64(len(block.Transactions)),
+	})
+
+	for i, tx := range block.Transactions {
+		from, err := transactionSender(tx)
+		if err != nil {
+			return err
+		}
+
+		row := &exportTransaction{
+			Hash:             tx.Hash().Hex(),
+			Nonce:            int64(tx.Nonce()),
+			BlockHash:        hash,
+			BlockNumber:      number,
+			TransactionIndex: int64(i),
+			FromAddress:      exportAddress(from),
+			Value:            tx.Value().String(),
+			Gas:              int64(tx.Gas()),
+			GasPrice:         tx.GasPrice().String(),
+			Input:            hexutil.Encode(tx.Data()),
+			BlockTimestamp:   int64(header.Time),
+		}
+		if tx.To() != nil {
+			row.ToAddress = optionalString(exportAddress(*tx.To()))
+		}
+		tables.transactions = append(tables.transactions, row)
+	}
+
+	for i, receipt := range block.Receipts {
+		row := &exportReceipt{
+			TransactionHash:   receipt.TxHash.Hex(),
+			TransactionIndex:  int64(i),
+			BlockHash:         hash,
+			BlockNumber:       number,
+			CumulativeGasUsed: int64(receipt.CumulativeGasUsed),
+			GasUsed:           int64(receipt.GasUsed),
+		}
+		if receipt.ContractAddress != (common.Address{}) {
+			row.ContractAddress = optionalString(exportAddress(receipt.ContractAddress))
+		}
+		// Receipts before Byzantium have a state root instead of a status
+		if len(receipt.PostState) > 0 {
+			row.Root = optionalString(hexutil.Encode(receipt.PostState))
+		} else {
+			status := int64(receipt.Status)
+			row.Status = &status
+		}
+		tables.receipts = append(tables.receipts, row)
+
+		for _, l := range receipt.Logs {
+			topics := make([]string, len(l.Topics))
+			for j, topic := range l.Topics {
+				topics[j] = topic.Hex()
+			}
+
+			tables.logs = append(tables.logs, &exportLog{
+				LogIndex:         int64(l.Index),
+				TransactionHash:  receipt.TxHash.Hex(),
+				TransactionIndex: int64(i),
+				BlockHash:        hash,
+				BlockNumber:      number,
+				Address:          exportAddress(l.Address),
+				Data:             hexutil.Encode(l.Data),
+				Topics:           strings.Join(topics, ","),
+			})
+		}
+	}
+
+	for _, transfer := range extractTokenTransfers(block) {
+		value := transfer.Value
+		if transfer.Standard == tokenStandardERC721 {
+			value = transfer.TokenID
+		}
+
+		tables.tokenTransfers = append(tables.tokenTransfers, &exportTokenTransfer{
+			TokenAddress:    exportAddress(transfer.TokenAddress),
+			FromAddress:     exportAddress(transfer.From),
+			ToAddress:       exportAddress(transfer.To),
+			Value:           value,
+			TransactionHash: transfer.TransactionHash.Hex(),
+			LogIndex:        int64(transfer.LogIndex),
+			BlockNumber:     number,
+		})
+	}
+
+	return nil
+}
+
+// exportTable is a named table of rows. Rows is a slice of pointers to one of
+// the export row types.
+type exportTable struct {
+	name string
+	rows interface{}
+}
+
+func (tables *exportTables) tables() []*exportTable {
+	return []*exportTable{
+		{"blocks", tables.blocks},
+		{"transactions", tables.transactions},
+		{"receipts", tables.receipts},
+		{"logs", tables.logs},
+		{"token_transfers", tables.tokenTransfers},
+	}
+}
+
+func exportContentType(format string) string {
+	switch format {
+	case exportFormatCSV:
+		return "text/csv"
+	case exportFormatNDJSON:
+		return "application/x-ndjson"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// encodeTable writes the rows of a table in the given format.
+func encodeTable(format string, table *exportTable) ([]byte, error) {
+	rows := reflect.ValueOf(table.rows)
+
+	switch format {
+	case exportFormatCSV:
+		return encodeCSV(rows)
+	case exportFormatNDJSON:
+		var buffer bytes.Buffer
+		encoder := json.NewEncoder(&buffer)
+		for i := 0; i < rows.Len(); i++ {
+			err := encoder.Encode(rows.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+		}
+		return buffer.Bytes(), nil
+	case exportFormatParquet:
+		return encodeParquet(rows)
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// encodeCSV uses the JSON names of the fields as the header. Missing
+// optional values are empty.
+func encodeCSV(rows reflect.Value) ([]byte, error) {
+	var buffer bytes.Buffer
+	csvWriter := csv.NewWriter(&buffer)
+
+	rowType := rows.Type().Elem().Elem()
+	header := make([]string, rowType.NumField())
+	for i := range header {
+		header[i] = strings.Split(rowType.Field(i).Tag.Get("json"), ",")[0]
+	}
+	csvWriter.Write(header)
+
+	for i := 0; i < rows.Len(); i++ {
+		row := rows.Index(i).Elem()
+		record := make([]string, row.NumField())
+		for j := range record {
+			field := row.Field(j)
+			if field.Kind() == reflect.Ptr {
+				if field.IsNil() {
+					continue
+				}
+				field = field.Elem()
+			}
+			record[j] = fmt.Sprint(field.Interface())
+		}
+		csvWriter.Write(record)
+	}
+
+	csvWriter.Flush()
+	return buffer.Bytes(), csvWriter.Error()
+}
+
+func encodeParquet(rows reflect.Value) ([]byte, error) {
+	file := &parquetBuffer{}
+	parquetWriter, err := writer.NewParquetWriter(file, reflect.New(rows.Type().Elem().Elem()).Interface(), 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < rows.Len(); i++ {
+		err = parquetWriter.Write(rows.Index(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = parquetWriter.WriteStop()
+	if err != nil {
+		return nil, err
+	}
+
+	return file.Bytes(), nil
+}
+
+// parquetBuffer is an in-memory source.ParquetFile that can only be written.
+type parquetBuffer struct {
+	bytes.Buffer
+}
+
+func (file *parquetBuffer) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekCurrent {
+		return int64(file.Len()), nil
+	}
+
+	return 0, errors.New("parquet buffer can only be written")
+}
+
+func (file *parquetBuffer) Close() error {
+	return nil
+}
+
+func (file *parquetBuffer) Open(name string) (source.ParquetFile, error) {
+	return nil, errors.New("parquet buffer can only be written")
+}
+
+func (file *parquetBuffer) Create(name string) (source.ParquetFile, error) {
+	return file, nil
+}
+
+// exportKey follows the partition layout of ethereum-etl, e.g.
+// export/blocks/start_block=00000100/end_block=00000199/blocks_00000100_00000199.csv
+func exportKey(table string, from *big.Int, to *big.Int, format string) string {
+	return fmt.Sprintf("export/%s/start_block=%08d/end_block=%08d/%s_%08d_%08d.%s", table, from, to, table, from, to, format)
+}
+
+// exportRange writes the tables of a range of cached blocks, one file per
+// table.
+func exportRange(from *big.Int, to *big.Int, format string, s3Client s3Client) error {
+	tables := &exportTables{}
+	for n := new(big.Int).Set(from); n.Cmp(to) <= 0; n.Add(n, big.NewInt(1)) {
+		data, blockFormat, err := s3Client.GetBlock(n)
+		if err != nil {
+			return fmt.Errorf("block %s: %s", n, err)
+		}
+
+		block, err := decodeBlock(blockFormat, data)
+		if err != nil {
+			return fmt.Errorf("block %s: %s", n, err)
+		}
+
+		err = tables.add(block)
+		if err != nil {
+			return fmt.Errorf("block %s: %s", n, err)
+		}
+	}
+
+	for _, table := range tables.tables() {
+		data, err := encodeTable(format, table)
+		if err != nil {
+			return err
+		}
+
+		err = s3Client.StoreFile(exportKey(table.name, from, to, format), string(data), exportContentType(format))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// firstBatch returns the start of the first whole batch at or after the
+// working block start.
+func firstBatch(workingBlockStart *big.Int, batchSize int) *big.Int {
+	size := big.NewInt(int64(batchSize))
+	start := new(big.Int).Add(workingBlockStart, new(big.Int).Sub(size, big.NewInt(1)))
+	start.Div(start, size)
+	return start.Mul(start, size)
+}
+
+// processedBlock returns the last block that every block before it has been
+// processed up to, or nil if no block has been finished yet. Blocks that are
+// still being worked on hold it back.
+func (p *pipeline) processedBlock() (*big.Int, error) {
+	ready, err := p.clients.redis.getLastFinishedBlock()
+	if err != nil || ready == nil {
+		return nil, err
+	}
+
+	working, err := p.clients.redis.getWorkingBlocks()
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range working {
+		if block.Number.Cmp(ready) <= 0 {
+			ready = new(big.Int).Sub(block.Number, big.NewInt(1))
+		}
+	}
+
+	return ready, nil
+}
+
+// export writes every batch whose blocks have all been processed. Batches are
+// aligned to multiples of the batch size.
+func (p *pipeline) export() error {
+	cursor, err := p.clients.redis.getExportCursor()
+	if err != nil {
+		return err
+	}
+	if cursor == nil {
+		cursor = firstBatch(p.config.workingBlockStart, p.config.exportBatchSize)
+	}
+
+	ready, err := p.processedBlock()
+	if err != nil || ready == nil {
+		return err
+	}
+
+	size := big.NewInt(int64(p.config.exportBatchSize))
+	for {
+		end := new(big.Int).Add(cursor, size)
+		end.Sub(end, big.NewInt(1))
+		if end.Cmp(ready) > 0 {
+			return nil
+		}
+
+		p.log.Infof("Exporting blocks %s to %s", cursor, end)
+		err = exportRange(cursor, end, p.config.exportFormat, p.clients.s3)
+		if err != nil {
+			return err
+		}
+
+		cursor = new(big.Int).Add(end, big.NewInt(1))
+		err = p.clients.redis.setExportCursor(cursor)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// exportLoop exports finished batches until the process exits.
+func (p *pipeline) exportLoop() {
+	for {
+		time.Sleep(exportInterval)
+
+		err := p.export()
+		if err != nil {
+			p.log.Error("Failed to export blocks")
+			p.log.Error(err)
+			incrementMetric(p.name, "export_errors")
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/prettymuchbryce/ingestr/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+func testExportBlock(t testing.TB) (*receiptsBlock, common.Address) {
+	block, err := unmarshalReceiptBlock(testBlockReceipts)
+	assert.NoError(t, err)
+
+	contractBlock, _, address := testContractBlock(t, 0)
+	block.Transactions = contractBlock.Transactions
+	block.Receipts = contractBlock.Receipts
+
+	from := common.BytesToHash(testFrom.Bytes())
+	to := common.BytesToHash(testTo.Bytes())
+	block.Receipts[0].Status = types.ReceiptStatusSuccessful
+	block.Receipts[0].GasUsed = 21000
+	block.Receipts[0].Logs = testTransferBlock(
+		&types.Log{Topics: []common.Hash{transferTopic, from, to}, Data: testWord(1000)},
+	).Receipts[0].Logs
+
+	return block, address
+}
+
+func TestExportTables(t *testing.T) {
+	block, address := testExportBlock(t)
+
+	tables := &exportTables{}
+	err := tables.add(block)
+	assert.NoError(t, err)
+
+	assert.Len(t, tables.blocks, 1)
+	assert.Equal(t, int64(8816481), tables.blocks[0].Number)
+	assert.Equal(t, "0x5715f190c16d0b954ee2741b255cdb5930b738ef7edba01852df8a721c81409b", tables.blocks[0].Hash)
+	assert.Equal(t, "0x56f2b9180109f03a", tables.blocks[0].Nonce)
+	assert.Equal(t, "2449559075042291", tables.blocks[0].Difficulty)
+	assert.Equal(t, int64(1), tables.blocks[0].TransactionCount)
+
+	assert.Len(t, tables.transactions, 1)
+	assert.Nil(t, tables.transactions[0].ToAddress)
+	assert.Equal(t, "0x6000", tables.transactions[0].Input)
+
+	assert.Len(t, tables.receipts, 1)
+	assert.Equal(t, strings.ToLower(address.Hex()), *tables.receipts[0].ContractAddress)
+	assert.Equal(t, int64(1), *tables.receipts[0].Status)
+	assert.Nil(t, tables.receipts[0].Root)
+
+	assert.Len(t, tables.logs, 1)
+	assert.Equal(t, strings.ToLower(testToken.Hex()), tables.logs[0].Address)
+	assert.Equal(t, 3, len(strings.Split(tables.logs[0].Topics, ",")))
+
+	assert.Len(t, tables.tokenTransfers, 1)
+	assert.Equal(t, "1000", tables.tokenTransfers[0].Value)
+	assert.Equal(t, strings.ToLower(testFrom.Hex()), tables.tokenTransfers[0].FromAddress)
+
+	receipts := &exportTable{"receipts", tables.receipts}
+
+	data, err := encodeTable(exportFormatCSV, receipts)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, "transaction_hash,transaction_index,block_hash,block_number,cumulative_gas_used,gas_used,contract_address,root,status", lines[0])
+	assert.True(t, strings.HasSuffix(lines[1], ",0,21000,"+strings.ToLower(address.Hex())+",,1"))
+
+	data, err = encodeTable(exportFormatNDJSON, receipts)
+	assert.NoError(t, err)
+	var row map[string]interface{}
+	err = json.Unmarshal(data, &row)
+	assert.NoError(t, err)
+	assert.Nil(t, row["root"])
+	assert.Equal(t, float64(21000), row["gas_used"])
+
+	for _, table := range tables.tables() {
+		data, err = encodeTable(exportFormatParquet, table)
+		assert.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(data, []byte("PAR1")), table.name)
+		assert.True(t, bytes.HasSuffix(data, []byte("PAR1")), table.name)
+	}
+
+	// The rows read back from a Parquet file match the exported rows
+	data, err = encodeTable(exportFormatParquet, receipts)
+	assert.NoError(t, err)
+	parquetReader, err := reader.NewParquetReader(&parquetTestFile{bytes.NewReader(data)}, new(exportReceipt), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), parquetReader.GetNumRows())
+	rows := make([]exportReceipt, 1)
+	assert.NoError(t, parquetReader.Read(&rows))
+	parquetReader.ReadStop()
+	assert.Equal(t, *tables.receipts[0], rows[0])
+}
+
+// parquetTestFile is an in-memory source.ParquetFile that can only be read.
+type parquetTestFile struct {
+	*bytes.Reader
+}
+
+func (file *parquetTestFile) Write(p []byte) (int, error) {
+	return 0, errors.New("parquet test file can only be read")
+}
+
+func (file *parquetTestFile) Close() error {
+	return nil
+}
+
+func (file *parquetTestFile) Open(name string) (source.ParquetFile, error) {
+	data := make([]byte, file.Size())
+	_, err := file.ReadAt(data, 0)
+	return &parquetTestFile{bytes.NewReader(data)}, err
+}
+
+func (file *parquetTestFile) Create(name string) (source.ParquetFile, error) {
+	return nil, errors.New("parquet test file can only be read")
+}
+
+func TestFirstBatch(t *testing.T) {
+	assert.Equal(t, int64(0), firstBatch(big.NewInt(0), 100).Int64())
+	assert.Equal(t, int64(200), firstBatch(big.NewInt(150), 100).Int64())
+	assert.Equal(t, int64(200), firstBatch(big.NewInt(200), 100).Int64())
+}
+
+func TestExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingestr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	embedded := testCreateEmbeddedClient(t, dir, 60)
+	defer embedded.close()
+
+	conf := *testConf
+	conf.exportFormat = exportFormatCSV
+	conf.exportBatchSize = 100
+	conf.workingBlockStart = big.NewInt(50)
+
+	s3 := &mocks.S3Client{}
+	s3.On("GetBlock", mock.Anything).Return(testBlockReceipts, blockFormatJSON, nil)
+	s3.On("StoreFile", mock.Anything, mock.Anything, "text/csv").Return(nil)
+
+	p := createPipeline(&conf)
+	p.clients = &clients{redis: embedded, s3: s3}
+
+	// Nothing is exported before a block has been finished
+	err = p.export()
+	assert.NoError(t, err)
+	s3.AssertNotCalled(t, "GetBlock", mock.Anything)
+
+	// Only the batch from 100 to 199 is complete
+	err = embedded.setLastFinishedBlock(big.NewInt(250))
+	assert.NoError(t, err)
+
+	err = p.export()
+	assert.NoError(t, err)
+	s3.AssertNumberOfCalls(t, "GetBlock", 100)
+	s3.AssertCalled(t, "StoreFile", "export/blocks/start_block=00000100/end_block=00000199/blocks_00000100_00000199.csv", mock.Anything, "text/csv")
+	s3.AssertNumberOfCalls(t, "StoreFile", 5)
+
+	cursor, err := embedded.getExportCursor()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(200), cursor.Int64())
+
+	// A block that is still being worked on holds back its batch
+	working, err := embedded.getNextWorkingBlock(big.NewInt(1000))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(251), working.Int64())
+	err = embedded.setLastFinishedBlock(big.NewInt(350))
+	assert.NoError(t, err)
+
+	err = p.export()
+	assert.NoError(t, err)
+	s3.AssertNumberOfCalls(t, "StoreFile", 5)
+
+	err = embedded.removeFromWorkingSet(working)
+	assert.NoError(t, err)
+
+	err = p.export()
+	assert.NoError(t, err)
+	s3.AssertNumberOfCalls(t, "StoreFile", 10)
+
+	cursor, err = embedded.getExportCursor()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(300), cursor.Int64())
+}
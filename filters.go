@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// notificationFilter selects the transactions and logs of a block that a
+// consumer cares about. Empty lists match everything. Addresses and topics
+// select logs by contract address and by their first topic, the event
+// signature. From and to select transactions by sender and recipient.
+type notificationFilter struct {
+	Name      string
+	Addresses []common.Address
+	Topics    []common.Hash
+	From      []common.Address
+	To        []common.Address
+
+	// SNSTopic is the topic that matches are published to. Matches of filters
+	// without a topic are published to SNS_TOPIC.
+	SNSTopic string
+}
+
+// filterMatch is published for every block that matches a filter.
+type filterMatch struct {
+	BlockNumber        *big.Int `json:"blockNumber"`
+	Filter             string   `json:"filter"`
+	TransactionIndexes []int    `json:"transactionIndexes"`
+	LogIndexes         []uint   `json:"logIndexes"`
+}
+
+// readFilterFile reads the filters from a YAML file such as:
+//
+//	filters:
+//	  - name: dai
+//	    addresses: [0x6b175474e89094c44da98b954eedeac495271d0f]
+//	    topics: [0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef]
+//	    sns_topic: arn:aws:sns:us-east-1:42069:dai
+func readFilterFile(path string) ([]*notificationFilter, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw struct {
+		Filters []struct {
+			Name      string   `yaml:"name"`
+			Addresses []string `yaml:"addresses"`
+			Topics    []string `yaml:"topics"`
+			From      []string `yaml:"from"`
+			To        []string `yaml:"to"`
+			SNSTopic  string   `yaml:"sns_topic"`
+		} `yaml:"filters"`
+	}
+	err = yaml.UnmarshalStrict(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var filters []*notificationFilter
+	names := make(map[string]bool)
+	for i, rawFilter := range raw.Filters {
+		if rawFilter.Name == "" {
+			return nil, fmt.Errorf("filter %d has no name", i)
+		}
+		if names[rawFilter.Name] {
+			return nil, fmt.Errorf("filter %q is defined more than once", rawFilter.Name)
+		}
+		names[rawFilter.Name] = true
+
+		filter := &notificationFilter{Name: rawFilter.Name, SNSTopic: rawFilter.SNSTopic}
+
+		filter.Addresses, err = parseFilterAddresses(rawFilter.Addresses)
+		if err == nil {
+			filter.From, err = parseFilterAddresses(rawFilter.From)
+		}
+		if err == nil {
+			filter.To, err = parseFilterAddresses(rawFilter.To)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("filter %q: %s", rawFilter.Name, err)
+		}
+
+		for _, topic := range rawFilter.Topics {
+			decoded, err := hexutil.Decode(topic)
+			if err != nil || len(decoded) != common.HashLength {
+				return nil, fmt.Errorf("filter %q: invalid topic %q", rawFilter.Name, topic)
+			}
+			filter.Topics = append(filter.Topics, common.BytesToHash(decoded))
+		}
+
+		filters = append(filters, filter)
+	}
+
+	return filters, nil
+}
+
+func parseFilterAddresses(values []string) ([]common.Address, error) {
+	var addresses []common.Address
+	for _, value := range values {
+		if !common.IsHexAddress(value) {
+			return nil, fmt.Errorf("invalid address %q", value)
+		}
+		addresses = append(addresses, common.HexToAddress(value))
+	}
+
+	return addresses, nil
+}
+
+func (filter *notificationFilter) hasLogCriteria() bool {
+	return len(filter.Addresses) > 0 || len(filter.Topics) > 0
+}
+
+// mayMatch checks the logs bloom of the header, which rules out most blocks
+// without looking at their receipts.
+func (filter *notificationFilter) mayMatch(header *types.Header) bool {
+	if !filter.hasLogCriteria() || header == nil {
+		return true
+	}
+
+	if len(filter.Addresses) > 0 {
+		found := false
+		for _, address := range filter.Addresses {
+			if types.BloomLookup(header.Bloom, address) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(filter.Topics) > 0 {
+		for _, topic := range filter.Topics {
+			if types.BloomLookup(header.Bloom, topic) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// match returns the transactions and logs of the block that match the filter,
+// or nil if nothing matches.
+func (filter *notificationFilter) match(blockNumber *big.Int, block *receiptsBlock) (*filterMatch, error) {
+	if !filter.mayMatch(block.Header) {
+		return nil, nil
+	}
+
+	match := &filterMatch{
+		BlockNumber:        blockNumber,
+		Filter:             filter.Name,
+		TransactionIndexes: []int{},
+		LogIndexes:         []uint{},
+	}
+
+	for i, tx := range block.Transactions {
+		ok, err := filter.matchTransaction(tx)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		if !filter.hasLogCriteria() {
+			match.TransactionIndexes = append(match.TransactionIndexes, i)
+			continue
+		}
+
+		if i >= len(block.Receipts) {
+			continue
+		}
+
+		matchedLog := false
+		for _, l := range block.Receipts[i].Logs {
+			if filter.matchLog(l) {
+				match.LogIndexes = append(match.LogIndexes, l.Index)
+				matchedLog = true
+			}
+		}
+		if matchedLog {
+			match.TransactionIndexes = append(match.TransactionIndexes, i)
+		}
+	}
+
+	if len(match.TransactionIndexes) == 0 {
+		return nil, nil
+	}
+
+	return match, nil
+}
+
+func (filter *notificationFilter) matchTransaction(tx *types.Transaction) (bool, error) {
+	if len(filter.To) > 0 && (tx.To() == nil || !containsAddress(filter.To, *tx.To())) {
+		return false, nil
+	}
+
+	if len(filter.From) > 0 {
+		sender, err := transactionSender(tx)
+		if err != nil {
+			return false, err
+		}
+		if !containsAddress(filter.From, sender) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (filter *notificationFilter) matchLog(l *types.Log) bool {
+	if len(filter.Addresses) > 0 && !containsAddress(filter.Addresses, l.Address) {
+		return false
+	}
+
+	if len(filter.Topics) > 0 {
+		if len(l.Topics) == 0 {
+			return false
+		}
+		for _, topic := range filter.Topics {
+			if l.Topics[0] == topic {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func containsAddress(addresses []common.Address, address common.Address) bool {
+	for _, a := range addresses {
+		if a == address {
+			return true
+		}
+	}
+
+	return false
+}
+
+// publishFilterMatches publishes a message to the sink of every filter that
+// the block matches. Sinks that succeeded are skipped when the block is
+// retried.
+func publishFilterMatches(blockNumber *big.Int, block *receiptsBlock, attributes map[string]string, p *pipeline) error {
+	for _, filter := range p.config.filters {
+		match, err := filter.match(blockNumber, block)
+		if err != nil {
+			return err
+		}
+		if match == nil {
+			continue
+		}
+
+		data, err := json.Marshal(match)
+		if err != nil {
+			return err
+		}
+
+		filterAttributes := map[string]string{"filter": filter.Name}
+		for name, value := range attributes {
+			filterAttributes[name] = value
+		}
+
+		sink := p.clients.sns
+		if filter.SNSTopic != "" {
+			sink = p.clients.filterSns[filter.SNSTopic]
+		}
+
+		err = p.publish(blockNumber, block, "filter/"+filter.Name, sink, string(data), filterAttributes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
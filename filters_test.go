@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/prettymuchbryce/ingestr/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const testFilterFile = `filters:
+  - name: dai
+    addresses: [0x6b175474e89094c44da98b954eedeac495271d0f]
+    topics: [0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef]
+    sns_topic: arn:aws:sns:us-east-1:42069:dai
+  - name: payments
+    to: [0xea674fdde714fd979de3edf0f56aa9716b898ec8]
+  - name: other
+    addresses: [0x0000000000000000000000000000000000000001]
+`
+
+func testFilterBlock(t *testing.T) (*receiptsBlock, common.Address) {
+	key, err := crypto.GenerateKey()
+	assert.NoError(t, err)
+
+	tx := types.NewTransaction(0, testTo, big.NewInt(1), 21000, big.NewInt(1), nil)
+	tx, err = types.SignTx(tx, types.NewEIP155Signer(big.NewInt(1)), key)
+	assert.NoError(t, err)
+
+	from := common.BytesToHash(testFrom.Bytes())
+	to := common.BytesToHash(testTo.Bytes())
+	block := testTransferBlock(
+		&types.Log{Topics: []common.Hash{common.HexToHash("0x01")}},
+		&types.Log{Topics: []common.Hash{transferTopic, from, to}, Data: testWord(1)},
+	)
+	block.Transactions = []*types.Transaction{tx}
+	block.Header = &types.Header{Bloom: types.CreateBloom(block.Receipts)}
+
+	return block, crypto.PubkeyToAddress(key.PublicKey)
+}
+
+func TestNotificationFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingestr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "filters.yaml")
+	err = ioutil.WriteFile(path, []byte(testFilterFile), 0644)
+	assert.NoError(t, err)
+
+	filters, err := readFilterFile(path)
+	assert.NoError(t, err)
+	assert.Len(t, filters, 3)
+
+	blockNumber := big.NewInt(8886217)
+	block, sender := testFilterBlock(t)
+
+	match, err := filters[0].match(blockNumber, block)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0}, match.TransactionIndexes)
+	assert.Equal(t, []uint{1}, match.LogIndexes)
+
+	match, err = filters[1].match(blockNumber, block)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0}, match.TransactionIndexes)
+	assert.Empty(t, match.LogIndexes)
+
+	// The bloom rules out the block without looking at the receipts
+	assert.False(t, filters[2].mayMatch(block.Header))
+	match, err = filters[2].match(blockNumber, block)
+	assert.NoError(t, err)
+	assert.Nil(t, match)
+
+	senderFilter := &notificationFilter{Name: "sender", From: []common.Address{testFrom}}
+	match, err = senderFilter.match(blockNumber, block)
+	assert.NoError(t, err)
+	assert.Nil(t, match)
+
+	senderFilter.From = []common.Address{sender}
+	match, err = senderFilter.match(blockNumber, block)
+	assert.NoError(t, err)
+	assert.NotNil(t, match)
+
+	// Every filter publishes to its own sink
+	conf := *testConf
+	conf.filters = filters
+
+	defaultSns := &mocks.SNSClient{}
+	defaultSns.On("Publish", `{"blockNumber":8886217,"filter":"payments","transactionIndexes":[0],"logIndexes":[]}`, mock.Anything).Return(errors.New("throttled")).Once()
+	defaultSns.On("Publish", `{"blockNumber":8886217,"filter":"payments","transactionIndexes":[0],"logIndexes":[]}`, mock.Anything).Return(nil)
+	daiSns := &mocks.SNSClient{}
+	daiSns.On("Publish", `{"blockNumber":8886217,"filter":"dai","transactionIndexes":[0],"logIndexes":[1]}`, map[string]string{"filter": "dai", "uncleCount": "0"}).Return(nil)
+
+	p := createPipeline(&conf)
+	p.clients = &clients{sns: defaultSns, filterSns: map[string]snsClient{filters[0].SNSTopic: daiSns}}
+
+	err = publishFilterMatches(blockNumber, block, map[string]string{"uncleCount": "0"}, p)
+	assert.EqualError(t, err, "throttled")
+
+	// A retry only publishes to the sinks that failed
+	err = publishFilterMatches(blockNumber, block, map[string]string{"uncleCount": "0"}, p)
+	assert.NoError(t, err)
+	defaultSns.AssertExpectations(t)
+	daiSns.AssertExpectations(t)
+	defaultSns.AssertNumberOfCalls(t, "Publish", 2)
+	daiSns.AssertNumberOfCalls(t, "Publish", 1)
+
+	// Once the block has been processed it is published in full again
+	p.forgetPublished(blockNumber, block)
+	err = publishFilterMatches(blockNumber, block, map[string]string{"uncleCount": "0"}, p)
+	assert.NoError(t, err)
+	defaultSns.AssertNumberOfCalls(t, "Publish", 3)
+	daiSns.AssertNumberOfCalls(t, "Publish", 2)
+
+	err = ioutil.WriteFile(path, []byte("filters:\n  - name: bad\n    topics: [0x01]\n"), 0644)
+	assert.NoError(t, err)
+	_, err = readFilterFile(path)
+	assert.EqualError(t, err, `filter "bad": invalid topic "0x01"`)
+}
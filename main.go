@@ -2,132 +2,204 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	"math/big"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
 
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/ethereum/go-ethereum/core/types"
 	redis "github.com/go-redis/redis/v7"
-	"github.com/joho/godotenv"
 	log "github.com/sirupsen/logrus"
 )
 
-var latestBlock *big.Int
-var workCompleteChan chan bool = make(chan bool)
-
 type clients struct {
 	eth   ethClient
 	redis redisClient
 	s3    s3Client
 	sns   snsClient
-}
 
-type config struct {
-	ethNodeHost               string
-	ethNodePort               string
-	httpReqTimeoutMS          int
-	maxConcurrency            int
-	minConfirmations          int
-	newBlockTimeoutMS         int
-	redisAddress              string
-	redisDB                   int
-	redisLastFinishedBlockKey string
-	redisPassword             string
-	redisWorkingBlockSetKey   string
-	redisWorkingTimeSetKey    string
-	s3BucketURI               string
-	s3TimeoutMS               int
-	snsTimeoutMS              int
-	snsTopic                  string
-	workingBlockStart         *big.Int
-	workingBlockTTLSeconds    int
+	// transferSns publishes token transfers. It is nil unless a token transfer
+	// topic is configured.
+	transferSns snsClient
+
+	// filterSns holds a client for the SNS topic of every notification filter
+	// that has its own topic.
+	filterSns map[string]snsClient
 }
 
-func loadEnvVariables() *config {
-	httpReqTimeoutMS, _ := strconv.Atoi(os.Getenv("HTTP_TIMEOUT_MS"))
-	maxConcurrency, _ := strconv.Atoi(os.Getenv("MAX_CONCURRENCY"))
-	minConfirmations, _ := strconv.Atoi(os.Getenv("MIN_CONFIRMATIONS"))
-	newBlockTimeoutMS, _ := strconv.Atoi(os.Getenv("NEW_BLOCK_TIMEOUT_MS"))
-	redisDB, _ := strconv.Atoi(os.Getenv("REDIS_DB"))
-	s3TimeoutMS, _ := strconv.Atoi(os.Getenv("S3_TIMEOUT_MS"))
-	snsTimeoutMS, _ := strconv.Atoi(os.Getenv("SNS_TIMEOUT_MS"))
-	workingBlockStart, _ := strconv.Atoi(os.Getenv("WORKING_BLOCK_START"))
-	workingBlockTTLSeconds, _ := strconv.Atoi(os.Getenv("WORKING_BLOCK_TTL_SECONDS"))
-
-	return &config{
-		ethNodeHost:               os.Getenv("ETH_NODE_HOST"),
-		ethNodePort:               os.Getenv("ETH_NODE_PORT"),
-		httpReqTimeoutMS:          httpReqTimeoutMS,
-		maxConcurrency:            maxConcurrency,
-		minConfirmations:          minConfirmations,
-		newBlockTimeoutMS:         newBlockTimeoutMS,
-		redisAddress:              os.Getenv("REDIS_ADDRESS"),
-		redisDB:                   redisDB,
-		redisLastFinishedBlockKey: os.Getenv("REDIS_LAST_FINISHED_BLOCK_KEY"),
-		redisPassword:             os.Getenv("REDIS_PASSWORD"),
-		redisWorkingBlockSetKey:   os.Getenv("REDIS_WORKING_BLOCK_SET_KEY"),
-		redisWorkingTimeSetKey:    os.Getenv("REDIS_WORKING_TIME_SET_KEY"),
-		s3BucketURI:               os.Getenv("S3_BUCKET_URI"),
-		s3TimeoutMS:               s3TimeoutMS,
-		snsTimeoutMS:              snsTimeoutMS,
-		snsTopic:                  os.Getenv("SNS_TOPIC"),
-		workingBlockStart:         big.NewInt(int64(workingBlockStart)),
-		workingBlockTTLSeconds:    workingBlockTTLSeconds,
+func createRedisClient(conf *config) (redisClient, error) {
+	if conf.redisAddress == "" {
+		log.Infof("No redis address configured. Using embedded database: %s", conf.embeddedDBPath)
+
+		return createEmbeddedClient(
+			conf.embeddedDBPath,
+			conf.instanceID,
+			conf.workingBlockStart,
+			conf.redisWorkingBlockSetKey,
+			conf.redisRequeueBlockSetKey,
+			conf.redisLastFinishedBlockKey,
+			conf.redisPausedKey,
+			conf.redisNetworkKey,
+			conf.redisIndexKey,
+			conf.redisExportCursorKey,
+			conf.redisArchiveCursorKey,
+			conf.workingBlockTTLSeconds,
+		)
 	}
+
+	log.Info("Connecting to redis")
+
+	return createRealRedisClient(
+		conf.redisAddress,
+		conf.redisPassword,
+		conf.redisDB,
+		conf.instanceID,
+		conf.workingBlockStart,
+		conf.redisWorkingTimeSetKey,
+		conf.redisWorkingBlockSetKey,
+		conf.redisWorkingOwnerKey,
+		conf.redisRequeueBlockSetKey,
+		conf.redisLastFinishedBlockKey,
+		conf.redisPausedKey,
+		conf.redisNetworkKey,
+		conf.redisIndexKey,
+		conf.redisExportCursorKey,
+		conf.redisArchiveCursorKey,
+		conf.workingBlockTTLSeconds,
+	)
 }
 
-func main() {
-	env := os.Getenv("ENV")
+// createS3Client creates an S3 client. If chainID is not nil it is stored in
+// the metadata of every block.
+func createS3Client(conf *config, chainID *big.Int) *realS3Client {
+	return createRealS3Client(
+		conf.s3AWS,
+		conf.s3BucketURI,
+		conf.s3KeyPrefix,
+		chainID,
+		conf.blockFormat,
+		conf.readAllBlockFormats,
+		conf.compression,
+		conf.gzipLevel,
+		conf.zstdDictionaryID,
+		createEncryptor(conf),
+		conf.archiveSize,
+		msToDuration(conf.s3TimeoutMS),
+	)
+}
 
-	if env == "" {
-		godotenv.Load(".env.development")
+// createEncryptor creates the encryptor of stored blocks. It is disabled with
+// ENCRYPTION=none.
+func createEncryptor(conf *config) *encryptor {
+	switch conf.encryption {
+	case encryptionKeyfile:
+		return newEncryptor(conf.encryptionKeyID, conf.encryptionKeys)
+	case encryptionKMS:
+		return newEncryptor(conf.encryptionKeyID, createKMSKeys(conf.kmsAWS, msToDuration(conf.s3TimeoutMS)))
+	default:
+		return newEncryptor("", nil)
 	}
+}
 
-	err := godotenv.Load()
+func main() {
+	conf, args, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	}
 	if err != nil {
-		log.Fatal("Error loading .env file")
-		return
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
 
-	conf := loadEnvVariables()
+	if len(args) > 0 {
+		err := runCommand(args, conf)
+		if err == errUsage {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	initLogger()
 
 	log.Info("Starting up")
-	log.Info("Establishing connection to Ethereum node")
 
-	ethClient, err := createRealEthClient(conf.ethNodeHost, conf.ethNodePort)
+	var pipelines []*pipeline
+	for _, pipelineConf := range conf.pipelines {
+		p := createPipeline(pipelineConf)
+		if pipelineConf.abiDirectory != "" {
+			p.abis, err = loadABIRegistry(pipelineConf.abiDirectory)
+			if err != nil {
+				p.log.Fatal(err)
+			}
+		}
+		pipelines = append(pipelines, p)
+	}
+
+	go reloadABIsOnSignal(pipelines)
+
+	if conf.adminAddress != "" {
+		log.Infof("Starting admin server on %s", conf.adminAddress)
+		adminServer := createAdminServer(conf.adminAddress, conf.adminToken, pipelines)
+		go func() {
+			err := adminServer.ListenAndServe()
+			if err != nil {
+				log.Error("Admin server stopped")
+				log.Error(err)
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for _, p := range pipelines {
+		wg.Add(1)
+		go func(p *pipeline) {
+			defer wg.Done()
+			p.run()
+		}(p)
+	}
+
+	wg.Wait()
+	log.Fatal("All pipelines stopped")
+}
+
+func createClients(conf *config, logger *log.Entry) (*clients, error) {
+	logger.Info("Establishing connection to Ethereum node")
+
+	ethClient, err := createReconnectingEthClient(conf.ethNodeHost, conf.ethNodePort)
 	if err != nil {
-		log.Error("Failed to connect to ETH node")
-		log.Fatal(err)
-		return
+		logger.Error("Failed to connect to ETH node")
+		return nil, err
 	}
 
-	log.Info("Connecting to redis")
+	network, err := fetchNetwork(conf, ethClient)
+	if err != nil {
+		logger.Error("Failed to get the chain ID and genesis block from ETH node")
+		return nil, err
+	}
 
-	redisClient, err := createRealRedisClient(
-		conf.redisAddress,
-		conf.redisPassword,
-		conf.redisDB,
-		conf.workingBlockStart,
-		conf.redisWorkingTimeSetKey,
-		conf.redisWorkingBlockSetKey,
-		conf.redisLastFinishedBlockKey,
-		conf.workingBlockTTLSeconds,
-	)
+	redisClient, err := createRedisClient(conf)
 	if err != nil {
-		log.Error("Failed to connect to redis")
-		log.Fatal(err)
-		return
+		logger.Error("Failed to connect to redis")
+		return nil, err
 	}
 
-	log.Info("Creating SNS client")
-	snsClient := createRealSnsClient(conf.snsTopic, msToDuration(conf.snsTimeoutMS))
+	logger.Info("Creating SNS client")
+	snsClient := createRealSnsClient(conf.snsAWS, conf.snsTopic, network.ChainID, msToDuration(conf.snsTimeoutMS))
 
-	log.Info("Creating S3 client")
-	s3Client := createRealS3Client(conf.s3BucketURI, msToDuration(conf.s3TimeoutMS))
+	logger.Info("Creating S3 client")
+	s3Client := createS3Client(conf, network.ChainID)
 
 	clients := &clients{
 		eth:   ethClient,
@@ -136,190 +208,428 @@ func main() {
 		s3:    s3Client,
 	}
 
-	start(clients, conf)
-}
-
-func start(clients *clients, config *config) {
-	go func() {
-		for {
-			if latestBlock != nil {
-				for i := 0; i < config.maxConcurrency; i++ {
-					findNextWork(clients, config)
-				}
-
-				for {
-					<-workCompleteChan
-					findNextWork(clients, config)
-				}
-			}
-		}
-	}()
+	clients.filterSns = createFilterSnsClients(conf, network.ChainID, logger)
 
-	ctx := context.Background()
-	ctx, cancelFn := context.WithTimeout(ctx, msToDuration(config.newBlockTimeoutMS))
-	defer cancelFn()
+	if conf.tokenTransfers && conf.tokenTransferSnsTopic != "" {
+		logger.Info("Creating token transfer SNS client")
+		clients.transferSns = createRealSnsClient(conf.snsAWS, conf.tokenTransferSnsTopic, network.ChainID, msToDuration(conf.snsTimeoutMS))
+	}
 
-	log.Info("Subscribing to new blocks")
-	ethChan := make(chan *types.Header)
-	_, err := clients.eth.SubscribeNewHead(ctx, ethChan)
+	logger.Infof("Verifying network: %s", network)
+	err = verifyNetwork(network, conf, clients)
 	if err != nil {
-		log.Fatal("Failed to subscribe to latest block")
+		closeRedisClient(redisClient)
+		return nil, err
 	}
 
-	for {
-		header := <-ethChan
-		latestBlock = header.Number
+	return clients, nil
+}
+
+// closeRedisClient closes a client that is not used after all. The embedded
+// database is locked while it is open, so a pipeline that retries creating its
+// clients could not open it again.
+func closeRedisClient(client redisClient) {
+	if closer, ok := client.(interface{ close() error }); ok {
+		closer.close()
+	}
+}
 
-		log.Infof("Found new block: %s", latestBlock)
+// createFilterSnsClients creates a client for every SNS topic that a
+// notification filter publishes to.
+func createFilterSnsClients(conf *config, chainID *big.Int, logger *log.Entry) map[string]snsClient {
+	clients := make(map[string]snsClient)
+	for _, filter := range conf.filters {
+		if filter.SNSTopic != "" && clients[filter.SNSTopic] == nil {
+			logger.Infof("Creating SNS client for filter: %s", filter.Name)
+			clients[filter.SNSTopic] = createRealSnsClient(conf.snsAWS, filter.SNSTopic, chainID, msToDuration(conf.snsTimeoutMS))
+		}
 	}
+
+	return clients
 }
 
-func findNextWork(clients *clients, config *config) int {
+func findNextWork(p *pipeline) int {
 	var newWorkItems int = 0
 
-	nextAllowedBlock := big.NewInt(0)
-	nextAllowedBlock.Sub(
-		latestBlock,
-		big.NewInt(int64(config.minConfirmations)),
-	)
+	nextAllowedBlock := p.nextAllowedBlock()
+	if nextAllowedBlock == nil {
+		go func() { p.workCompleteChan <- true }()
+		return 0
+	}
+
+	paused, err := p.clients.redis.isPaused()
+	if err != nil {
+		p.log.Error("Failed to check whether ingestion is paused")
+		p.log.Error(err)
+		go func() { p.workCompleteChan <- true }()
+		return 0
+	}
+
+	if paused {
+		go func() { p.workCompleteChan <- true }()
+		return 0
+	}
 
-	nextBlock, err := clients.redis.getStaleWorkingBlock()
+	nextBlock, err := p.clients.redis.getStaleWorkingBlock()
 	if err != nil {
 		if err != redis.TxFailedErr {
-			log.Error("Failed to get a stale working block")
-			log.Error(err)
-			go func() { workCompleteChan <- true }()
+			p.log.Error("Failed to get a stale working block")
+			p.log.Error(err)
+			go func() { p.workCompleteChan <- true }()
 			return 0
 		} else {
-			log.Warn(err)
+			p.log.Warn(err)
 		}
 	}
 
 	if nextBlock == nil {
-		nextBlock, err = clients.redis.getNextWorkingBlock(nextAllowedBlock)
+		nextBlock, err = p.clients.redis.getNextWorkingBlock(nextAllowedBlock)
 		if err != nil {
 			if err != redis.TxFailedErr {
-				log.Error("Failed to get the next working block")
-				log.Error(err)
-				go func() { workCompleteChan <- true }()
+				p.log.Error("Failed to get the next working block")
+				p.log.Error(err)
+				go func() { p.workCompleteChan <- true }()
 				return 0
 			} else {
-				log.Warn(err)
+				p.log.Warn(err)
 			}
 		}
 	}
 
 	if nextBlock.Cmp(nextAllowedBlock) <= 0 {
-		go processBlock(nextBlock, config, clients, workCompleteChan)
+		go func() {
+			// A block whose processing panicked stays in the working set and
+			// is processed again once it is stale
+			var err error
+			panicked := p.runGuarded("Processing block "+nextBlock.String(), func() {
+				err = processBlock(nextBlock, p)
+			})
+			if panicked || err != nil {
+				incrementMetric(p.name, "block_errors")
+				recordBlockFailure(nextBlock, p)
+			}
+		}()
 		newWorkItems++
 	} else {
-		go func() { workCompleteChan <- true }()
+		go func() { p.workCompleteChan <- true }()
 	}
 
 	return newWorkItems
 }
 
-func processBlock(
-	blockNumber *big.Int,
-	config *config,
-	clients *clients,
-	workCompleteChan chan bool,
-) error {
-	log.Infof("Processing block: %s", blockNumber.String())
+// recordBlockFailure counts a failure of a block, and warns once the block
+// has become a dead letter.
+func recordBlockFailure(blockNumber *big.Int, p *pipeline) {
+	failures, err := p.clients.redis.recordBlockFailure(blockNumber)
+	if err != nil {
+		p.log.Error("Failed to record the failure of block: " + blockNumber.String())
+		p.log.Error(err)
+		return
+	}
+
+	if failures == deadLetterFailures {
+		p.log.Warnf("Block %s failed %d times and is a dead letter", blockNumber.String(), failures)
+		incrementMetric(p.name, "dead_letters")
+	}
+}
+
+func processBlock(blockNumber *big.Int, p *pipeline) error {
+	p.log.Infof("Processing block: %s", blockNumber.String())
 
-	defer func() { workCompleteChan <- true }()
+	defer func() { p.workCompleteChan <- true }()
 
 	var hitFromCache = false
-	var receiptBlockString string
-	receiptBlockString, err := clients.s3.GetBlock(blockNumber)
+	var storeBlock = false
+	block, format, err := getCachedBlock(blockNumber, p)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			if aerr.Code() == s3.ErrCodeNoSuchKey {
-				ctx := context.Background()
-				ctx, cancelFn := context.WithTimeout(ctx, msToDuration(config.httpReqTimeoutMS))
-				block, err := clients.eth.BlockByNumber(ctx, blockNumber)
-				if err != nil {
-					cancelFn()
-					log.Errorf("Failed to get block from ETH node: %s", blockNumber.String())
-					return err
-				}
-				cancelFn()
-				transactions := block.Transactions()
-				var receipts []*types.Receipt = make([]*types.Receipt, 0)
-				for i := 0; i < len(transactions); i++ {
-					t := transactions[i]
-					ctx := context.Background()
-					ctx, cancelFn := context.WithTimeout(ctx, msToDuration(config.httpReqTimeoutMS))
-					receipt, err := clients.eth.TransactionReceipt(ctx, t.Hash())
-					if err != nil {
-						cancelFn()
-						log.Error(err)
-						return err
-					}
-					receipts = append(receipts, receipt)
-					cancelFn()
-				}
-
-				receiptsBlock := &receiptsBlock{
-					Header:       block.Header(),
-					Receipts:     receipts,
-					Hash:         block.Hash(),
-					Transactions: block.Transactions(),
-				}
-
-				receiptBlockString, err = marshalReceiptBlock(receiptsBlock)
-				if err != nil {
-					log.Error(err)
-					return err
-				}
-			} else {
-				log.Error(err)
-				return err
-			}
-		} else {
-			log.Error(err)
+		p.log.Error(err)
+		return err
+	}
+
+	if block != nil && p.config.validateCacheHits {
+		block, err = validateCachedBlock(blockNumber, block, format, p)
+		if err != nil {
+			p.log.Error(err)
 			return err
 		}
 	}
 
-	if err == nil {
-		log.Infof("s3 Cache hit for block: %s", blockNumber.String())
+	if block != nil {
+		p.log.Infof("s3 Cache hit for block: %s", blockNumber.String())
+		incrementMetric(p.name, "cache_hits")
 		hitFromCache = true
+
+		// Blocks in other formats are rewritten in the configured format
+		storeBlock = format != p.config.blockFormat
+	} else {
+		block, err = fetchReceiptsBlock(blockNumber, p.config, p.clients, p.log)
+		if err != nil {
+			return err
+		}
+
+		storeBlock = true
+	}
+
+	// Cached blocks that were stored without decoded logs are stored again
+	// with them
+	if p.abis != nil && len(block.DecodedLogs) == 0 {
+		block.DecodedLogs = p.abis.decodeLogs(block)
+		if len(block.DecodedLogs) > 0 {
+			storeBlock = true
+		}
+	}
+
+	var objects []string
+	var traces json.RawMessage
+	if p.config.traceMode != traceModeNone {
+		traces, err = processTraces(blockNumber, hitFromCache, p)
+		if err != nil {
+			p.log.Errorf("Failed to store traces of block: %s", blockNumber.String())
+			p.log.Error(err)
+			return err
+		}
+		objects = append(objects, tracesObject)
+	}
+
+	if p.config.stateDiffMode != traceModeNone {
+		err = processStateDiffs(blockNumber, hitFromCache, p)
+		if err != nil {
+			p.log.Errorf("Failed to store state diffs of block: %s", blockNumber.String())
+			p.log.Error(err)
+			return err
+		}
+		objects = append(objects, stateDiffsObject)
+	}
+
+	if p.config.contractIndex {
+		err = indexContractCreations(blockNumber, block, traces, p)
+		if err != nil {
+			p.log.Errorf("Failed to index contracts of block: %s", blockNumber.String())
+			p.log.Error(err)
+			return err
+		}
+	}
+
+	if p.config.transactionIndex {
+		err = indexTransactions(blockNumber, block, p)
+		if err != nil {
+			p.log.Errorf("Failed to index transactions of block: %s", blockNumber.String())
+			p.log.Error(err)
+			return err
+		}
+	}
+
+	attributes := notificationAttributes(block, objects)
+
+	if p.config.tokenTransfers {
+		transfers, err := processTokenTransfers(blockNumber, block, hitFromCache, p)
+		if err != nil {
+			p.log.Errorf("Failed to store token transfers of block: %s", blockNumber.String())
+			p.log.Error(err)
+			return err
+		}
+		attributes[tokenTransfersObject] = "true"
+		attributes["tokenTransferCount"] = strconv.Itoa(len(transfers))
 	}
 
-	err = clients.sns.Publish(blockNumber.String())
+	if len(p.config.filters) > 0 {
+		err = publishFilterMatches(blockNumber, block, attributes, p)
+	} else {
+		err = p.publish(blockNumber, block, "block", p.clients.sns, blockNumber.String(), attributes)
+	}
 	if err != nil {
-		log.Errorf("Failed to publish new block number to SNS: %s", blockNumber.String())
-		log.Error(err)
+		p.log.Errorf("Failed to publish new block number to SNS: %s", blockNumber.String())
+		p.log.Error(err)
 		return err
 	}
 
-	if !hitFromCache {
-		err = clients.s3.StoreBlock(blockNumber, receiptBlockString)
+	if storeBlock {
+		err = p.clients.s3.WriteBlock(blockNumber, p.config.blockFormat, func(w io.Writer) error {
+			return writeBlock(w, p.config.blockFormat, block)
+		})
 		if err != nil {
-			log.Errorf("Failed to store block in S3: %s", blockNumber.String())
-			log.Error(err)
+			p.log.Errorf("Failed to store block in S3: %s", blockNumber.String())
+			p.log.Error(err)
 			return err
 		}
 	}
 
 	for retries := 10; retries > 0; retries-- {
-		err := clients.redis.removeFromWorkingSet(blockNumber)
+		err := p.clients.redis.removeFromWorkingSet(blockNumber)
 		if err == nil {
 			break
 		}
 		if err != redis.TxFailedErr {
-			log.Error(err)
+			p.log.Error(err)
 			return err
 		}
 		if retries == 0 {
-			log.Error("Failed to process block due to redis lock. Will retry after TTL")
-			log.Error(err)
+			p.log.Error("Failed to process block due to redis lock. Will retry after TTL")
+			p.log.Error(err)
 			return err
 		}
 	}
 
-	log.Infof("Successfully processed block: %s", blockNumber.String())
+	p.forgetPublished(blockNumber, block)
+
+	p.log.Infof("Successfully processed block: %s", blockNumber.String())
+	incrementMetric(p.name, "blocks_processed")
 
 	return nil
 }
+
+// reloadABIsOnSignal reloads the ABIs of every pipeline on SIGHUP.
+func reloadABIsOnSignal(pipelines []*pipeline) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		for _, p := range pipelines {
+			if p.abis == nil {
+				continue
+			}
+
+			err := p.abis.reload()
+			if err != nil {
+				p.log.Error("Failed to reload ABIs")
+				p.log.Error(err)
+				continue
+			}
+
+			contracts, signatures := p.abis.size()
+			p.log.Infof("Reloaded ABIs of %d contracts and %d event signatures", contracts, signatures)
+		}
+	}
+}
+
+// getCachedBlock returns a block from the S3 cache and the format it is stored
+// in. It returns nil if the block is not cached or cannot be decoded. Blocks
+// stored with an older schema version only lack uncles, so they are fetched
+// again with the current schema only if their header has uncles.
+func getCachedBlock(blockNumber *big.Int, p *pipeline) (*receiptsBlock, string, error) {
+	block, format, err := readCachedBlock(blockNumber, p.clients.s3)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, "", nil
+		}
+		if _, ok := err.(*corruptBlockError); ok {
+			p.log.Warnf("Cached block %s failed verification, fetching it again", blockNumber.String())
+			p.log.Warn(err)
+			incrementMetric(p.name, "cache_corrupt")
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+
+	if block.Version < receiptsBlockVersion {
+		if block.Header.UncleHash != types.EmptyUncleHash {
+			p.log.Infof("Cached block %s has schema version %d and uncles, fetching it again", blockNumber.String(), block.Version)
+			incrementMetric(p.name, "cache_outdated")
+			return nil, "", nil
+		}
+		block.Version = receiptsBlockVersion
+		block.Uncles = []*types.Header{}
+	}
+
+	return block, format, nil
+}
+
+// readCachedBlock decodes a cached block as it is read, like decodeStoredBlock.
+func readCachedBlock(blockNumber *big.Int, s3Client s3Client) (*receiptsBlock, string, error) {
+	reader, format, err := s3Client.ReadBlock(blockNumber)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer reader.Close()
+
+	block, err := decodeStoredBlock(blockNumber, format, reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return block, format, nil
+}
+
+// validateCachedBlock compares a cached block with the canonical header of its
+// number. A block that was cached before a reorg is moved aside and nil is
+// returned, so that the canonical block is ingested instead.
+func validateCachedBlock(blockNumber *big.Int, block *receiptsBlock, format string, p *pipeline) (*receiptsBlock, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), msToDuration(p.config.httpReqTimeoutMS))
+	defer cancelFn()
+
+	header, err := p.clients.eth.HeaderByNumber(ctx, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Hash() == block.Hash {
+		return block, nil
+	}
+
+	p.log.Warnf("Cached block %s has hash %s but the canonical hash is %s, ingesting it again", blockNumber.String(), block.Hash.Hex(), header.Hash().Hex())
+	incrementMetric(p.name, "cache_orphans")
+
+	err = p.clients.s3.OrphanBlock(blockNumber, block.Hash.Hex(), format)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// notificationAttributes are sent with the SNS message of a block. Every
+// object stored next to the block, such as its traces, is flagged by name.
+func notificationAttributes(block *receiptsBlock, objects []string) map[string]string {
+	attributes := map[string]string{
+		"uncleCount": strconv.Itoa(len(block.Uncles)),
+	}
+	for _, object := range objects {
+		attributes[object] = "true"
+	}
+
+	return attributes
+}
+
+// fetchReceiptsBlock fetches a block and the receipts of all its transactions
+// from the ETH node.
+func fetchReceiptsBlock(
+	blockNumber *big.Int,
+	config *config,
+	clients *clients,
+	logger *log.Entry,
+) (*receiptsBlock, error) {
+	ctx := context.Background()
+	ctx, cancelFn := context.WithTimeout(ctx, msToDuration(config.httpReqTimeoutMS))
+	block, err := clients.eth.BlockByNumber(ctx, blockNumber)
+	if err != nil {
+		cancelFn()
+		logger.Errorf("Failed to get block from ETH node: %s", blockNumber.String())
+		return nil, err
+	}
+	cancelFn()
+	transactions := block.Transactions()
+	var receipts []*types.Receipt = make([]*types.Receipt, 0)
+	for i := 0; i < len(transactions); i++ {
+		t := transactions[i]
+		ctx := context.Background()
+		ctx, cancelFn := context.WithTimeout(ctx, msToDuration(config.httpReqTimeoutMS))
+		receipt, err := clients.eth.TransactionReceipt(ctx, t.Hash())
+		if err != nil {
+			cancelFn()
+			logger.Error(err)
+			return nil, err
+		}
+		receipts = append(receipts, receipt)
+		cancelFn()
+	}
+
+	return &receiptsBlock{
+		Version:      receiptsBlockVersion,
+		Header:       block.Header(),
+		Receipts:     receipts,
+		Hash:         block.Hash(),
+		Transactions: block.Transactions(),
+		Uncles:       block.Uncles(),
+	}, nil
+}
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
 	"math/big"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/ethereum/go-ethereum/core/types"
 	redis "github.com/go-redis/redis/v7"
 	"github.com/joho/godotenv"
 	"github.com/prettymuchbryce/ingestr/mocks"
@@ -17,6 +25,7 @@ import (
 
 var testConf *config
 var testClients *clients
+var testPipeline *pipeline
 
 var ethMock *mocks.EthClient
 var s3Mock *mocks.S3Client
@@ -36,16 +45,28 @@ func TestMain(m *testing.M) {
 		return
 	}
 
-	testConf = loadEnvVariables()
+	testConf, _, err = parseConfig(nil)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
 
 	rc, err := createRealRedisClient(
 		testConf.redisAddress,
 		testConf.redisPassword,
 		testConf.redisDB,
+		testConf.instanceID,
 		testConf.workingBlockStart,
 		testConf.redisWorkingTimeSetKey,
 		testConf.redisWorkingBlockSetKey,
+		testConf.redisWorkingOwnerKey,
+		testConf.redisRequeueBlockSetKey,
 		testConf.redisLastFinishedBlockKey,
+		testConf.redisPausedKey,
+		testConf.redisNetworkKey,
+		testConf.redisIndexKey,
+		testConf.redisExportCursorKey,
+		testConf.redisArchiveCursorKey,
 		testConf.maxConcurrency,
 	)
 
@@ -62,13 +83,16 @@ func TestMain(m *testing.M) {
 		redis: rc,
 	}
 
+	testPipeline = createPipeline(testConf)
+	testPipeline.clients = testClients
+
 	code := m.Run()
 	os.Exit(code)
 }
 
 func TestFindWorkNoLatest(t *testing.T) {
-	latestBlock = big.NewInt(1)
-	newWorkItems := findNextWork(testClients, testConf)
+	testPipeline.latestBlock = big.NewInt(1)
+	newWorkItems := findNextWork(testPipeline)
 	assert.Equal(t, 0, newWorkItems)
 
 	testClearRedis(redisClientTest)
@@ -76,14 +100,17 @@ func TestFindWorkNoLatest(t *testing.T) {
 
 func TestProcessBlock(t *testing.T) {
 	blockNumber := big.NewInt(int64(8886217))
-	s3Mock.On("GetBlock", blockNumber).Return("", awserr.New(s3.ErrCodeNoSuchKey, "", nil))
+	s3Mock.On("ReadBlock", blockNumber).Return(nil, "", awserr.New(s3.ErrCodeNoSuchKey, "", nil))
 	ethMock.On("BlockByNumber", mock.Anything, blockNumber).Return(testGetBlock(testBlock), nil)
-	snsMock.On("Publish", mock.Anything).Return(nil)
-	s3Mock.On("StoreBlock", blockNumber, mock.Anything).Return(nil)
+	snsMock.On("Publish", mock.Anything, mock.Anything).Return(nil)
+	s3Mock.On("WriteBlock", blockNumber, blockFormatJSON, mock.Anything).Return(nil)
 
 	testWorkCompleteChan := make(chan bool, 1)
+	p := createPipeline(testConf)
+	p.clients = testClients
+	p.workCompleteChan = testWorkCompleteChan
 
-	err := processBlock(blockNumber, testConf, testClients, testWorkCompleteChan)
+	err := processBlock(blockNumber, p)
 	assert.NoError(t, err)
 
 	result, err := testGetRedisLastFinishedBlock(redisClientTest, testConf.redisLastFinishedBlockKey)
@@ -102,3 +129,198 @@ func TestProcessBlock(t *testing.T) {
 	assert.Equal(t, true, chanResult)
 
 }
+
+func TestProcessBlockDecodesCachedLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingestr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "erc20.json"), []byte(testERC20ABI), 0644)
+	assert.NoError(t, err)
+	registry, err := loadABIRegistry(dir)
+	assert.NoError(t, err)
+
+	embedded := testCreateEmbeddedClient(t, dir+"/db", 60)
+	defer embedded.close()
+
+	block, _ := testExportBlock(t)
+	blockNumber := block.Header.Number
+	cached, err := encodeBlock(blockFormatJSON, block)
+	assert.NoError(t, err)
+
+	// A cached block without decoded logs is stored again with them
+	var stored bytes.Buffer
+	s3 := &mocks.S3Client{}
+	s3.On("ReadBlock", blockNumber).Return(ioutil.NopCloser(strings.NewReader(cached)), blockFormatJSON, nil)
+	s3.On("WriteBlock", blockNumber, blockFormatJSON, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		args.Get(2).(func(io.Writer) error)(&stored)
+	})
+	sns := &mocks.SNSClient{}
+	sns.On("Publish", blockNumber.String(), mock.Anything).Return(nil)
+
+	p := createPipeline(testConf)
+	p.clients = &clients{redis: embedded, s3: s3, sns: sns}
+	p.abis = registry
+	p.workCompleteChan = make(chan bool, 1)
+
+	err = processBlock(blockNumber, p)
+	assert.NoError(t, err)
+	s3.AssertExpectations(t)
+
+	decoded, err := decodeBlock(blockFormatJSON, stored.String())
+	assert.NoError(t, err)
+	assert.Len(t, decoded.DecodedLogs, 1)
+	assert.Equal(t, "Transfer", decoded.DecodedLogs[0].Event)
+}
+
+func TestRequeueBlocks(t *testing.T) {
+	err := testClients.redis.requeueBlocks(big.NewInt(10), big.NewInt(11))
+	assert.NoError(t, err)
+
+	block, err := testClients.redis.getNextWorkingBlock(big.NewInt(100))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), block.Int64())
+
+	block, err = testClients.redis.getNextWorkingBlock(big.NewInt(100))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(11), block.Int64())
+
+	working, err := testClients.redis.getWorkingBlocks()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(working))
+	assert.Equal(t, testConf.instanceID, working[0].Owner)
+
+	// Large ranges are added in batches, and too large ranges are rejected
+	err = testClients.redis.requeueBlocks(big.NewInt(1000), big.NewInt(1000+2*requeueBatchSize))
+	assert.NoError(t, err)
+	count, err := redisClientTest.ZCard(testConf.redisRequeueBlockSetKey).Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2*requeueBatchSize+1), count)
+
+	err = testClients.redis.requeueBlocks(big.NewInt(0), big.NewInt(maxRequeueBlocks))
+	assert.EqualError(t, err, "cannot requeue 1000001 blocks, at most 1000000 blocks can be requeued at once")
+
+	testClearRedis(redisClientTest)
+}
+
+func TestDeadLetters(t *testing.T) {
+	block, err := testClients.redis.getNextWorkingBlock(big.NewInt(100))
+	assert.NoError(t, err)
+
+	for i := int64(1); i <= deadLetterFailures; i++ {
+		failures, err := testClients.redis.recordBlockFailure(block)
+		assert.NoError(t, err)
+		assert.Equal(t, i, failures)
+	}
+
+	deadLetters, err := testClients.redis.getDeadLetters()
+	assert.NoError(t, err)
+	assert.Equal(t, []*big.Int{block}, deadLetters)
+
+	err = testClients.redis.requeueBlocks(big.NewInt(10), big.NewInt(11))
+	assert.NoError(t, err)
+	requeued, err := testClients.redis.getRequeuedCount()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), requeued)
+
+	// A block that is processed is no longer a dead letter
+	assert.NoError(t, testClients.redis.removeFromWorkingSet(block))
+	deadLetters, err = testClients.redis.getDeadLetters()
+	assert.NoError(t, err)
+	assert.Empty(t, deadLetters)
+
+	failures, err := testClients.redis.recordBlockFailure(block)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), failures)
+
+	testClearRedis(redisClientTest)
+}
+
+func TestGetCachedBlockVersion(t *testing.T) {
+	s3 := &mocks.S3Client{}
+	p := createPipeline(testConf)
+	p.clients = &clients{s3: s3}
+
+	cached, err := unmarshalReceiptBlock(testBlockReceipts)
+	assert.NoError(t, err)
+	blockNumber := cached.Header.Number
+
+	// Older blocks without uncles are used as they are
+	s3.On("ReadBlock", blockNumber).Return(ioutil.NopCloser(strings.NewReader(testBlockReceipts)), blockFormatJSON, nil).Once()
+	block, _, err := getCachedBlock(blockNumber, p)
+	assert.NoError(t, err)
+	assert.Equal(t, receiptsBlockVersion, block.Version)
+	assert.Empty(t, block.Uncles)
+
+	// Older blocks with uncles are fetched again to store their uncles
+	withUncles, err := unmarshalReceiptBlock(testBlockReceipts)
+	assert.NoError(t, err)
+	withUncles.Header.UncleHash = types.CalcUncleHash([]*types.Header{{Number: big.NewInt(8816480)}})
+	withUncles.Hash = withUncles.Header.Hash()
+	old, err := encodeBlock(blockFormatJSON, withUncles)
+	assert.NoError(t, err)
+	s3.On("ReadBlock", blockNumber).Return(ioutil.NopCloser(strings.NewReader(old)), blockFormatJSON, nil).Once()
+	block, _, err = getCachedBlock(blockNumber, p)
+	assert.NoError(t, err)
+	assert.Nil(t, block)
+
+	cached.Version = receiptsBlockVersion
+	current, err := encodeBlock(blockFormatCBOR, cached)
+	assert.NoError(t, err)
+	s3.On("ReadBlock", blockNumber).Return(ioutil.NopCloser(strings.NewReader(current)), blockFormatCBOR, nil).Once()
+	block, format, err := getCachedBlock(blockNumber, p)
+	assert.NoError(t, err)
+	assert.NotNil(t, block)
+	assert.Equal(t, blockFormatCBOR, format)
+	assert.Equal(t, cached.Hash, block.Hash)
+
+	// Blocks that fail verification are fetched again
+	s3.On("ReadBlock", blockNumber).Return(nil, "", &corruptBlockError{blockNumber, "checksum does not match"}).Once()
+	block, _, err = getCachedBlock(blockNumber, p)
+	assert.NoError(t, err)
+	assert.Nil(t, block)
+
+	// A corrupt block may only be found once it has been read
+	s3.On("ReadBlock", blockNumber).Return(ioutil.NopCloser(iotest.ErrReader(&corruptBlockError{blockNumber, "checksum does not match"})), blockFormatJSON, nil).Once()
+	block, _, err = getCachedBlock(blockNumber, p)
+	assert.NoError(t, err)
+	assert.Nil(t, block)
+
+	other := big.NewInt(1)
+	s3.On("ReadBlock", other).Return(ioutil.NopCloser(strings.NewReader(current)), blockFormatCBOR, nil)
+	block, _, err = getCachedBlock(other, p)
+	assert.NoError(t, err)
+	assert.Nil(t, block)
+
+	failed := big.NewInt(4)
+	s3.On("ReadBlock", failed).Return(nil, "", errors.New("timeout"))
+	_, _, err = getCachedBlock(failed, p)
+	assert.EqualError(t, err, "timeout")
+}
+
+func TestValidateCachedBlock(t *testing.T) {
+	eth := &mocks.EthClient{}
+	s3 := &mocks.S3Client{}
+	p := createPipeline(testConf)
+	p.clients = &clients{eth: eth, s3: s3}
+
+	block, err := unmarshalReceiptBlock(testBlockReceipts)
+	assert.NoError(t, err)
+
+	canonical := big.NewInt(8816481)
+	eth.On("HeaderByNumber", mock.Anything, canonical).Return(block.Header, nil).Once()
+	validated, err := validateCachedBlock(canonical, block, blockFormatJSON, p)
+	assert.NoError(t, err)
+	assert.Equal(t, block, validated)
+	s3.AssertNotCalled(t, "OrphanBlock", mock.Anything, mock.Anything, mock.Anything)
+
+	// A block cached before a reorg is moved aside
+	reorged := types.CopyHeader(block.Header)
+	reorged.Extra = []byte("reorg")
+	eth.On("HeaderByNumber", mock.Anything, canonical).Return(reorged, nil).Once()
+	s3.On("OrphanBlock", canonical, block.Hash.Hex(), blockFormatJSON).Return(nil)
+	validated, err = validateCachedBlock(canonical, block, blockFormatJSON, p)
+	assert.NoError(t, err)
+	assert.Nil(t, validated)
+	s3.AssertNumberOfCalls(t, "OrphanBlock", 1)
+}
@@ -0,0 +1,11 @@
+package main
+
+import "expvar"
+
+// metrics are counters labelled by chain, e.g. "mainnet.blocks_processed".
+// They are served by the admin API on /debug/vars.
+var metrics = expvar.NewMap("ingestr")
+
+func incrementMetric(chain string, name string) {
+	metrics.Add(chain+"."+name, 1)
+}
@@ -4,6 +4,7 @@ package mocks
 
 import (
 	context "context"
+	json "encoding/json"
 	big "math/big"
 
 	common "github.com/ethereum/go-ethereum/common"
@@ -43,6 +44,75 @@ func (_m *EthClient) BlockByNumber(ctx context.Context, number *big.Int) (*types
 	return r0, r1
 }
 
+// BlockNumberByTag provides a mock function with given fields: ctx, tag
+func (_m *EthClient) BlockNumberByTag(ctx context.Context, tag string) (*big.Int, error) {
+	ret := _m.Called(ctx, tag)
+
+	var r0 *big.Int
+	if rf, ok := ret.Get(0).(func(context.Context, string) *big.Int); ok {
+		r0 = rf(ctx, tag)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*big.Int)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, tag)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ChainID provides a mock function with given fields: ctx
+func (_m *EthClient) ChainID(ctx context.Context) (*big.Int, error) {
+	ret := _m.Called(ctx)
+
+	var r0 *big.Int
+	if rf, ok := ret.Get(0).(func(context.Context) *big.Int); ok {
+		r0 = rf(ctx)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*big.Int)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// HeaderByNumber provides a mock function with given fields: ctx, number
+func (_m *EthClient) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	ret := _m.Called(ctx, number)
+
+	var r0 *types.Header
+	if rf, ok := ret.Get(0).(func(context.Context, *big.Int) *types.Header); ok {
+		r0 = rf(ctx, number)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*types.Header)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *big.Int) error); ok {
+		r1 = rf(ctx, number)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // SubscribeNewHead provides a mock function with given fields: ctx, ch
 func (_m *EthClient) SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
 	ret := _m.Called(ctx, ch)
@@ -88,3 +158,72 @@ func (_m *EthClient) TransactionReceipt(ctx context.Context, txHash common.Hash)
 
 	return r0, r1
 }
+
+// TraceBlock provides a mock function with given fields: ctx, number, mode
+func (_m *EthClient) TraceBlock(ctx context.Context, number *big.Int, mode string) (json.RawMessage, error) {
+	ret := _m.Called(ctx, number, mode)
+
+	var r0 json.RawMessage
+	if rf, ok := ret.Get(0).(func(context.Context, *big.Int, string) json.RawMessage); ok {
+		r0 = rf(ctx, number, mode)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(json.RawMessage)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *big.Int, string) error); ok {
+		r1 = rf(ctx, number, mode)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// StateDiffs provides a mock function with given fields: ctx, number, mode
+func (_m *EthClient) StateDiffs(ctx context.Context, number *big.Int, mode string) (json.RawMessage, error) {
+	ret := _m.Called(ctx, number, mode)
+
+	var r0 json.RawMessage
+	if rf, ok := ret.Get(0).(func(context.Context, *big.Int, string) json.RawMessage); ok {
+		r0 = rf(ctx, number, mode)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(json.RawMessage)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *big.Int, string) error); ok {
+		r1 = rf(ctx, number, mode)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// CodeAt provides a mock function with given fields: ctx, account, blockNumber
+func (_m *EthClient) CodeAt(ctx context.Context, account common.Address, blockNumber *big.Int) ([]byte, error) {
+	ret := _m.Called(ctx, account, blockNumber)
+
+	var r0 []byte
+	if rf, ok := ret.Get(0).(func(context.Context, common.Address, *big.Int) []byte); ok {
+		r0 = rf(ctx, account, blockNumber)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]byte)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, common.Address, *big.Int) error); ok {
+		r1 = rf(ctx, account, blockNumber)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
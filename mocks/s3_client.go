@@ -3,6 +3,7 @@
 package mocks
 
 import (
+	io "io"
 	big "math/big"
 
 	mock "github.com/stretchr/testify/mock"
@@ -13,8 +14,8 @@ type S3Client struct {
 	mock.Mock
 }
 
-// getBlock provides a mock function with given fields: blockNumber
-func (_m *S3Client) GetBlock(blockNumber *big.Int) (string, error) {
+// GetBlock provides a mock function with given fields: blockNumber
+func (_m *S3Client) GetBlock(blockNumber *big.Int) (string, string, error) {
 	ret := _m.Called(blockNumber)
 
 	var r0 string
@@ -24,9 +25,186 @@ func (_m *S3Client) GetBlock(blockNumber *big.Int) (string, error) {
 		r0 = ret.Get(0).(string)
 	}
 
+	var r1 string
+	if rf, ok := ret.Get(1).(func(*big.Int) string); ok {
+		r1 = rf(blockNumber)
+	} else {
+		r1 = ret.Get(1).(string)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(*big.Int) error); ok {
+		r2 = rf(blockNumber)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// ReadBlock provides a mock function with given fields: blockNumber
+func (_m *S3Client) ReadBlock(blockNumber *big.Int) (io.ReadCloser, string, error) {
+	ret := _m.Called(blockNumber)
+
+	var r0 io.ReadCloser
+	if rf, ok := ret.Get(0).(func(*big.Int) io.ReadCloser); ok {
+		r0 = rf(blockNumber)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(io.ReadCloser)
+		}
+	}
+
+	var r1 string
+	if rf, ok := ret.Get(1).(func(*big.Int) string); ok {
+		r1 = rf(blockNumber)
+	} else {
+		r1 = ret.Get(1).(string)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(*big.Int) error); ok {
+		r2 = rf(blockNumber)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// WriteBlock provides a mock function with given fields: blockNumber, format, encode
+func (_m *S3Client) WriteBlock(blockNumber *big.Int, format string, encode func(io.Writer) error) error {
+	ret := _m.Called(blockNumber, format, encode)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*big.Int, string, func(io.Writer) error) error); ok {
+		r0 = rf(blockNumber, format, encode)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// DeleteBlock provides a mock function with given fields: blockNumber, format
+func (_m *S3Client) DeleteBlock(blockNumber *big.Int, format string) error {
+	ret := _m.Called(blockNumber, format)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*big.Int, string) error); ok {
+		r0 = rf(blockNumber, format)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// OrphanBlock provides a mock function with given fields: blockNumber, hash, format
+func (_m *S3Client) OrphanBlock(blockNumber *big.Int, hash string, format string) error {
+	ret := _m.Called(blockNumber, hash, format)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*big.Int, string, string) error); ok {
+		r0 = rf(blockNumber, hash, format)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// StoreArchive provides a mock function with given fields: from, count, format, write
+func (_m *S3Client) StoreArchive(from *big.Int, count int, format string, write func(*big.Int, io.Writer) error) error {
+	ret := _m.Called(from, count, format, write)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*big.Int, int, string, func(*big.Int, io.Writer) error) error); ok {
+		r0 = rf(from, count, format, write)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// MoveBlockAside provides a mock function with given fields: blockNumber, name
+func (_m *S3Client) MoveBlockAside(blockNumber *big.Int, name string) (int, error) {
+	ret := _m.Called(blockNumber, name)
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func(*big.Int, string) int); ok {
+		r0 = rf(blockNumber, name)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(*big.Int, string) error); ok {
+		r1 = rf(blockNumber, name)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ReencryptBlock provides a mock function with given fields: blockNumber, objects
+func (_m *S3Client) ReencryptBlock(blockNumber *big.Int, objects []string) (int, error) {
+	ret := _m.Called(blockNumber, objects)
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func(*big.Int, []string) int); ok {
+		r0 = rf(blockNumber, objects)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(*big.Int, []string) error); ok {
+		r1 = rf(blockNumber, objects)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ReencryptArchive provides a mock function with given fields: from
+func (_m *S3Client) ReencryptArchive(from *big.Int) (bool, error) {
+	ret := _m.Called(from)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(*big.Int) bool); ok {
+		r0 = rf(from)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
 	var r1 error
 	if rf, ok := ret.Get(1).(func(*big.Int) error); ok {
-		r1 = rf(blockNumber)
+		r1 = rf(from)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetNetwork provides a mock function with given fields:
+func (_m *S3Client) GetNetwork() (string, error) {
+	ret := _m.Called()
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func() string); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -34,13 +212,62 @@ func (_m *S3Client) GetBlock(blockNumber *big.Int) (string, error) {
 	return r0, r1
 }
 
-// storeBlock provides a mock function with given fields: blockNumber, data
-func (_m *S3Client) StoreBlock(blockNumber *big.Int, data string) error {
-	ret := _m.Called(blockNumber, data)
+// StoreNetwork provides a mock function with given fields: data
+func (_m *S3Client) StoreNetwork(data string) error {
+	ret := _m.Called(data)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(*big.Int, string) error); ok {
-		r0 = rf(blockNumber, data)
+	if rf, ok := ret.Get(0).(func(string) error); ok {
+		r0 = rf(data)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetBlockObject provides a mock function with given fields: name, blockNumber
+func (_m *S3Client) GetBlockObject(name string, blockNumber *big.Int) (string, error) {
+	ret := _m.Called(name, blockNumber)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(string, *big.Int) string); ok {
+		r0 = rf(name, blockNumber)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, *big.Int) error); ok {
+		r1 = rf(name, blockNumber)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// StoreBlockObject provides a mock function with given fields: name, blockNumber, data
+func (_m *S3Client) StoreBlockObject(name string, blockNumber *big.Int, data string) error {
+	ret := _m.Called(name, blockNumber, data)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, *big.Int, string) error); ok {
+		r0 = rf(name, blockNumber, data)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// StoreFile provides a mock function with given fields: name, data, contentType
+func (_m *S3Client) StoreFile(name string, data string, contentType string) error {
+	ret := _m.Called(name, data, contentType)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, string, string) error); ok {
+		r0 = rf(name, data, contentType)
 	} else {
 		r0 = ret.Error(0)
 	}
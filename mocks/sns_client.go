@@ -9,13 +9,13 @@ type SNSClient struct {
 	mock.Mock
 }
 
-// publish provides a mock function with given fields: data
-func (_m *SNSClient) Publish(data string) error {
-	ret := _m.Called(data)
+// publish provides a mock function with given fields: data, attributes
+func (_m *SNSClient) Publish(data string, attributes map[string]string) error {
+	ret := _m.Called(data, attributes)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string) error); ok {
-		r0 = rf(data)
+	if rf, ok := ret.Get(0).(func(string, map[string]string) error); ok {
+		r0 = rf(data, attributes)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// network identifies the chain that an ETH node serves. It is recorded in the
+// coordinator and the store on the first run so that ingestr never mixes data
+// from different chains.
+type network struct {
+	ChainID     *big.Int    `json:"chainId"`
+	GenesisHash common.Hash `json:"genesisHash"`
+}
+
+func (n *network) String() string {
+	if n.GenesisHash == (common.Hash{}) {
+		return fmt.Sprintf("chain %s", n.ChainID)
+	}
+
+	return fmt.Sprintf("chain %s with genesis %s", n.ChainID, n.GenesisHash.Hex())
+}
+
+func (n *network) equal(other *network) bool {
+	return n.ChainID.Cmp(other.ChainID) == 0 && n.GenesisHash == other.GenesisHash
+}
+
+type networkMismatchError struct {
+	source   string
+	expected *network
+	actual   *network
+}
+
+func (err *networkMismatchError) Error() string {
+	return fmt.Sprintf("ETH node serves %s but the %s expects %s", err.actual, err.source, err.expected)
+}
+
+func fetchNetwork(conf *config, eth ethClient) (*network, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), msToDuration(conf.httpReqTimeoutMS))
+	defer cancelFn()
+
+	chainID, err := eth.ChainID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	genesis, err := eth.HeaderByNumber(ctx, big.NewInt(0))
+	if err != nil {
+		return nil, err
+	}
+
+	return &network{
+		ChainID:     chainID,
+		GenesisHash: genesis.Hash(),
+	}, nil
+}
+
+// verifyNetwork compares the network of the ETH node with the pinned chain ID
+// and with the network recorded in the coordinator and the store. The network
+// is recorded wherever it is missing.
+func verifyNetwork(actual *network, conf *config, clients *clients) error {
+	if conf.chainID != nil && conf.chainID.Cmp(actual.ChainID) != 0 {
+		return &networkMismatchError{
+			source:   "configuration",
+			expected: &network{ChainID: conf.chainID},
+			actual:   actual,
+		}
+	}
+
+	recorded, err := clients.redis.getNetwork()
+	if err != nil {
+		return err
+	}
+
+	if recorded == nil {
+		err = clients.redis.setNetwork(actual)
+		if err != nil {
+			return err
+		}
+	} else if !recorded.equal(actual) {
+		return &networkMismatchError{source: "coordinator", expected: recorded, actual: actual}
+	}
+
+	storedString, err := clients.s3.GetNetwork()
+	if err != nil {
+		return err
+	}
+
+	if storedString == "" {
+		data, err := json.Marshal(actual)
+		if err != nil {
+			return err
+		}
+
+		return clients.s3.StoreNetwork(string(data))
+	}
+
+	var stored *network
+	err = json.Unmarshal([]byte(storedString), &stored)
+	if err != nil {
+		return err
+	}
+
+	if !stored.equal(actual) {
+		return &networkMismatchError{source: "store", expected: stored, actual: actual}
+	}
+
+	return nil
+}
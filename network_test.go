@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/prettymuchbryce/ingestr/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestVerifyNetwork(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingestr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	embedded := testCreateEmbeddedClient(t, dir, 60)
+	defer embedded.close()
+
+	mainnet := &network{ChainID: big.NewInt(1), GenesisHash: common.HexToHash("0xd4e5")}
+	goerli := &network{ChainID: big.NewInt(5), GenesisHash: common.HexToHash("0xbf7e")}
+
+	s3 := &mocks.S3Client{}
+	s3.On("GetNetwork").Return("", nil).Once()
+	s3.On("StoreNetwork", mock.Anything).Return(nil).Once()
+	networkClients := &clients{redis: embedded, s3: s3}
+
+	// The first run records the network
+	err = verifyNetwork(mainnet, testConf, networkClients)
+	assert.NoError(t, err)
+
+	recorded, err := embedded.getNetwork()
+	assert.NoError(t, err)
+	assert.True(t, recorded.equal(mainnet))
+
+	err = verifyNetwork(goerli, testConf, networkClients)
+	mismatch, ok := err.(*networkMismatchError)
+	assert.True(t, ok)
+	assert.Equal(t, "coordinator", mismatch.source)
+
+	// A pinned chain ID is checked before anything else
+	pinned := *testConf
+	pinned.chainID = big.NewInt(5)
+	err = verifyNetwork(mainnet, &pinned, networkClients)
+	mismatch, ok = err.(*networkMismatchError)
+	assert.True(t, ok)
+	assert.Equal(t, "configuration", mismatch.source)
+
+	s3.AssertExpectations(t)
+}
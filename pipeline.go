@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+)
+
+var pipelineRestartDelay = 10 * time.Second
+
+// headPollInterval is how often the pipeline checks whether it has seen a head
+// before it starts working.
+var headPollInterval = time.Second
+
+// Confirmation policies decide how far behind the head a block must be before
+// it is processed.
+const (
+	confirmationDepth     = "depth"
+	confirmationSafe      = "safe"
+	confirmationFinalized = "finalized"
+)
+
+// pipeline ingests a single chain. Every pipeline has its own clients and
+// state so that a failure in one does not affect the others.
+type pipeline struct {
+	name             string
+	config           *config
+	clients          *clients
+	workCompleteChan chan bool
+	log              *log.Entry
+
+	// abis decodes event logs. It is nil unless an ABI directory is
+	// configured.
+	abis *abiRegistry
+
+	// lock guards the heads, which the subscription updates while workers
+	// and the admin server read them, and the clients, which run sets while
+	// the admin server reads them.
+	lock           sync.Mutex
+	latestBlock    *big.Int
+	finalizedBlock *big.Int
+
+	// published holds the messages that were published for blocks which
+	// failed afterwards, so that a retry only publishes the rest.
+	publishedLock sync.Mutex
+	published     map[string]map[string]bool
+}
+
+func createPipeline(conf *config) *pipeline {
+	return &pipeline{
+		name:             conf.chainName,
+		config:           conf,
+		workCompleteChan: make(chan bool),
+		log:              log.WithField("chain", conf.chainName),
+	}
+}
+
+// maxPublishedBlocks bounds how many failed blocks the pipeline remembers the
+// published messages of. Blocks that fail for longer are published in full
+// when they are retried.
+const maxPublishedBlocks = 10000
+
+// publishedKey identifies a block by its number and hash, so that a block
+// which is replaced by a reorg is published again.
+func publishedKey(blockNumber *big.Int, block *receiptsBlock) string {
+	return blockNumber.String() + "/" + block.Hash.Hex()
+}
+
+// publish publishes a message of a block to a sink unless it was already
+// published while the block was processed before. A block is only retried
+// after a later step fails, so its messages are published once for every
+// time it is processed in full. The message is identified by name within the
+// block.
+func (p *pipeline) publish(blockNumber *big.Int, block *receiptsBlock, name string, sink snsClient, data string, attributes map[string]string) error {
+	key := publishedKey(blockNumber, block)
+
+	p.publishedLock.Lock()
+	published := p.published[key][name]
+	p.publishedLock.Unlock()
+	if published {
+		return nil
+	}
+
+	err := sink.Publish(data, attributes)
+	if err != nil {
+		return err
+	}
+
+	p.publishedLock.Lock()
+	defer p.publishedLock.Unlock()
+	if p.published == nil || len(p.published) >= maxPublishedBlocks {
+		p.published = make(map[string]map[string]bool)
+	}
+	if p.published[key] == nil {
+		p.published[key] = make(map[string]bool)
+	}
+	p.published[key][name] = true
+
+	return nil
+}
+
+// forgetPublished forgets the published messages of a block once it has been
+// processed, so that it is published in full if it is processed again.
+func (p *pipeline) forgetPublished(blockNumber *big.Int, block *receiptsBlock) {
+	p.publishedLock.Lock()
+	defer p.publishedLock.Unlock()
+
+	delete(p.published, publishedKey(blockNumber, block))
+}
+
+// run connects the pipeline and ingests blocks until the process exits. If
+// connecting or subscribing fails it is retried after pipelineRestartDelay.
+func (p *pipeline) run() {
+	for p.connectedClients() == nil {
+		clients, err := createClients(p.config, p.log)
+		if _, ok := err.(*networkMismatchError); ok {
+			p.log.Error("Refusing to run on a different network")
+			p.log.Error(err)
+			return
+		}
+		if err != nil {
+			p.log.Error(err)
+			time.Sleep(pipelineRestartDelay)
+			continue
+		}
+		p.lock.Lock()
+		p.clients = clients
+		p.lock.Unlock()
+	}
+
+	go p.supervise("Worker", p.work)
+
+	if p.config.exportFormat != exportFormatNone {
+		go p.supervise("Export", func(bool) { p.exportLoop() })
+	}
+
+	if p.config.archiveSize > 0 {
+		go p.supervise("Archiver", func(bool) { p.archiveLoop() })
+	}
+
+	for {
+		err := p.subscribe()
+		p.log.Error("Subscription to new blocks failed")
+		p.log.Error(err)
+		incrementMetric(p.name, "subscription_errors")
+		time.Sleep(pipelineRestartDelay)
+
+		err = p.reconnect()
+		if err != nil {
+			p.log.Error("Failed to reconnect to ETH node")
+			p.log.Error(err)
+		}
+	}
+}
+
+// reconnect connects to the node again before the pipeline subscribes again,
+// since the subscription usually fails because the connection was lost.
+func (p *pipeline) reconnect() error {
+	client, ok := p.clients.eth.(interface{ reconnect() error })
+	if !ok {
+		return nil
+	}
+
+	p.log.Info("Reconnecting to ETH node")
+	return client.reconnect()
+}
+
+// supervise runs a goroutine of the pipeline and restarts it after
+// pipelineRestartDelay if it panics.
+func (p *pipeline) supervise(name string, run func(restarted bool)) {
+	for restarted := false; ; restarted = true {
+		if !p.runGuarded(name, func() { run(restarted) }) {
+			return
+		}
+		time.Sleep(pipelineRestartDelay)
+	}
+}
+
+// runGuarded runs fn and returns whether it panicked. The panic is logged with
+// its stack and counted.
+func (p *pipeline) runGuarded(name string, fn func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.log.Errorf("%s panicked: %v", name, r)
+			p.log.Error(string(debug.Stack()))
+			incrementMetric(p.name, "panics")
+			panicked = true
+		}
+	}()
+
+	fn()
+	return false
+}
+
+// work keeps maxConcurrency blocks in flight once the first head is known.
+// Workers that are in flight when work panics still complete, so a restarted
+// work only replaces the work it may have lost.
+func (p *pipeline) work(restarted bool) {
+	for latest, _ := p.heads(); latest == nil; latest, _ = p.heads() {
+		time.Sleep(headPollInterval)
+	}
+
+	workers := p.config.maxConcurrency
+	if restarted {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		findNextWork(p)
+	}
+
+	for {
+		<-p.workCompleteChan
+		findNextWork(p)
+	}
+}
+
+// subscribe follows new heads until the subscription fails.
+func (p *pipeline) subscribe() error {
+	ctx := context.Background()
+	ctx, cancelFn := context.WithTimeout(ctx, msToDuration(p.config.newBlockTimeoutMS))
+	defer cancelFn()
+
+	p.log.Info("Subscribing to new blocks")
+	ethChan := make(chan *types.Header)
+	sub, err := p.clients.eth.SubscribeNewHead(ctx, ethChan)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	for {
+		select {
+		case header := <-ethChan:
+			if p.config.confirmationPolicy != confirmationDepth {
+				p.updateFinalizedBlock()
+			}
+
+			p.lock.Lock()
+			p.latestBlock = header.Number
+			p.lock.Unlock()
+
+			p.log.Infof("Found new block: %s", header.Number)
+		case err := <-sub.Err():
+			return err
+		}
+	}
+}
+
+// updateFinalizedBlock polls the block of the confirmation policy's tag. On
+// failure the previous block is kept.
+func (p *pipeline) updateFinalizedBlock() {
+	ctx, cancelFn := context.WithTimeout(context.Background(), msToDuration(p.config.httpReqTimeoutMS))
+	defer cancelFn()
+
+	block, err := p.clients.eth.BlockNumberByTag(ctx, p.config.confirmationPolicy)
+	if err != nil {
+		p.log.Warnf("Failed to get the %s block", p.config.confirmationPolicy)
+		p.log.Warn(err)
+		return
+	}
+
+	p.lock.Lock()
+	p.finalizedBlock = block
+	p.lock.Unlock()
+}
+
+// heads returns the latest block and the block of the confirmation policy.
+// connectedClients returns the clients of the pipeline, or nil while it is
+// not connected yet.
+func (p *pipeline) connectedClients() *clients {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.clients
+}
+
+func (p *pipeline) heads() (*big.Int, *big.Int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.latestBlock, p.finalizedBlock
+}
+
+// nextAllowedBlock returns the highest block that may be processed, or nil if
+// no block may be processed yet.
+func (p *pipeline) nextAllowedBlock() *big.Int {
+	latestBlock, finalizedBlock := p.heads()
+	if p.config.confirmationPolicy != confirmationDepth {
+		return finalizedBlock
+	}
+
+	if latestBlock == nil {
+		return nil
+	}
+
+	return new(big.Int).Sub(latestBlock, big.NewInt(int64(p.config.minConfirmations)))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/prettymuchbryce/ingestr/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestNextAllowedBlockDepth(t *testing.T) {
+	p := createPipeline(testConf)
+	assert.Nil(t, p.nextAllowedBlock())
+
+	p.latestBlock = big.NewInt(100)
+	expected := 100 - int64(testConf.minConfirmations)
+	assert.Equal(t, expected, p.nextAllowedBlock().Int64())
+}
+
+func TestNextAllowedBlockFinalized(t *testing.T) {
+	conf := *testConf
+	conf.confirmationPolicy = confirmationFinalized
+
+	eth := &mocks.EthClient{}
+	eth.On("BlockNumberByTag", mock.Anything, "finalized").Return(big.NewInt(68), nil).Once()
+	eth.On("BlockNumberByTag", mock.Anything, "finalized").Return(nil, errors.New("unavailable")).Once()
+
+	p := createPipeline(&conf)
+	p.clients = &clients{eth: eth}
+	p.latestBlock = big.NewInt(100)
+	assert.Nil(t, p.nextAllowedBlock())
+
+	p.updateFinalizedBlock()
+	assert.Equal(t, int64(68), p.nextAllowedBlock().Int64())
+
+	// A failed poll keeps the previous finalized block
+	p.updateFinalizedBlock()
+	assert.Equal(t, int64(68), p.nextAllowedBlock().Int64())
+
+	eth.AssertExpectations(t)
+}
+
+func TestSupervise(t *testing.T) {
+	defer func(delay time.Duration) { pipelineRestartDelay = delay }(pipelineRestartDelay)
+	pipelineRestartDelay = 0
+
+	// A goroutine that panics is restarted until it returns
+	var runs []bool
+	p := createPipeline(testConf)
+	p.supervise("Test", func(restarted bool) {
+		runs = append(runs, restarted)
+		if len(runs) < 3 {
+			panic("failed")
+		}
+	})
+	assert.Equal(t, []bool{false, true, true}, runs)
+
+	var err error
+	panicked := p.runGuarded("Test", func() { err = errors.New("failed") })
+	assert.False(t, panicked)
+	assert.EqualError(t, err, "failed")
+}
+
+// testSubscription is a subscription to new heads that fails with the error
+// sent to err.
+type testSubscription struct {
+	err chan error
+}
+
+func (sub *testSubscription) Err() <-chan error {
+	return sub.err
+}
+
+func (sub *testSubscription) Unsubscribe() {}
+
+// testReconnectingEthClient counts how often it connects again.
+type testReconnectingEthClient struct {
+	*mocks.EthClient
+	reconnects int
+}
+
+func (client *testReconnectingEthClient) reconnect() error {
+	client.reconnects++
+	return nil
+}
+
+func TestSubscribe(t *testing.T) {
+	sub := &testSubscription{err: make(chan error)}
+	eth := &testReconnectingEthClient{EthClient: &mocks.EthClient{}}
+	eth.On("SubscribeNewHead", mock.Anything, mock.Anything).Return(sub, nil).Run(func(args mock.Arguments) {
+		heads := args.Get(1).(chan<- *types.Header)
+		go func() {
+			for i := int64(100); i <= 110; i++ {
+				heads <- &types.Header{Number: big.NewInt(i)}
+			}
+			sub.err <- errors.New("connection lost")
+		}()
+	})
+
+	p := createPipeline(testConf)
+	p.clients = &clients{eth: eth}
+
+	// Workers read the head while the subscription updates it
+	done := make(chan error)
+	go func() { done <- p.subscribe() }()
+	for {
+		next := p.nextAllowedBlock()
+		if next != nil && next.Int64() == 110-int64(testConf.minConfirmations) {
+			break
+		}
+	}
+	assert.EqualError(t, <-done, "connection lost")
+
+	// The node is connected again before subscribing again
+	assert.NoError(t, p.reconnect())
+	assert.Equal(t, 1, eth.reconnects)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"math/big"
 	"strconv"
 	"time"
@@ -12,14 +14,77 @@ type redisClient interface {
 	removeFromWorkingSet(blockNumber *big.Int) error
 	getStaleWorkingBlock() (*big.Int, error)
 	getNextWorkingBlock(nextAllowedBlock *big.Int) (*big.Int, error)
+	getWorkingBlocks() ([]*workingBlock, error)
+	getLastFinishedBlock() (*big.Int, error)
+	setLastFinishedBlock(blockNumber *big.Int) error
+	getExportCursor() (*big.Int, error)
+	setExportCursor(blockNumber *big.Int) error
+	getArchiveCursor() (*big.Int, error)
+	setArchiveCursor(blockNumber *big.Int) error
+	requeueBlocks(from *big.Int, to *big.Int) error
+	getRequeuedCount() (int64, error)
+	recordBlockFailure(blockNumber *big.Int) (int64, error)
+	getDeadLetters() ([]*big.Int, error)
+	isPaused() (bool, error)
+	setPaused(paused bool) error
+	getNetwork() (*network, error)
+	setNetwork(n *network) error
+	setBlockIndex(index string, blockNumber *big.Int, entries map[string][]byte) error
+	setIndexEntries(index string, blockNumber *big.Int, entries map[string][]byte) error
+	getIndexEntry(index string, key string) ([]byte, *big.Int, error)
+}
+
+// maxRequeueBlocks is the largest range of blocks that can be requeued at
+// once. Requeued blocks are held in a single set, so larger backfills are
+// requeued in several ranges as the pipeline catches up.
+const maxRequeueBlocks = 1000000
+
+// requeueBatchSize is how many requeued blocks are added to the set in one
+// request.
+const requeueBatchSize = 10000
+
+// deadLetterFailures is how often a block must fail in a row before it is a
+// dead letter. Dead letters are still retried, but they are listed by the
+// status command so that an operator can look into them. A block stops being
+// a dead letter once it has been processed.
+const deadLetterFailures = 5
+
+// checkRequeueRange returns an error if a range cannot be requeued.
+func checkRequeueRange(from *big.Int, to *big.Int) error {
+	if to.Cmp(from) < 0 {
+		return fmt.Errorf("to block %s is before from block %s", to, from)
+	}
+
+	count := new(big.Int).Sub(to, from)
+	if count.Add(count, big.NewInt(1)).Cmp(big.NewInt(maxRequeueBlocks)) > 0 {
+		return fmt.Errorf("cannot requeue %s blocks, at most %d blocks can be requeued at once", count, maxRequeueBlocks)
+	}
+
+	return nil
+}
+
+// workingBlock is a block that has been claimed by an ingestr instance but is
+// not finished yet.
+type workingBlock struct {
+	Number    *big.Int  `json:"number"`
+	ClaimedAt time.Time `json:"claimedAt"`
+	Owner     string    `json:"owner"`
 }
 
 type realRedisClient struct {
 	redis                *redis.Client
+	owner                string
 	workingBlockStart    *big.Int
 	workingTimeSetKey    string
 	workingBlockSetKey   string
+	workingOwnerKey      string
+	requeueBlockSetKey   string
 	lastFinishedBlockKey string
+	pausedKey            string
+	networkKey           string
+	indexKey             string
+	exportCursorKey      string
+	archiveCursorKey     string
 	ttlSeconds           int
 }
 
@@ -27,10 +92,18 @@ func createRealRedisClient(
 	address string,
 	password string,
 	db int,
+	owner string,
 	workingBlockStart *big.Int,
 	workingTimeSetKey string,
 	workingBlockSetKey string,
+	workingOwnerKey string,
+	requeueBlockSetKey string,
 	lastFinishedBlockKey string,
+	pausedKey string,
+	networkKey string,
+	indexKey string,
+	exportCursorKey string,
+	archiveCursorKey string,
 	ttlSeconds int,
 ) (*realRedisClient, error) {
 	client := redis.NewClient(&redis.Options{
@@ -40,15 +113,31 @@ func createRealRedisClient(
 	})
 
 	_, err := client.Ping().Result()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
 
 	return &realRedisClient{
 		client,
+		owner,
 		workingBlockStart,
 		workingTimeSetKey,
 		workingBlockSetKey,
+		workingOwnerKey,
+		requeueBlockSetKey,
 		lastFinishedBlockKey,
+		pausedKey,
+		networkKey,
+		indexKey,
+		exportCursorKey,
+		archiveCursorKey,
 		ttlSeconds,
-	}, err
+	}, nil
+}
+
+func (client *realRedisClient) close() error {
+	return client.redis.Close()
 }
 
 func (client *realRedisClient) getStaleWorkingBlock() (*big.Int, error) {
@@ -89,7 +178,11 @@ func (client *realRedisClient) getStaleWorkingBlock() (*big.Int, error) {
 		// Reset stale member TTL
 		if member != nil {
 			cmd := tx.ZAdd(client.workingTimeSetKey, member)
-			return cmd.Err()
+			if cmd.Err() != nil {
+				return cmd.Err()
+			}
+
+			return tx.HSet(client.workingOwnerKey, block.String(), client.owner).Err()
 		}
 
 		return nil
@@ -101,6 +194,34 @@ func (client *realRedisClient) getStaleWorkingBlock() (*big.Int, error) {
 func (client *realRedisClient) getNextWorkingBlock(nextAllowedBlock *big.Int) (*big.Int, error) {
 	var block *big.Int = big.NewInt(0)
 	watchErr := client.redis.Watch(func(tx *redis.Tx) error {
+		// Requeued blocks take priority over new blocks
+		requeueOptions := &redis.ZRangeBy{
+			Min:    "-inf",
+			Max:    nextAllowedBlock.String(),
+			Count:  1,
+			Offset: 0,
+		}
+
+		requeued, err := client.redis.ZRangeByScore(client.requeueBlockSetKey, requeueOptions).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+
+		if len(requeued) > 0 {
+			var ok bool
+			block, ok = new(big.Int).SetString(requeued[0], 10)
+			if !ok {
+				return fmt.Errorf("invalid requeued block: %s", requeued[0])
+			}
+
+			cmdRem := tx.ZRem(client.requeueBlockSetKey, requeued[0])
+			if cmdRem.Err() != nil {
+				return cmdRem.Err()
+			}
+
+			return client.claimBlock(tx, block)
+		}
+
 		options := &redis.ZRangeBy{
 			Min:    "-inf",
 			Max:    "inf",
@@ -157,30 +278,38 @@ func (client *realRedisClient) getNextWorkingBlock(nextAllowedBlock *big.Int) (*
 			return nil
 		}
 
-		// Add as redis member
-		member := &redis.Z{
-			Score:  float64(time.Now().Unix()),
-			Member: block.Int64(),
-		}
+		return client.claimBlock(tx, block)
+	}, client.workingTimeSetKey, client.requeueBlockSetKey)
 
-		cmd := tx.ZAdd(client.workingTimeSetKey, member)
+	return block, watchErr
+}
 
-		if cmd.Err() != nil {
-			return cmd.Err()
-		}
+func (client *realRedisClient) claimBlock(tx *redis.Tx, block *big.Int) error {
+	// Add as redis member
+	member := &redis.Z{
+		Score:  float64(time.Now().Unix()),
+		Member: block.Int64(),
+	}
 
-		// Add as redis member
-		member = &redis.Z{
-			Score:  float64(block.Int64()),
-			Member: block.Int64(),
-		}
+	cmd := tx.ZAdd(client.workingTimeSetKey, member)
 
-		cmd = tx.ZAdd(client.workingBlockSetKey, member)
+	if cmd.Err() != nil {
+		return cmd.Err()
+	}
+
+	// Add as redis member
+	member = &redis.Z{
+		Score:  float64(block.Int64()),
+		Member: block.Int64(),
+	}
 
+	cmd = tx.ZAdd(client.workingBlockSetKey, member)
+
+	if cmd.Err() != nil {
 		return cmd.Err()
-	}, client.workingTimeSetKey)
+	}
 
-	return block, watchErr
+	return tx.HSet(client.workingOwnerKey, block.String(), client.owner).Err()
 }
 
 func (client *realRedisClient) removeFromWorkingSet(blockNumber *big.Int) error {
@@ -222,8 +351,333 @@ func (client *realRedisClient) removeFromWorkingSet(blockNumber *big.Int) error
 			return cmdRem.Err()
 		}
 
+		cmdRem = tx.HDel(client.workingOwnerKey, blockNumber.String())
+		if cmdRem.Err() != nil {
+			return cmdRem.Err()
+		}
+
+		cmdRem = tx.HDel(client.failuresKey(), blockNumber.String())
+		if cmdRem.Err() != nil {
+			return cmdRem.Err()
+		}
+
+		cmdRem = tx.ZRem(client.deadLettersKey(), blockNumber.Int64())
+		if cmdRem.Err() != nil {
+			return cmdRem.Err()
+		}
+
 		return nil
 	}, client.lastFinishedBlockKey)
 
 	return watchErr
 }
+
+func (client *realRedisClient) getWorkingBlocks() ([]*workingBlock, error) {
+	members, err := client.redis.ZRangeWithScores(client.workingTimeSetKey, 0, -1).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	owners, err := client.redis.HGetAll(client.workingOwnerKey).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	var blocks []*workingBlock = make([]*workingBlock, 0)
+	for _, member := range members {
+		memberString := fmt.Sprint(member.Member)
+		number, ok := new(big.Int).SetString(memberString, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid working block: %s", memberString)
+		}
+
+		blocks = append(blocks, &workingBlock{
+			Number:    number,
+			ClaimedAt: time.Unix(int64(member.Score), 0),
+			Owner:     owners[memberString],
+		})
+	}
+
+	return blocks, nil
+}
+
+// getLastFinishedBlock returns nil if no block has been finished yet.
+func (client *realRedisClient) getLastFinishedBlock() (*big.Int, error) {
+	lastFinishedInt, err := client.redis.Get(client.lastFinishedBlockKey).Int64()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return big.NewInt(lastFinishedInt), nil
+}
+
+func (client *realRedisClient) setLastFinishedBlock(blockNumber *big.Int) error {
+	return client.redis.Set(client.lastFinishedBlockKey, blockNumber.Int64(), 0).Err()
+}
+
+// getExportCursor returns the first block that has not been exported yet, or
+// nil if nothing has been exported.
+func (client *realRedisClient) getExportCursor() (*big.Int, error) {
+	cursor, err := client.redis.Get(client.exportCursorKey).Int64()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return big.NewInt(cursor), nil
+}
+
+func (client *realRedisClient) setExportCursor(blockNumber *big.Int) error {
+	return client.redis.Set(client.exportCursorKey, blockNumber.Int64(), 0).Err()
+}
+
+// getArchiveCursor returns the first block that has not been archived yet, or
+// nil if nothing has been archived.
+func (client *realRedisClient) getArchiveCursor() (*big.Int, error) {
+	cursor, err := client.redis.Get(client.archiveCursorKey).Int64()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return big.NewInt(cursor), nil
+}
+
+func (client *realRedisClient) setArchiveCursor(blockNumber *big.Int) error {
+	return client.redis.Set(client.archiveCursorKey, blockNumber.Int64(), 0).Err()
+}
+
+func (client *realRedisClient) requeueBlocks(from *big.Int, to *big.Int) error {
+	err := checkRequeueRange(from, to)
+	if err != nil {
+		return err
+	}
+
+	var members []*redis.Z
+	for i := new(big.Int).Set(from); i.Cmp(to) <= 0; i.Add(i, big.NewInt(1)) {
+		members = append(members, &redis.Z{
+			Score:  float64(i.Int64()),
+			Member: i.Int64(),
+		})
+
+		if len(members) == requeueBatchSize || i.Cmp(to) == 0 {
+			err := client.redis.ZAdd(client.requeueBlockSetKey, members...).Err()
+			if err != nil {
+				return err
+			}
+			members = members[:0]
+		}
+	}
+
+	return nil
+}
+
+// getRequeuedCount returns how many requeued blocks have not been claimed yet.
+func (client *realRedisClient) getRequeuedCount() (int64, error) {
+	return client.redis.ZCard(client.requeueBlockSetKey).Result()
+}
+
+// failuresKey is a hash of how often every block that has not been processed
+// yet failed.
+func (client *realRedisClient) failuresKey() string {
+	return client.workingBlockSetKey + "_failures"
+}
+
+// deadLettersKey is a set of the blocks that failed at least
+// deadLetterFailures times.
+func (client *realRedisClient) deadLettersKey() string {
+	return client.workingBlockSetKey + "_dead"
+}
+
+// recordBlockFailure counts a failure of a block and returns how often it has
+// failed since it was last processed.
+func (client *realRedisClient) recordBlockFailure(blockNumber *big.Int) (int64, error) {
+	failures, err := client.redis.HIncrBy(client.failuresKey(), blockNumber.String(), 1).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	if failures >= deadLetterFailures {
+		err = client.redis.ZAdd(client.deadLettersKey(), &redis.Z{
+			Score:  float64(blockNumber.Int64()),
+			Member: blockNumber.Int64(),
+		}).Err()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return failures, nil
+}
+
+func (client *realRedisClient) getDeadLetters() ([]*big.Int, error) {
+	members, err := client.redis.ZRange(client.deadLettersKey(), 0, -1).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	var blocks []*big.Int = make([]*big.Int, 0)
+	for _, member := range members {
+		number, ok := new(big.Int).SetString(member, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid dead letter: %s", member)
+		}
+		blocks = append(blocks, number)
+	}
+
+	return blocks, nil
+}
+
+func (client *realRedisClient) isPaused() (bool, error) {
+	count, err := client.redis.Exists(client.pausedKey).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (client *realRedisClient) setPaused(paused bool) error {
+	if paused {
+		return client.redis.Set(client.pausedKey, 1, 0).Err()
+	}
+
+	return client.redis.Del(client.pausedKey).Err()
+}
+
+// getNetwork returns nil if no network has been recorded yet.
+func (client *realRedisClient) getNetwork() (*network, error) {
+	data, err := client.redis.Get(client.networkKey).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var n *network
+	err = json.Unmarshal(data, &n)
+	return n, err
+}
+
+func (client *realRedisClient) setNetwork(n *network) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	return client.redis.Set(client.networkKey, data, 0).Err()
+}
+
+// setBlockIndex replaces the entries that a block added to an index. Entries
+// are stored with the number of the block that added them, so that entries
+// which a later block has taken over are left alone. Every index is a hash of
+// entries and a hash of the keys that each block added.
+func (client *realRedisClient) setBlockIndex(index string, blockNumber *big.Int, entries map[string][]byte) error {
+	entriesKey := client.indexKey + "/" + index
+	blocksKey := entriesKey + "_blocks"
+
+	previous, err := client.redis.HGet(blocksKey, blockNumber.String()).Bytes()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	var previousKeys []string
+	if previous != nil {
+		err = json.Unmarshal(previous, &previousKeys)
+		if err != nil {
+			return err
+		}
+	}
+
+	var staleKeys []string
+	for _, key := range previousKeys {
+		if _, ok := entries[key]; ok {
+			continue
+		}
+
+		value, err := client.redis.HGet(entriesKey, key).Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if owner, _ := decodeIndexEntry(value); owner != nil && owner.Cmp(blockNumber) == 0 {
+			staleKeys = append(staleKeys, key)
+		}
+	}
+
+	keys := make([]string, 0, len(entries))
+	values := make(map[string]interface{})
+	for key, value := range entries {
+		keys = append(keys, key)
+		values[key] = encodeIndexEntry(blockNumber, value)
+	}
+
+	_, err = client.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		if len(staleKeys) > 0 {
+			pipe.HDel(entriesKey, staleKeys...)
+		}
+
+		if len(keys) == 0 {
+			pipe.HDel(blocksKey, blockNumber.String())
+			return nil
+		}
+
+		data, err := json.Marshal(keys)
+		if err != nil {
+			return err
+		}
+
+		pipe.HMSet(entriesKey, values)
+		pipe.HSet(blocksKey, blockNumber.String(), data)
+		return nil
+	})
+
+	return err
+}
+
+// setIndexEntries adds entries to an index without recording which keys the
+// block added, for indexes whose entries are checked against the block when
+// they are read. Entries are stored with the number of the block that added
+// them, like the entries of setBlockIndex.
+func (client *realRedisClient) setIndexEntries(index string, blockNumber *big.Int, entries map[string][]byte) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	values := make(map[string]interface{})
+	for key, value := range entries {
+		values[key] = encodeIndexEntry(blockNumber, value)
+	}
+
+	return client.redis.HMSet(client.indexKey+"/"+index, values).Err()
+}
+
+// getIndexEntry returns an index entry and the block that added it, or nil if
+// the index has no such entry.
+func (client *realRedisClient) getIndexEntry(index string, key string) ([]byte, *big.Int, error) {
+	value, err := client.redis.HGet(client.indexKey+"/"+index, key).Bytes()
+	if err == redis.Nil {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	blockNumber, entry := decodeIndexEntry(value)
+	if blockNumber == nil {
+		return nil, nil, fmt.Errorf("invalid %s index entry: %s", index, key)
+	}
+
+	return entry, blockNumber, nil
+}
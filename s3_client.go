@@ -2,105 +2,1439 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
 	"math/big"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 type s3Client interface {
-	GetBlock(blockNumber *big.Int) (string, error)
-	StoreBlock(blockNumber *big.Int, data string) error
+	GetBlock(blockNumber *big.Int) (string, string, error)
+	ReadBlock(blockNumber *big.Int) (io.ReadCloser, string, error)
+	WriteBlock(blockNumber *big.Int, format string, encode func(w io.Writer) error) error
+	DeleteBlock(blockNumber *big.Int, format string) error
+	OrphanBlock(blockNumber *big.Int, hash string, format string) error
+	MoveBlockAside(blockNumber *big.Int, name string) (int, error)
+	StoreArchive(from *big.Int, count int, format string, write func(blockNumber *big.Int, w io.Writer) error) error
+	ReencryptBlock(blockNumber *big.Int, objects []string) (int, error)
+	ReencryptArchive(from *big.Int) (bool, error)
+	GetBlockObject(name string, blockNumber *big.Int) (string, error)
+	StoreBlockObject(name string, blockNumber *big.Int, data string) error
+	GetNetwork() (string, error)
+	StoreNetwork(data string) error
+	StoreFile(name string, data string, contentType string) error
+}
+
+// networkKey is the key of the object that records the network of the blocks
+// in the bucket.
+const networkKey = "network.json"
+
+// reencryptAttempts is how often an object that is stored again while it is
+// reencrypted is examined again before reencrypt gives up.
+const reencryptAttempts = 3
+
+// Metadata entries of stored objects.
+const (
+	// formatMetadata records the format of a block.
+	formatMetadata = "Format"
+
+	// dictionaryMetadata records the ID of the zstd dictionary that an object
+	// was compressed with.
+	dictionaryMetadata = "Zstd-Dictionary"
+
+	// blockEncodingMetadata records how the blocks of an archive, or an
+	// encrypted object, are compressed. Neither has a Content-Encoding because
+	// its body is not compressed as a whole, and HTTP clients would try to
+	// decompress it.
+	blockEncodingMetadata = "Block-Encoding"
+
+	// checksumMetadata records the hex encoded SHA-256 of an uncompressed
+	// block.
+	checksumMetadata = "Sha256"
+
+	// encryptionMetadata records how an encrypted object is encrypted.
+	encryptionMetadata = "Encryption"
+
+	// encryptionKeyIDMetadata records the ID of the master key that wraps the
+	// data key of an encrypted object.
+	encryptionKeyIDMetadata = "Encryption-Key-Id"
+
+	// dataKeyMetadata records the base64 encoded wrapped data key of an
+	// encrypted object.
+	dataKeyMetadata = "Encryption-Data-Key"
+
+	// refetchMetadata marks an empty object that is stored in place of a block
+	// that must be fetched from the node again, because the block is also in
+	// an archive that cannot be changed.
+	refetchMetadata = "Refetch"
+)
+
+// errRefetchBlock is returned for a block that is marked to be fetched from
+// the node again. It is a missing key, so that readers fetch the block, but
+// the archive of the block is not read.
+var errRefetchBlock = awserr.New(s3.ErrCodeNoSuchKey, "block is marked to be fetched again", nil)
+
+// corruptBlockError is returned by GetBlock for a stored block that cannot be
+// decompressed or decoded, or that does not match its checksum or the
+// requested block number.
+type corruptBlockError struct {
+	blockNumber *big.Int
+	reason      string
+}
+
+func (err *corruptBlockError) Error() string {
+	return fmt.Sprintf("stored block %s is corrupt: %s", err.blockNumber, err.reason)
+}
+
+func blockChecksum(data string) []byte {
+	sum := sha256.Sum256([]byte(data))
+	return sum[:]
+}
+
+// archiveCacheSize is the number of archive indexes that are kept in memory.
+const archiveCacheSize = 64
+
+// archiveMissTTL is how long an archive that does not exist is remembered, so
+// that cache misses in a range that is not archived yet do not each look up
+// its archive.
+var archiveMissTTL = 5 * time.Minute
+
+// cachedArchive is the index of an archive and how its blocks are stored.
+type cachedArchive struct {
+	index        *archiveIndex
+	etag         string
+	format       string
+	encoding     string
+	dictionaryID uint32
+
+	// dataKey is the data key of an encrypted archive, or nil.
+	dataKey []byte
 }
 
 type realS3Client struct {
-	bucket  string
-	s3      *s3.S3
-	timeout time.Duration
-}
-
-func createRealS3Client(bucket string, timeout time.Duration) *realS3Client {
-	// All clients require a Session. The Session provides the client with
-	// shared configuration such as region, endpoint, and credentials. A
-	// Session should be shared where possible to take advantage of
-	// configuration and credential caching. See the session package for
-	// more information.
-	sess := session.Must(session.NewSession())
-
-	// Create a new instance of the service's client with a Session.
-	// Optional aws.Config values can also be provided as variadic arguments
-	// to the New function. This option allows you to provide service
-	// specific configuration.
-	svc := s3.New(sess)
-
-	// Create a context with a timeout that will abort the upload if it takes
-	// more than the passed in timeout.
+	bucket      string
+	prefix      string
+	chainID     *big.Int
+	blockFormat string
+	allFormats  bool
+	compressor  *compressor
+	encryptor   *encryptor
+	archiveSize int
+	s3          *s3.S3
+	uploader    *s3manager.Uploader
+	timeout     time.Duration
+
+	archiveLock     sync.Mutex
+	archives        map[string]*cachedArchive
+	missingArchives map[string]time.Time
+}
+
+// createRealS3Client creates an S3 client. If chainID is not nil it is stored
+// in the metadata of every block. Blocks are looked up in blockFormat first,
+// and ReadBlock looks them up in the other formats only if allFormats is set.
+// Objects are compressed with compression, using the zstd dictionary with
+// dictionaryID unless it is 0. Blocks are also looked up in archives of
+// archiveSize blocks unless it is 0. Objects are encrypted by encryptor if it
+// is enabled. The client connects as configured by awsConfig. Objects are
+// compressed into memory as they are encoded and stored with a single request.
+// Objects larger than the minimum part size are spilled to a temporary file
+// and uploaded in parts, one at a time.
+func createRealS3Client(
+	awsConfig awsClientConfig,
+	bucket string,
+	prefix string,
+	chainID *big.Int,
+	blockFormat string,
+	allFormats bool,
+	compression string,
+	gzipLevel int,
+	dictionaryID uint32,
+	encryptor *encryptor,
+	archiveSize int,
+	timeout time.Duration,
+) *realS3Client {
+	svc := s3.New(newAWSSession(awsConfig), awsConfig.serviceConfig())
+
+	client := &realS3Client{
+		bucket:          bucket,
+		prefix:          prefix,
+		chainID:         chainID,
+		blockFormat:     blockFormat,
+		allFormats:      allFormats,
+		encryptor:       encryptor,
+		archiveSize:     archiveSize,
+		s3:              svc,
+		timeout:         timeout,
+		archives:        make(map[string]*cachedArchive),
+		missingArchives: make(map[string]time.Time),
+	}
+	client.uploader = s3manager.NewUploaderWithClient(svc, func(uploader *s3manager.Uploader) {
+		uploader.PartSize = s3manager.MinUploadPartSize
+		uploader.Concurrency = 1
+	})
+	client.compressor = newCompressor(compression, gzipLevel, dictionaryID, client.getDictionary)
+
+	return client
+}
+
+// GetBlock returns a block and the format it is stored in, like ReadBlock, but
+// looks it up in every format. The block is decoded as it is read, and a block
+// that cannot be decoded or whose header is not the header of the requested
+// block is returned as a *corruptBlockError.
+func (client *realS3Client) GetBlock(blockNumber *big.Int) (string, string, error) {
+	reader, format, err := client.readBlock(blockNumber, true)
+	if err != nil {
+		return "", "", err
+	}
+
+	defer reader.Close()
+
+	var data strings.Builder
+	_, err = decodeStoredBlock(blockNumber, format, io.TeeReader(reader, &data))
+	if err != nil {
+		return "", "", err
+	}
+
+	return data.String(), format, nil
+}
+
+// decodeStoredBlock decodes a stored block as it is read from r, and reads r
+// to its end so that the checksum of the block is compared. Errors of reading
+// r are returned as they are, and a block that cannot be decoded or whose
+// header is not the header of the requested block is returned as a
+// *corruptBlockError.
+func decodeStoredBlock(blockNumber *big.Int, format string, r io.Reader) (*receiptsBlock, error) {
+	body := &objectBody{ReadCloser: ioutil.NopCloser(r)}
+	block, err := readBlock(body, format)
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, body)
+	}
+	if body.err != nil {
+		return nil, body.err
+	}
+	if err == nil {
+		err = checkBlockHeader(blockNumber, block)
+	}
+	if err != nil {
+		return nil, &corruptBlockError{blockNumber, err.Error()}
+	}
+
+	return block, nil
+}
+
+// ReadBlock returns a reader of a block and the format it is stored in. A
+// bucket may hold blocks in several formats and in archives, so the
+// configured format is tried first, then the archive of the block, then the
+// other formats if allFormats is set. Every format costs a request on a cache
+// miss, so the pipeline only reads other formats while a bucket is migrated.
+// The block is decompressed as it is read, and the reader returns a
+// *corruptBlockError if the block cannot be decompressed or does not match
+// its checksum. The reader must be closed.
+func (client *realS3Client) ReadBlock(blockNumber *big.Int) (io.ReadCloser, string, error) {
+	return client.readBlock(blockNumber, client.allFormats)
+}
+
+func (client *realS3Client) readBlock(blockNumber *big.Int, allFormats bool) (io.ReadCloser, string, error) {
+	reader, format, err := client.getBlockObject(blockNumber, client.blockFormat)
+	if err == errRefetchBlock || !isNoSuchKey(err) {
+		return reader, format, err
+	}
+
+	if client.archiveSize > 0 {
+		reader, format, err = client.getArchivedBlock(blockNumber)
+		if !isNoSuchKey(err) {
+			return reader, format, err
+		}
+	}
+
+	if !allFormats {
+		return nil, "", err
+	}
+
+	for _, other := range blockFormats {
+		if other == client.blockFormat {
+			continue
+		}
+
+		reader, format, err = client.getBlockObject(blockNumber, other)
+		if !isNoSuchKey(err) {
+			return reader, format, err
+		}
+	}
+
+	return nil, "", err
+}
+
+// getBlockObject returns a reader of a block that is stored in its own object
+// in the given format. Blocks stored before checksums were recorded are not
+// checked, and a block that is marked to be fetched again returns
+// errRefetchBlock.
+func (client *realS3Client) getBlockObject(blockNumber *big.Int, format string) (io.ReadCloser, string, error) {
+	result, cancelFn, err := client.openObject(client.blockKey(blockNumber, format))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if _, ok := result.Metadata[refetchMetadata]; ok {
+		result.Body.Close()
+		cancelFn()
+		return nil, "", errRefetchBlock
+	}
+
+	// Missing keys are not corrupt blocks, the block must not be replaced
+	dataKey, err := client.encryptor.objectDataKey(result.Metadata)
+	if err != nil {
+		result.Body.Close()
+		cancelFn()
+		return nil, "", err
+	}
+
+	body := &objectBody{ReadCloser: result.Body}
+	decompressed, err := client.objectReader(result, dataKey, body)
+	if err != nil {
+		body.Close()
+		cancelFn()
+		if body.err != nil {
+			return nil, "", body.err
+		}
+		return nil, "", &corruptBlockError{blockNumber, err.Error()}
+	}
+
+	if stored, ok := result.Metadata[formatMetadata]; ok && stored != nil {
+		format = *stored
+	}
+
+	reader := &blockReader{
+		blockNumber:  blockNumber,
+		body:         body,
+		decompressed: decompressed,
+		hash:         sha256.New(),
+		checksum:     aws.StringValue(result.Metadata[checksumMetadata]),
+		cancelFn:     cancelFn,
+	}
+	return reader, format, nil
+}
+
+// objectBody records the error of reading the body of an object, so that it
+// can be told apart from errors of decompressing the object.
+type objectBody struct {
+	io.ReadCloser
+	err error
+}
+
+func (body *objectBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		body.err = err
+	}
+	return n, err
+}
+
+// blockReader decrypts and decompresses a stored block and compares it with
+// its checksum once it has been read.
+type blockReader struct {
+	blockNumber  *big.Int
+	body         *objectBody
+	decompressed io.ReadCloser
+	hash         hash.Hash
+	checksum     string
+	cancelFn     context.CancelFunc
+
+	// archive is the key of the archive that the block is read from, or empty.
+	archive string
+}
+
+func (reader *blockReader) Read(p []byte) (int, error) {
+	n, err := reader.decompressed.Read(p)
+	reader.hash.Write(p[:n])
+
+	if err == io.EOF && reader.checksum != "" {
+		if sum := hex.EncodeToString(reader.hash.Sum(nil)); sum != reader.checksum {
+			if reader.archive != "" {
+				return n, &corruptBlockError{reader.blockNumber, fmt.Sprintf("checksum does not match archive %s", reader.archive)}
+			}
+			return n, &corruptBlockError{reader.blockNumber, fmt.Sprintf("checksum %s does not match %s", sum, reader.checksum)}
+		}
+	}
+	if err != nil && err != io.EOF && reader.body.err == nil {
+		return n, &corruptBlockError{reader.blockNumber, err.Error()}
+	}
+
+	return n, err
+}
+
+func (reader *blockReader) Close() error {
+	defer reader.cancelFn()
+
+	reader.decompressed.Close()
+	return reader.body.Close()
+}
+
+// WriteBlock stores a block that is written by encode, with its format and the
+// checksum of the uncompressed block. The block is encoded straight into the
+// compressor, and the checksum is computed as it is written.
+func (client *realS3Client) WriteBlock(blockNumber *big.Int, format string, encode func(w io.Writer) error) error {
+	checksum := sha256.New()
+	object, err := client.encodeObject(func(w io.Writer) error {
+		return encode(io.MultiWriter(w, checksum))
+	})
+	if err != nil {
+		return err
+	}
+
+	defer object.Close()
+
+	metadata := map[string]*string{
+		formatMetadata:   aws.String(format),
+		checksumMetadata: aws.String(hex.EncodeToString(checksum.Sum(nil))),
+	}
+	return client.storeObject(client.blockKey(blockNumber, format), metadata, object)
+}
+
+func (client *realS3Client) DeleteBlock(blockNumber *big.Int, format string) error {
 	ctx := context.Background()
-	if timeout > 0 {
-		ctx, _ = context.WithTimeout(ctx, timeout)
+	ctx, cancelFn := context.WithTimeout(ctx, client.timeout)
+	defer cancelFn()
+
+	input := &s3.DeleteObjectInput{
+		Bucket: &client.bucket,
+		Key:    aws.String(client.blockKey(blockNumber, format)),
 	}
 
-	return &realS3Client{
-		bucket:  bucket,
-		s3:      svc,
-		timeout: timeout,
+	_, err := client.s3.DeleteObjectWithContext(ctx, input)
+	return err
+}
+
+// OrphanBlock moves a block that is no longer canonical aside, to
+// orphans/<number>/<hash>, with a server-side copy that keeps its stored
+// bytes and metadata, and deletes its object. A block that is only in an
+// archive stays there until the range is archived again, but the block that is
+// stored in its place is read first.
+func (client *realS3Client) OrphanBlock(blockNumber *big.Int, hash string, format string) error {
+	_, err := client.moveObject(client.blockKey(blockNumber, format), client.orphanKey(blockNumber, hash, format))
+	return err
+}
+
+// MoveBlockAside moves the objects of a block in every format aside, to
+// orphans/<number>/<name>, so that the block is fetched from the node again
+// when it is processed. It returns how many objects were moved. Archives are
+// not rewritten, so a block that is in an archive is marked with an empty
+// object in its place that is read instead of the archive until the block is
+// stored again. If the block is only in the archive, it is copied aside too.
+func (client *realS3Client) MoveBlockAside(blockNumber *big.Int, name string) (int, error) {
+	moved := 0
+	for _, format := range blockFormats {
+		ok, err := client.moveObject(client.blockKey(blockNumber, format), client.orphanKey(blockNumber, name, format))
+		if err != nil {
+			return moved, err
+		}
+		if ok {
+			moved++
+		}
+	}
+
+	if client.archiveSize == 0 {
+		return moved, nil
+	}
+
+	reader, format, err := client.getArchivedBlock(blockNumber)
+	if isNoSuchKey(err) {
+		return moved, nil
+	}
+
+	if err == nil {
+		if moved == 0 {
+			metadata := map[string]*string{formatMetadata: aws.String(format)}
+			err = client.uploadObject(client.orphanKey(blockNumber, name, format), metadata, func(w io.Writer) error {
+				_, err := io.Copy(w, reader)
+				return err
+			})
+			if err == nil {
+				moved++
+			}
+		}
+		reader.Close()
+	}
+	if _, ok := err.(*corruptBlockError); err != nil && !ok {
+		return moved, err
 	}
+
+	err = client.putObject(client.blockKey(blockNumber, client.blockFormat), "", map[string]*string{
+		refetchMetadata: aws.String("true"),
+	})
+	return moved, err
 }
 
-func (client *realS3Client) GetBlock(blockNumber *big.Int) (string, error) {
+// moveObject copies an object to another key in the bucket, with its metadata,
+// and deletes it. It returns false if the object does not exist.
+func (client *realS3Client) moveObject(from string, to string) (bool, error) {
 	ctx := context.Background()
 	ctx, cancelFn := context.WithTimeout(ctx, client.timeout)
 	defer cancelFn()
-	blockNumberString := blockNumber.String()
+
+	input := &s3.CopyObjectInput{
+		Bucket:     &client.bucket,
+		Key:        &to,
+		CopySource: aws.String(url.PathEscape(client.bucket + "/" + from)),
+	}
+
+	_, err := client.s3.CopyObjectWithContext(ctx, input)
+	if err != nil {
+		if isNoSuchKey(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	_, err = client.s3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: &client.bucket,
+		Key:    &from,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// orphanKey is the key of a block that is no longer canonical, e.g.
+// orphans/8886217/0x8e38b4dbf6b11fcc3b9dee84fb7986e29ca0a02cecd8977c161ff7333329681e.rlp.
+func (client *realS3Client) orphanKey(blockNumber *big.Int, hash string, format string) string {
+	return client.prefix + "orphans/" + blockNumber.String() + "/" + hash + blockFormatExtension(format)
+}
+
+// blockKey is the key of a block, e.g. 8886217 for JSON or 8886217.rlp for
+// RLP.
+func (client *realS3Client) blockKey(blockNumber *big.Int, format string) string {
+	return client.prefix + blockNumber.String() + blockFormatExtension(format)
+}
+
+// GetBlockObject returns an object that is stored next to a block, such as its
+// traces, or an empty string if it does not exist.
+func (client *realS3Client) GetBlockObject(name string, blockNumber *big.Int) (string, error) {
+	data, err := client.getObject(client.blockObjectKey(name, blockNumber))
+	if err != nil {
+		if isNoSuchKey(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return data, nil
+}
+
+func (client *realS3Client) StoreBlockObject(name string, blockNumber *big.Int, data string) error {
+	return client.putObject(client.blockObjectKey(name, blockNumber), data, nil)
+}
+
+// blockObjectKey is the key of an object that is stored next to a block, e.g.
+// traces/8886217.
+func (client *realS3Client) blockObjectKey(name string, blockNumber *big.Int) string {
+	return client.prefix + name + "/" + blockNumber.String()
+}
+
+func (client *realS3Client) getObject(key string) (string, error) {
+	data, _, err := client.getObjectWithMetadata(key)
+	return data, err
+}
+
+func (client *realS3Client) getObjectWithMetadata(key string) (string, map[string]*string, error) {
+	result, cancelFn, err := client.openObject(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer cancelFn()
+	defer result.Body.Close()
+
+	dataKey, err := client.encryptor.objectDataKey(result.Metadata)
+	if err != nil {
+		return "", nil, err
+	}
+
+	reader, err := client.objectReader(result, dataKey, result.Body)
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return string(data), result.Metadata, nil
+}
+
+// openObject starts reading an object. The context of the request is canceled
+// by the returned function, which must be called once the body is closed.
+func (client *realS3Client) openObject(key string) (*s3.GetObjectOutput, context.CancelFunc, error) {
+	ctx := context.Background()
+	ctx, cancelFn := context.WithTimeout(ctx, client.timeout)
 
 	input := &s3.GetObjectInput{
 		Bucket: &client.bucket,
-		Key:    &blockNumberString,
+		Key:    &key,
 	}
 
 	result, err := client.s3.GetObjectWithContext(ctx, input)
 	if err != nil {
-		return "", err
+		cancelFn()
+		return nil, nil, err
 	}
 
-	gzipReader, err := gzip.NewReader(result.Body)
+	return result, cancelFn, nil
+}
+
+// objectReader decompresses the body of an object by its Content-Encoding. An
+// object with a data key is decrypted first and decompressed by its
+// Block-Encoding.
+func (client *realS3Client) objectReader(result *s3.GetObjectOutput, dataKey []byte, body io.Reader) (io.ReadCloser, error) {
+	dictionaryID, err := objectDictionaryID(result.Metadata)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	defer gzipReader.Close()
+	encoding := aws.StringValue(result.ContentEncoding)
+	if dataKey != nil {
+		body, err = decryptReader(body, dataKey, 0)
+		if err != nil {
+			return nil, err
+		}
+		encoding = aws.StringValue(result.Metadata[blockEncodingMetadata])
+	}
+
+	return client.compressor.reader(encoding, dictionaryID, body)
+}
 
-	// var buffer bytes.Buffer
-	data, err := ioutil.ReadAll(gzipReader)
+// putObject stores a compressed object with its Content-Encoding. The chain ID
+// is added to the metadata, and the data key if the object is encrypted.
+func (client *realS3Client) putObject(key string, data string, metadata map[string]*string, options ...request.Option) error {
+	return client.uploadObject(key, metadata, func(w io.Writer) error {
+		_, err := io.WriteString(w, data)
+		return err
+	}, options...)
+}
+
+// uploadObject stores an object that is written by encode, like putObject.
+func (client *realS3Client) uploadObject(key string, metadata map[string]*string, encode func(w io.Writer) error, options ...request.Option) error {
+	object, err := client.encodeObject(encode)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	return string(data), nil
+	defer object.Close()
+
+	return client.storeObject(key, metadata, object, options...)
+}
+
+// encodedObject is an object that has been compressed, and encrypted if
+// encryption is enabled, but not stored yet.
+type encodedObject struct {
+	spillBuffer
+
+	// encryption is the metadata of the data key of an encrypted object.
+	encryption map[string]*string
+}
+
+// encodeObject compresses and encrypts an object that is written by encode.
+// The encoded object is held in memory unless it is larger than a part. It
+// must be closed.
+func (client *realS3Client) encodeObject(encode func(w io.Writer) error) (*encodedObject, error) {
+	object := &encodedObject{spillBuffer: spillBuffer{limit: int(client.uploader.PartSize)}}
+
+	var dataKey []byte
+	if client.encryptor.enabled() {
+		var err error
+		dataKey, object.encryption, err = client.encryptor.newDataKey()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := client.writeObject(&object.spillBuffer, dataKey, encode)
+	if err != nil {
+		object.Close()
+		return nil, err
+	}
+
+	return object, nil
+}
+
+// storeObject stores an encoded object with its Content-Encoding, or with its
+// data key and Block-Encoding if it is encrypted.
+func (client *realS3Client) storeObject(key string, metadata map[string]*string, object *encodedObject, options ...request.Option) error {
+	metadata = client.objectMetadata(metadata)
+	contentEncoding := aws.String(client.compressor.contentEncoding())
+	var contentType *string
+	if object.encryption != nil {
+		for name, value := range object.encryption {
+			metadata[name] = value
+		}
+		metadata[blockEncodingMetadata] = contentEncoding
+		contentEncoding = nil
+		contentType = aws.String("application/octet-stream")
+	}
+
+	return client.sendObject(key, &object.spillBuffer, contentEncoding, contentType, metadata, options...)
 }
 
-func (client *realS3Client) StoreBlock(blockNumber *big.Int, data string) error {
+// sendObject stores the body of an object that has been written to a spill
+// buffer. Bodies that fit in a part are stored with a single request, larger
+// bodies are uploaded in parts from their temporary file. Objects stored with
+// request options, such as ifMatch, are always stored with a single request.
+func (client *realS3Client) sendObject(key string, buffer *spillBuffer, contentEncoding *string, contentType *string, metadata map[string]*string, options ...request.Option) error {
+	body, err := buffer.reader()
+	if err != nil {
+		return err
+	}
+
 	ctx := context.Background()
 	ctx, cancelFn := context.WithTimeout(ctx, client.timeout)
 	defer cancelFn()
 
-	blockNumberString := blockNumber.String()
+	if buffer.file == nil || len(options) > 0 {
+		input := &s3.PutObjectInput{
+			Bucket:          &client.bucket,
+			Key:             &key,
+			Body:            body,
+			ContentEncoding: contentEncoding,
+			ContentType:     contentType,
+			Metadata:        metadata,
+		}
+
+		_, err = client.s3.PutObjectWithContext(ctx, input, options...)
+		return err
+	}
 
-	var buffer bytes.Buffer
-	gzipWriter := gzip.NewWriter(&buffer)
-	gzipWriter.Write([]byte(data))
-	gzipWriter.Close()
+	input := &s3manager.UploadInput{
+		Bucket:          &client.bucket,
+		Key:             &key,
+		Body:            body,
+		ContentEncoding: contentEncoding,
+		ContentType:     contentType,
+		Metadata:        metadata,
+	}
 
-	input := &s3.PutObjectInput{
+	_, err = client.uploader.UploadWithContext(ctx, input)
+	return err
+}
+
+// spillBuffer holds data in memory until it grows larger than limit, and in a
+// temporary file after that. The uploader reads parts of a file in place, so
+// large objects are not copied into part buffers either.
+type spillBuffer struct {
+	limit  int
+	memory bytes.Buffer
+	file   *os.File
+}
+
+func (buffer *spillBuffer) Write(p []byte) (int, error) {
+	if buffer.file == nil && buffer.memory.Len()+len(p) > buffer.limit {
+		file, err := ioutil.TempFile("", "ingestr-upload")
+		if err != nil {
+			return 0, err
+		}
+
+		buffer.file = file
+		_, err = file.Write(buffer.memory.Bytes())
+		if err != nil {
+			return 0, err
+		}
+		buffer.memory = bytes.Buffer{}
+	}
+
+	if buffer.file != nil {
+		return buffer.file.Write(p)
+	}
+	return buffer.memory.Write(p)
+}
+
+// reader returns a reader of everything written to the buffer.
+func (buffer *spillBuffer) reader() (io.ReadSeeker, error) {
+	if buffer.file == nil {
+		return bytes.NewReader(buffer.memory.Bytes()), nil
+	}
+
+	_, err := buffer.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.file, nil
+}
+
+// Close removes the temporary file.
+func (buffer *spillBuffer) Close() error {
+	if buffer.file == nil {
+		return nil
+	}
+
+	buffer.file.Close()
+	return os.Remove(buffer.file.Name())
+}
+
+// newDataKey returns the data key of a new object and adds it to the metadata
+// of the object, or returns nil if objects are not encrypted.
+func (client *realS3Client) newDataKey(metadata map[string]*string) ([]byte, error) {
+	if !client.encryptor.enabled() {
+		return nil, nil
+	}
+
+	dataKey, encryption, err := client.encryptor.newDataKey()
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range encryption {
+		metadata[name] = value
+	}
+
+	return dataKey, nil
+}
+
+// writeObject compresses an object that is written by encode into w, and
+// encrypts it with dataKey unless it is nil.
+func (client *realS3Client) writeObject(w io.Writer, dataKey []byte, encode func(w io.Writer) error) error {
+	return client.writeStream(w, dataKey, 0, encode)
+}
+
+// writeStream compresses what encode writes into w, and encrypts it as the
+// given stream of the data key unless dataKey is nil.
+func (client *realS3Client) writeStream(w io.Writer, dataKey []byte, stream uint32, encode func(w io.Writer) error) error {
+	if dataKey != nil {
+		encrypted, err := encryptWriter(w, dataKey, stream)
+		if err != nil {
+			return err
+		}
+
+		err = client.writeStream(encrypted, nil, stream, encode)
+		if closeErr := encrypted.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+
+	compressed, err := client.compressor.writer(w)
+	if err != nil {
+		return err
+	}
+
+	err = encode(compressed)
+	if closeErr := compressed.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// objectMetadata adds the chain ID and the zstd dictionary to the metadata of
+// a compressed object.
+func (client *realS3Client) objectMetadata(metadata map[string]*string) map[string]*string {
+	if metadata == nil {
+		metadata = make(map[string]*string)
+	}
+	if client.chainID != nil {
+		metadata["Chain-Id"] = aws.String(client.chainID.String())
+	}
+	if client.compressor.algorithm == compressionZstd && client.compressor.dictionaryID != 0 {
+		metadata[dictionaryMetadata] = aws.String(strconv.FormatUint(uint64(client.compressor.dictionaryID), 10))
+	}
+
+	return metadata
+}
+
+// objectDictionaryID returns the ID of the zstd dictionary that an object was
+// compressed with, or 0 if it was compressed without one.
+func objectDictionaryID(metadata map[string]*string) (uint32, error) {
+	id, ok := metadata[dictionaryMetadata]
+	if !ok || id == nil {
+		return 0, nil
+	}
+
+	dictionaryID, err := strconv.ParseUint(*id, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid zstd dictionary ID %q", *id)
+	}
+
+	return uint32(dictionaryID), nil
+}
+
+// StoreArchive stores a range of count blocks, starting at the from block, in
+// a single archive. Every block is written to the archive by write as it is
+// read, and compressed on its own so that it can be read with a range request.
+// The index records the checksum of every block. The archive is held in memory
+// unless it is larger than a part, and only its index is kept until it is
+// stored. The blocks of an encrypted archive share a data key, and every block
+// is encrypted as its own stream.
+func (client *realS3Client) StoreArchive(from *big.Int, count int, format string, write func(blockNumber *big.Int, w io.Writer) error) error {
+	return client.storeArchive(from, count, format, write)
+}
+
+func (client *realS3Client) storeArchive(from *big.Int, count int, format string, write func(blockNumber *big.Int, w io.Writer) error, options ...request.Option) error {
+	metadata := map[string]*string{
+		formatMetadata:        aws.String(format),
+		blockEncodingMetadata: aws.String(client.compressor.contentEncoding()),
+	}
+	metadata = client.objectMetadata(metadata)
+	dataKey, err := client.newDataKey(metadata)
+	if err != nil {
+		return err
+	}
+
+	buffer := &spillBuffer{limit: int(client.uploader.PartSize)}
+	defer buffer.Close()
+
+	archive := newArchiveWriter(buffer, from.Uint64())
+	for i := 0; i < count; i++ {
+		blockNumber := new(big.Int).Add(from, big.NewInt(int64(i)))
+		err = archive.writeBlock(func(w io.Writer) ([]byte, error) {
+			checksum := sha256.New()
+			err := client.writeStream(w, dataKey, uint32(i), func(w io.Writer) error {
+				return write(blockNumber, io.MultiWriter(w, checksum))
+			})
+			return checksum.Sum(nil), err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = archive.close()
+	if err != nil {
+		return err
+	}
+
+	to := new(big.Int).Add(from, big.NewInt(int64(count-1)))
+	key := client.prefix + archiveKey(from, to)
+	err = client.sendObject(key, buffer, nil, aws.String("application/octet-stream"), metadata, options...)
+	client.forgetArchive(key)
+	return err
+}
+
+// getArchivedBlock returns a reader of a block in its archive, which reads the
+// block with a range request. The index of the archive is cached, and range
+// requests only match the version of the archive that the index was read from,
+// so the index is read again if the archive was replaced. The block is
+// decrypted and decompressed as it is read, and the reader returns a
+// *corruptBlockError if the block does not match its checksum in the index.
+// The reader must be closed.
+func (client *realS3Client) getArchivedBlock(blockNumber *big.Int) (io.ReadCloser, string, error) {
+	from := archiveStart(blockNumber, client.archiveSize)
+	to := new(big.Int).Add(from, big.NewInt(int64(client.archiveSize-1)))
+	key := client.prefix + archiveKey(from, to)
+
+	for attempt := 0; ; attempt++ {
+		archive, err := client.getArchive(key)
+		if err != nil {
+			return nil, "", err
+		}
+
+		offset, length, checksum, ok := archive.index.locate(blockNumber.Uint64())
+		if !ok {
+			return nil, "", awserr.New(s3.ErrCodeNoSuchKey, fmt.Sprintf("block %s is not in %s", blockNumber, key), nil)
+		}
+
+		body := &objectBody{ReadCloser: ioutil.NopCloser(bytes.NewReader(nil))}
+		cancelFn := context.CancelFunc(func() {})
+		if length > 0 {
+			var result *s3.GetObjectOutput
+			result, cancelFn, err = client.openRange(key, fmt.Sprintf("bytes=%d-%d", offset, offset+uint64(length)-1), archive.etag)
+			if isPreconditionFailed(err) && attempt == 0 {
+				client.forgetArchive(key)
+				continue
+			}
+			if err != nil {
+				return nil, "", err
+			}
+			body.ReadCloser = result.Body
+		}
+
+		var compressed io.Reader = body
+		if archive.dataKey != nil {
+			stream := uint32(blockNumber.Uint64() - archive.index.start)
+			compressed, err = decryptReader(compressed, archive.dataKey, stream)
+		}
+
+		var decompressed io.ReadCloser
+		if err == nil {
+			decompressed, err = client.compressor.reader(archive.encoding, archive.dictionaryID, compressed)
+		}
+		if err != nil {
+			body.Close()
+			cancelFn()
+			if body.err != nil {
+				return nil, "", body.err
+			}
+			return nil, "", &corruptBlockError{blockNumber, err.Error()}
+		}
+
+		reader := &blockReader{
+			blockNumber:  blockNumber,
+			body:         body,
+			decompressed: decompressed,
+			hash:         sha256.New(),
+			checksum:     hex.EncodeToString(checksum),
+			archive:      key,
+			cancelFn:     cancelFn,
+		}
+		return reader, archive.format, nil
+	}
+}
+
+// getArchive returns the index of an archive. The index and the trailer are
+// read with a single range request for the largest index that an archive of
+// archiveSize blocks can have. An archive that does not exist is not looked up
+// again for archiveMissTTL, unless it is stored by this client.
+func (client *realS3Client) getArchive(key string) (*cachedArchive, error) {
+	client.archiveLock.Lock()
+	archive, ok := client.archives[key]
+	missing, isMissing := client.missingArchives[key]
+	client.archiveLock.Unlock()
+	if ok {
+		return archive, nil
+	}
+	if isMissing && time.Since(missing) < archiveMissTTL {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, fmt.Sprintf("archive %s does not exist", key), nil)
+	}
+
+	suffix := client.archiveSize*archiveIndexEntrySize + archiveTrailerSize
+	data, result, err := client.getRange(key, fmt.Sprintf("bytes=-%d", suffix), "")
+	if isNoSuchKey(err) {
+		client.archiveLock.Lock()
+		if len(client.missingArchives) >= archiveCacheSize {
+			for cached := range client.missingArchives {
+				delete(client.missingArchives, cached)
+				break
+			}
+		}
+		client.missingArchives[key] = time.Now()
+		client.archiveLock.Unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := parseArchiveIndex(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", key, err)
+	}
+
+	dictionaryID, err := objectDictionaryID(result.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := client.encryptor.objectDataKey(result.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", key, err)
+	}
+
+	archive = &cachedArchive{
+		index:        index,
+		etag:         aws.StringValue(result.ETag),
+		format:       aws.StringValue(result.Metadata[formatMetadata]),
+		encoding:     aws.StringValue(result.Metadata[blockEncodingMetadata]),
+		dictionaryID: dictionaryID,
+		dataKey:      dataKey,
+	}
+
+	client.archiveLock.Lock()
+	defer client.archiveLock.Unlock()
+	if len(client.archives) >= archiveCacheSize {
+		for cached := range client.archives {
+			delete(client.archives, cached)
+			break
+		}
+	}
+	client.archives[key] = archive
+
+	return archive, nil
+}
+
+func (client *realS3Client) forgetArchive(key string) {
+	client.archiveLock.Lock()
+	defer client.archiveLock.Unlock()
+
+	delete(client.archives, key)
+	delete(client.missingArchives, key)
+}
+
+// getRange reads a range of an object. If etag is not empty the object must
+// still have that ETag.
+func (client *realS3Client) getRange(key string, byteRange string, etag string) ([]byte, *s3.GetObjectOutput, error) {
+	result, cancelFn, err := client.openRange(key, byteRange, etag)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer cancelFn()
+	defer result.Body.Close()
+
+	data, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, result, nil
+}
+
+// openRange starts reading a range of an object, or the whole object if
+// byteRange is empty, like openObject. If etag is not empty the object must
+// still have that ETag.
+func (client *realS3Client) openRange(key string, byteRange string, etag string) (*s3.GetObjectOutput, context.CancelFunc, error) {
+	ctx := context.Background()
+	ctx, cancelFn := context.WithTimeout(ctx, client.timeout)
+
+	input := &s3.GetObjectInput{
+		Bucket: &client.bucket,
+		Key:    &key,
+	}
+	if byteRange != "" {
+		input.Range = &byteRange
+	}
+	if etag != "" {
+		input.IfMatch = &etag
+	}
+
+	result, err := client.s3.GetObjectWithContext(ctx, input)
+	if err != nil {
+		cancelFn()
+		return nil, nil, err
+	}
+
+	return result, cancelFn, nil
+}
+
+// ReencryptBlock moves a block in every format and the named objects that are
+// stored next to it, such as its traces, to the current master key. It returns
+// the number of objects that were changed.
+func (client *realS3Client) ReencryptBlock(blockNumber *big.Int, objects []string) (int, error) {
+	var keys []string
+	for _, format := range blockFormats {
+		keys = append(keys, client.blockKey(blockNumber, format))
+	}
+	for _, name := range objects {
+		keys = append(keys, client.blockObjectKey(name, blockNumber))
+	}
+
+	changed := 0
+	for _, key := range keys {
+		key := key
+		ok, err := client.reencryptObject(key, func(etag *string) error {
+			data, metadata, err := client.getObjectWithMetadata(key)
+			if err != nil {
+				return err
+			}
+
+			// The object is compressed again with the configured compressor
+			delete(metadata, dictionaryMetadata)
+			return client.putObject(key, data, metadata, ifMatch(etag))
+		})
+		if err != nil {
+			return changed, fmt.Errorf("%s: %s", key, err)
+		}
+		if ok {
+			changed++
+		}
+	}
+
+	return changed, nil
+}
+
+// ReencryptArchive moves the archive that starts at the from block to the
+// current master key. It returns false if the archive does not exist or
+// already uses the current master key.
+func (client *realS3Client) ReencryptArchive(from *big.Int) (bool, error) {
+	to := new(big.Int).Add(from, big.NewInt(int64(client.archiveSize-1)))
+	key := client.prefix + archiveKey(from, to)
+
+	ok, err := client.reencryptObject(key, func(etag *string) error {
+		return client.rewriteArchive(key, from, etag)
+	})
+	if err != nil {
+		return false, fmt.Errorf("%s: %s", key, err)
+	}
+
+	client.forgetArchive(key)
+	return ok, nil
+}
+
+// reencryptObject moves an object to the current master key. The data key of
+// an encrypted object is wrapped again and the object is copied onto itself
+// with the new metadata, so it is not read. An object that is not encrypted is
+// stored again by rewrite, on the condition that it still has the given ETag.
+// It returns false if the object does not exist or already uses the current
+// master key.
+//
+// Both the copy and the rewrite only replace the version of the object that
+// was examined, so an object that the pipeline stores again meanwhile is not
+// overwritten. It is examined again instead.
+func (client *realS3Client) reencryptObject(key string, rewrite func(etag *string) error) (bool, error) {
+	for attempt := 1; ; attempt++ {
+		ok, err := client.reencryptObjectVersion(key, rewrite)
+		if !isPreconditionFailed(err) || attempt == reencryptAttempts {
+			return ok, err
+		}
+	}
+}
+
+func (client *realS3Client) reencryptObjectVersion(key string, rewrite func(etag *string) error) (bool, error) {
+	ctx := context.Background()
+	ctx, cancelFn := context.WithTimeout(ctx, client.timeout)
+	defer cancelFn()
+
+	head, err := client.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 		Bucket: &client.bucket,
-		Key:    &blockNumberString,
-		Body:   bytes.NewReader(buffer.Bytes()),
+		Key:    &key,
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if aws.StringValue(head.Metadata[encryptionMetadata]) == "" {
+		return true, rewrite(head.ETag)
+	}
+
+	metadata, err := client.encryptor.rewrapMetadata(head.Metadata)
+	if err != nil || metadata == nil {
+		return false, err
+	}
+
+	input := &s3.CopyObjectInput{
+		Bucket:            &client.bucket,
+		Key:               &key,
+		CopySource:        aws.String(url.PathEscape(client.bucket + "/" + key)),
+		CopySourceIfMatch: head.ETag,
+		ContentEncoding:   head.ContentEncoding,
+		ContentType:       head.ContentType,
+		Metadata:          metadata,
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+	}
+
+	_, err = client.s3.CopyObjectWithContext(ctx, input)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// rewriteArchive stores an archive that is not encrypted again, with the
+// blocks that are read from the version of the archive with the given ETag.
+// The archive is read as it is written, and only replaced if it still has
+// that ETag.
+func (client *realS3Client) rewriteArchive(key string, from *big.Int, etag *string) error {
+	suffix := client.archiveSize*archiveIndexEntrySize + archiveTrailerSize
+	data, result, err := client.getRange(key, fmt.Sprintf("bytes=-%d", suffix), aws.StringValue(etag))
+	if err != nil {
+		return err
+	}
+
+	index, err := parseArchiveIndex(data)
+	if err != nil {
+		return err
+	}
+
+	dictionaryID, err := objectDictionaryID(result.Metadata)
+	if err != nil {
+		return err
+	}
+
+	result, cancelFn, err := client.openRange(key, "", aws.StringValue(etag))
+	if err != nil {
+		return err
+	}
+
+	defer cancelFn()
+	defer result.Body.Close()
+
+	encoding := aws.StringValue(result.Metadata[blockEncodingMetadata])
+	position := uint64(0)
+	return client.storeArchive(from, len(index.offsets), aws.StringValue(result.Metadata[formatMetadata]), func(blockNumber *big.Int, w io.Writer) error {
+		i := blockNumber.Uint64() - index.start
+		_, err := io.CopyN(ioutil.Discard, result.Body, int64(index.offsets[i]-position))
+		if err != nil {
+			return err
+		}
+
+		compressed := io.LimitReader(result.Body, int64(index.lengths[i]))
+		position = index.offsets[i] + uint64(index.lengths[i])
+		block, err := client.compressor.reader(encoding, dictionaryID, compressed)
+		if err != nil {
+			return fmt.Errorf("block %s: %s", blockNumber, err)
+		}
+
+		checksum := sha256.New()
+		_, err = io.Copy(io.MultiWriter(w, checksum), block)
+		block.Close()
+		if err != nil {
+			return fmt.Errorf("block %s: %s", blockNumber, err)
+		}
+
+		if !bytes.Equal(checksum.Sum(nil), index.checksums[i]) {
+			return fmt.Errorf("block %s does not match its checksum", blockNumber)
+		}
+
+		// Decompressors may stop before the end of the compressed block
+		_, err = io.Copy(ioutil.Discard, compressed)
+		return err
+	}, ifMatch(etag))
+}
+
+// getRawObject reads an object as it is stored.
+func (client *realS3Client) getRawObject(key string) ([]byte, map[string]*string, error) {
+	result, cancelFn, err := client.openObject(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer cancelFn()
+	defer result.Body.Close()
+
+	data, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, result.Metadata, nil
+}
+
+// isNotFound returns whether a request failed because the object does not
+// exist. HEAD requests have no body, so their error is NotFound instead of
+// NoSuchKey.
+func isNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound")
+}
+
+// isPreconditionFailed returns whether a conditional request failed because
+// the object was replaced.
+func isPreconditionFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == "PreconditionFailed"
+}
+
+// ifMatch makes a PUT request conditional on the ETag of the object that it
+// replaces. PutObjectInput has no field for the header.
+func ifMatch(etag *string) request.Option {
+	return func(r *request.Request) {
+		r.HTTPRequest.Header.Set("If-Match", aws.StringValue(etag))
+	}
+}
+
+// isNoSuchKey returns whether an S3 request failed because the object does not
+// exist.
+func isNoSuchKey(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == s3.ErrCodeNoSuchKey
+}
+
+// dictionaryKey is the key of a zstd dictionary, e.g.
+// dictionaries/1604072071.zdict.
+func dictionaryKey(id uint32) string {
+	return fmt.Sprintf("dictionaries/%d.zdict", id)
+}
+
+// getDictionary reads a zstd dictionary that was stored with StoreFile.
+func (client *realS3Client) getDictionary(id uint32) ([]byte, error) {
+	return client.getFile(client.prefix + dictionaryKey(id))
+}
+
+// GetNetwork returns an empty string if no network has been stored yet.
+func (client *realS3Client) GetNetwork() (string, error) {
+	data, err := client.getFile(client.prefix + networkKey)
+	if err != nil {
+		if isNoSuchKey(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func (client *realS3Client) StoreNetwork(data string) error {
+	return client.putFile(client.prefix+networkKey, data, "application/json", nil)
+}
+
+// StoreFile stores an uncompressed file, such as an exported table, under the
+// key prefix.
+func (client *realS3Client) StoreFile(name string, data string, contentType string) error {
+	var metadata map[string]*string
+	if client.chainID != nil {
+		metadata = map[string]*string{
+			"Chain-Id": aws.String(client.chainID.String()),
+		}
+	}
+
+	return client.putFile(client.prefix+name, data, contentType, metadata)
+}
+
+// putFile stores an uncompressed file. If encryption is enabled the file is
+// encrypted with a data key of its own, like blocks are.
+func (client *realS3Client) putFile(key string, data string, contentType string, metadata map[string]*string) error {
+	body := []byte(data)
+	if client.encryptor.enabled() {
+		if metadata == nil {
+			metadata = make(map[string]*string)
+		}
+		dataKey, err := client.newDataKey(metadata)
+		if err != nil {
+			return err
+		}
+		body, err = encryptBytes(dataKey, 0, body)
+		if err != nil {
+			return err
+		}
+		contentType = "application/octet-stream"
+	}
+
+	ctx := context.Background()
+	ctx, cancelFn := context.WithTimeout(ctx, client.timeout)
+	defer cancelFn()
+
+	input := &s3.PutObjectInput{
+		Bucket:      &client.bucket,
+		Key:         &key,
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+		Metadata:    metadata,
 	}
 
 	_, err := client.s3.PutObjectWithContext(ctx, input)
 	return err
 }
+
+// getFile reads a file that was stored with putFile, and decrypts it if it is
+// encrypted.
+func (client *realS3Client) getFile(key string) ([]byte, error) {
+	data, metadata, err := client.getRawObject(key)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := client.encryptor.objectDataKey(metadata)
+	if err != nil || dataKey == nil {
+		return data, err
+	}
+
+	return decryptBytes(dataKey, 0, data)
+}
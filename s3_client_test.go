@@ -0,0 +1,701 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/stretchr/testify/assert"
+)
+
+// testS3Object is an object stored by a testS3Server.
+type testS3Object struct {
+	body   []byte
+	header http.Header
+	etag   string
+}
+
+// testS3Server is an S3 compatible server that keeps objects in memory. It
+// serves the requests that realS3Client makes: single and multipart uploads,
+// copies, ranges and conditions on ETags.
+type testS3Server struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	objects  map[string]*testS3Object
+	uploads  map[string]map[int][]byte
+	headers  map[string]http.Header
+	versions int
+	requests map[string]int
+
+	// intercept is called with every request before it is served, with the
+	// server locked.
+	intercept func(r *http.Request)
+}
+
+func newTestS3Server() *testS3Server {
+	server := &testS3Server{
+		objects:  make(map[string]*testS3Object),
+		uploads:  make(map[string]map[int][]byte),
+		headers:  make(map[string]http.Header),
+		requests: make(map[string]int),
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.serve))
+	return server
+}
+
+// client creates a client of the bucket "blocks" on the server.
+func (server *testS3Server) client(compression string, encryptor *encryptor, archiveSize int) *realS3Client {
+	conf := awsClientConfig{
+		endpoint:        server.URL,
+		forcePathStyle:  true,
+		region:          "eu-west-1",
+		accessKeyID:     "key",
+		secretAccessKey: "secret",
+	}
+	return createRealS3Client(conf, "blocks", "", nil, blockFormatJSON, false, compression, 6, 0, encryptor, archiveSize, 10*time.Second)
+}
+
+// object returns a stored object by its key in the bucket.
+func (server *testS3Server) object(key string) *testS3Object {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	return server.objects["/blocks/"+key]
+}
+
+func (server *testS3Server) count(request string) int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	return server.requests[request]
+}
+
+func (server *testS3Server) serve(w http.ResponseWriter, r *http.Request) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if server.intercept != nil {
+		server.intercept(r)
+	}
+
+	key := r.URL.Path
+	query := r.URL.Query()
+	_, initiate := query["uploads"]
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case r.Method == http.MethodPost && initiate:
+		server.requests["CreateMultipartUpload"]++
+		uploadID = strconv.Itoa(len(server.uploads) + 1)
+		server.uploads[uploadID] = make(map[int][]byte)
+		server.headers[uploadID] = r.Header.Clone()
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, uploadID)
+	case r.Method == http.MethodPut && uploadID != "":
+		server.requests["UploadPart"]++
+		part, _ := strconv.Atoi(query.Get("partNumber"))
+		server.uploads[uploadID][part], _ = ioutil.ReadAll(r.Body)
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, part))
+	case r.Method == http.MethodPost && uploadID != "":
+		server.requests["CompleteMultipartUpload"]++
+		var parts []int
+		for part := range server.uploads[uploadID] {
+			parts = append(parts, part)
+		}
+		sort.Ints(parts)
+		var body []byte
+		for _, part := range parts {
+			body = append(body, server.uploads[uploadID][part]...)
+		}
+		object := server.store(key, body, server.headers[uploadID])
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><ETag>%s</ETag></CompleteMultipartUploadResult>`, object.etag)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		server.requests["CopyObject"]++
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		object, ok := server.objects["/"+source]
+		if !ok {
+			server.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if etag := r.Header.Get("X-Amz-Copy-Source-If-Match"); etag != "" && etag != object.etag {
+			server.fail(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		header := object.header
+		if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			header = r.Header
+		}
+		object = server.store(key, object.body, header)
+		fmt.Fprintf(w, `<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>`, object.etag)
+	case r.Method == http.MethodPut:
+		server.requests["PutObject"]++
+		if !server.matches(w, r, key) {
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		object := server.store(key, body, r.Header)
+		w.Header().Set("ETag", object.etag)
+	case r.Method == http.MethodDelete:
+		server.requests["DeleteObject"]++
+		delete(server.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodHead:
+		server.requests["HeadObject"]++
+		object, ok := server.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		server.writeHeader(w, object)
+	case r.Method == http.MethodGet:
+		server.requests["GetObject"]++
+		object, ok := server.objects[key]
+		if !ok {
+			server.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if !server.matches(w, r, key) {
+			return
+		}
+		server.writeHeader(w, object)
+
+		body := object.body
+		if byteRange := strings.TrimPrefix(r.Header.Get("Range"), "bytes="); byteRange != "" {
+			bounds := strings.Split(byteRange, "-")
+			if bounds[0] == "" {
+				suffix, _ := strconv.Atoi(bounds[1])
+				if suffix < len(body) {
+					body = body[len(body)-suffix:]
+				}
+			} else {
+				start, _ := strconv.Atoi(bounds[0])
+				end, _ := strconv.Atoi(bounds[1])
+				body = body[start : end+1]
+			}
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		w.Write(body)
+	}
+}
+
+// matches checks the If-Match condition of a request on the current object.
+func (server *testS3Server) matches(w http.ResponseWriter, r *http.Request, key string) bool {
+	etag := r.Header.Get("If-Match")
+	if etag == "" {
+		return true
+	}
+
+	object, ok := server.objects[key]
+	if !ok || object.etag != etag {
+		server.fail(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return false
+	}
+	return true
+}
+
+func (server *testS3Server) store(key string, body []byte, header http.Header) *testS3Object {
+	server.versions++
+	object := &testS3Object{
+		body:   body,
+		header: header.Clone(),
+		etag:   fmt.Sprintf(`"%d"`, server.versions),
+	}
+	server.objects[key] = object
+	return object
+}
+
+func (server *testS3Server) writeHeader(w http.ResponseWriter, object *testS3Object) {
+	for name, values := range object.header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") || name == "Content-Encoding" || name == "Content-Type" {
+			w.Header()[name] = values
+		}
+	}
+	w.Header().Set("ETag", object.etag)
+}
+
+func (server *testS3Server) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+// testS3Client returns a client of a new testS3Server. The server is closed
+// when the test ends.
+func testS3Client(tb testing.TB, compression string, encryptor *encryptor, archiveSize int) (*realS3Client, *testS3Server) {
+	server := newTestS3Server()
+	tb.Cleanup(server.Close)
+
+	return server.client(compression, encryptor, archiveSize), server
+}
+
+func TestUploadObject(t *testing.T) {
+	client, server := testS3Client(t, compressionGzip, newEncryptor("", nil), 0)
+
+	// Blocks that fit in a part are stored with a single request
+	block := testCodecBlock(t)
+	blockNumber := block.Header.Number
+	err := client.WriteBlock(blockNumber, blockFormatJSON, func(w io.Writer) error {
+		return writeBlock(w, blockFormatJSON, block)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, server.count("PutObject"))
+	assert.Equal(t, 0, server.count("CreateMultipartUpload"))
+
+	object := server.object(client.blockKey(blockNumber, blockFormatJSON))
+	assert.Equal(t, compressionGzip, object.header.Get("Content-Encoding"))
+	assert.NotEmpty(t, object.header.Get("X-Amz-Meta-Sha256"))
+
+	stored, format, err := readCachedBlock(blockNumber, client)
+	assert.NoError(t, err)
+	assert.Equal(t, blockFormatJSON, format)
+	assert.Equal(t, block.Hash, stored.Hash)
+
+	// Larger objects are uploaded in parts from a temporary file
+	data := make([]byte, 2*s3manager.MinUploadPartSize+100)
+	rand.Read(data)
+	err = client.uploadObject("large", nil, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, server.count("PutObject"))
+	assert.Equal(t, 1, server.count("CreateMultipartUpload"))
+	assert.Equal(t, 3, server.count("UploadPart"))
+
+	large, err := client.getObject("large")
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, []byte(large)))
+}
+
+func TestStoreLargeArchive(t *testing.T) {
+	client, server := testS3Client(t, compressionGzip, newEncryptor("", nil), 4)
+
+	// Archives larger than a part are written to a temporary file as their
+	// blocks are read, and uploaded in parts
+	from := big.NewInt(8816000)
+	blocks := make([]string, 4)
+	for i := range blocks {
+		data := make([]byte, s3manager.MinUploadPartSize/2)
+		rand.Read(data)
+		blocks[i] = string(data)
+	}
+	assert.NoError(t, client.StoreArchive(from, len(blocks), blockFormatJSON, writeBlocks(from, blocks)))
+	assert.Equal(t, 0, server.count("PutObject"))
+	assert.Equal(t, 1, server.count("CreateMultipartUpload"))
+	assert.Equal(t, 3, server.count("UploadPart"))
+
+	reader, _, err := client.getArchivedBlock(big.NewInt(8816002))
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.True(t, blocks[2] == string(data))
+	reader.Close()
+
+	// Nothing is stored if a block cannot be read
+	err = client.StoreArchive(big.NewInt(8816004), 4, blockFormatJSON, func(blockNumber *big.Int, w io.Writer) error {
+		return errors.New("unavailable")
+	})
+	assert.EqualError(t, err, "unavailable")
+	assert.Nil(t, server.object(archiveKey(big.NewInt(8816004), big.NewInt(8816007))))
+}
+
+func TestEncryptedFiles(t *testing.T) {
+	keys := keyfileKeys{"2020-01": make([]byte, dataKeySize)}
+	client, server := testS3Client(t, compressionZstd, newEncryptor("2020-01", keys), 0)
+
+	dictionary := []byte("a zstd dictionary")
+	assert.NoError(t, client.StoreFile(dictionaryKey(7), string(dictionary), "application/octet-stream"))
+	assert.NoError(t, client.StoreFile("exports/blocks.csv", "number,hash\n", "text/csv"))
+	assert.NoError(t, client.StoreNetwork(`{"chainId":1}`))
+
+	for _, key := range []string{dictionaryKey(7), "exports/blocks.csv", networkKey} {
+		object := server.object(key)
+		assert.Equal(t, encryptionAlgorithm, object.header.Get("X-Amz-Meta-Encryption"), key)
+		assert.Equal(t, "application/octet-stream", object.header.Get("Content-Type"), key)
+	}
+	assert.False(t, bytes.Contains(server.object("exports/blocks.csv").body, []byte("number")))
+
+	data, err := client.getDictionary(7)
+	assert.NoError(t, err)
+	assert.Equal(t, dictionary, data)
+
+	network, err := client.GetNetwork()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"chainId":1}`, network)
+
+	// Files stored before encryption was enabled are still read
+	plain := server.client(compressionZstd, newEncryptor("", nil), 0)
+	assert.NoError(t, plain.StoreNetwork(`{"chainId":3}`))
+	network, err = client.GetNetwork()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"chainId":3}`, network)
+}
+
+func TestReencryptRace(t *testing.T) {
+	keys := keyfileKeys{"2020-01": make([]byte, dataKeySize)}
+	client, server := testS3Client(t, compressionGzip, newEncryptor("2020-01", keys), 0)
+	plain := server.client(compressionGzip, newEncryptor("", nil), 0)
+
+	blockNumber := big.NewInt(1000)
+	assert.NoError(t, plain.WriteBlock(blockNumber, blockFormatJSON, writeString("old")))
+
+	// The pipeline stores the block again between the GET and the PUT of the
+	// rewrite, so the PUT fails and the new block is reencrypted instead
+	key := "/blocks/" + client.blockKey(blockNumber, blockFormatJSON)
+	stored := false
+	server.intercept = func(r *http.Request) {
+		if r.Method == http.MethodPut && r.URL.Path == key && !stored {
+			stored = true
+			server.store(key, gzipBytes(t, "new"), http.Header{"Content-Encoding": {compressionGzip}})
+		}
+	}
+
+	changed, err := client.ReencryptBlock(blockNumber, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, changed)
+	assert.Equal(t, 3, server.count("PutObject"))
+
+	object := server.object(client.blockKey(blockNumber, blockFormatJSON))
+	assert.Equal(t, encryptionAlgorithm, object.header.Get("X-Amz-Meta-Encryption"))
+	data, err := client.getObject(key[len("/blocks/"):])
+	assert.NoError(t, err)
+	assert.Equal(t, "new", data)
+
+	// Objects are only replaced a few times before reencrypt gives up
+	assert.NoError(t, plain.WriteBlock(blockNumber, blockFormatJSON, writeString("old")))
+	server.intercept = func(r *http.Request) {
+		if r.Method == http.MethodPut && r.URL.Path == key {
+			server.store(key, gzipBytes(t, "new"), http.Header{"Content-Encoding": {compressionGzip}})
+		}
+	}
+
+	_, err = client.ReencryptBlock(blockNumber, nil)
+	assert.Error(t, err)
+	assert.Equal(t, 3+1+reencryptAttempts, server.count("PutObject"))
+}
+
+func writeString(data string) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := io.WriteString(w, data)
+		return err
+	}
+}
+
+// writeBlocks writes the blocks of an archive that starts at block from.
+func writeBlocks(from *big.Int, blocks []string) func(blockNumber *big.Int, w io.Writer) error {
+	return func(blockNumber *big.Int, w io.Writer) error {
+		return writeString(blocks[new(big.Int).Sub(blockNumber, from).Int64()])(w)
+	}
+}
+
+func gzipBytes(t *testing.T, data string) []byte {
+	compressed, err := newCompressor(compressionGzip, 6, 0, nil).compress([]byte(data))
+	assert.NoError(t, err)
+	return compressed
+}
+
+func TestEncryptedS3Objects(t *testing.T) {
+	keys := keyfileKeys{"2020-01": make([]byte, dataKeySize), "2021-01": bytes.Repeat([]byte{1}, dataKeySize)}
+	blockNumber := big.NewInt(8816481)
+	from := big.NewInt(8816000)
+
+	for _, compression := range []string{compressionGzip, compressionZstd, compressionSnappy, compressionNone} {
+		server := newTestS3Server()
+		defer server.Close()
+
+		clients := func(keyID string) *realS3Client {
+			client := server.client(compression, newEncryptor(keyID, keys), 1000)
+			client.prefix = "main net/"
+			return client
+		}
+		plain := server.client(compression, newEncryptor("", nil), 1000)
+		plain.prefix = "main net/"
+		old := clients("2020-01")
+		current := clients("2021-01")
+
+		// Objects are encrypted as they are uploaded and decrypted as they are
+		// read
+		assert.NoError(t, old.WriteBlock(blockNumber, blockFormatJSON, writeString(testBlockReceipts)))
+		assert.NoError(t, old.StoreBlockObject(tracesObject, blockNumber, "[]"))
+
+		key := old.blockKey(blockNumber, blockFormatJSON)
+		object := server.object(key)
+		assert.Equal(t, "2020-01", object.header.Get("X-Amz-Meta-Encryption-Key-Id"), compression)
+		assert.Equal(t, old.compressor.contentEncoding(), object.header.Get("X-Amz-Meta-Block-Encoding"), compression)
+		assert.Empty(t, object.header.Get("Content-Encoding"))
+		assert.False(t, bytes.Contains(object.body, []byte("transactions")))
+
+		data, format, err := current.GetBlock(blockNumber)
+		assert.NoError(t, err)
+		assert.Equal(t, blockFormatJSON, format)
+		assert.Equal(t, testBlockReceipts, data)
+
+		_, _, err = plain.GetBlock(blockNumber)
+		assert.Error(t, err)
+		_, corrupt := err.(*corruptBlockError)
+		assert.False(t, corrupt)
+
+		// Modified objects are corrupt
+		object.body[len(object.body)/2] ^= 1
+		_, _, err = current.GetBlock(blockNumber)
+		assert.IsType(t, &corruptBlockError{}, err)
+		object.body[len(object.body)/2] ^= 1
+
+		// Rotation copies the objects onto themselves with the new data key
+		var copySources []string
+		server.intercept = func(r *http.Request) {
+			if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+				copySources = append(copySources, source)
+			}
+		}
+		changed, err := current.ReencryptBlock(blockNumber, reencryptedObjects)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, changed)
+		assert.Equal(t, []string{
+			url.PathEscape("blocks/" + key),
+			url.PathEscape("blocks/" + current.blockObjectKey(tracesObject, blockNumber)),
+		}, copySources)
+		assert.Contains(t, copySources[0], "main%20net%2F")
+		server.intercept = nil
+
+		assert.Equal(t, "2021-01", server.object(key).header.Get("X-Amz-Meta-Encryption-Key-Id"))
+		changed, err = current.ReencryptBlock(blockNumber, reencryptedObjects)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, changed)
+
+		data, _, err = clients("2021-01").GetBlock(blockNumber)
+		assert.NoError(t, err)
+		assert.Equal(t, testBlockReceipts, data)
+		traces, err := current.GetBlockObject(tracesObject, blockNumber)
+		assert.NoError(t, err)
+		assert.Equal(t, "[]", traces)
+
+		// Blocks of encrypted archives are read with range requests
+		blocks := make([]string, 1000)
+		blocks[481] = testBlockReceipts
+		assert.NoError(t, old.StoreArchive(from, len(blocks), blockFormatJSON, writeBlocks(from, blocks)))
+		assert.NoError(t, old.DeleteBlock(blockNumber, blockFormatJSON))
+
+		archive := server.object(old.prefix + archiveKey(from, big.NewInt(8816999)))
+		assert.Equal(t, "2020-01", archive.header.Get("X-Amz-Meta-Encryption-Key-Id"))
+		assert.False(t, bytes.Contains(archive.body, []byte("transactions")))
+
+		reader, format, err := current.getArchivedBlock(blockNumber)
+		assert.NoError(t, err)
+		assert.Equal(t, blockFormatJSON, format)
+		archived, err := ioutil.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, testBlockReceipts, string(archived))
+		reader.Close()
+
+		ok, err := current.ReencryptArchive(from)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		ok, err = current.ReencryptArchive(from)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		delete(keys, "2020-01")
+		data, _, err = clients("2021-01").GetBlock(blockNumber)
+		assert.NoError(t, err)
+		assert.Equal(t, testBlockReceipts, data)
+		keys["2020-01"] = make([]byte, dataKeySize)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	client, server := testS3Client(t, compressionGzip, newEncryptor("", nil), 1000)
+	blockNumber := big.NewInt(8816481)
+	other := sha256.Sum256([]byte("other"))
+
+	// A stored block that does not match its Sha256 metadata is corrupt
+	assert.NoError(t, client.WriteBlock(blockNumber, blockFormatJSON, writeString(testBlockReceipts)))
+	server.object(client.blockKey(blockNumber, blockFormatJSON)).header.Set("X-Amz-Meta-Sha256", hex.EncodeToString(other[:]))
+
+	_, _, err := client.GetBlock(blockNumber)
+	assert.IsType(t, &corruptBlockError{}, err)
+	assert.Contains(t, err.Error(), "does not match")
+
+	reader, _, err := client.ReadBlock(blockNumber)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(reader)
+	assert.IsType(t, &corruptBlockError{}, err)
+	reader.Close()
+
+	// An archived block that does not match the checksum in the archive index
+	// is corrupt
+	assert.NoError(t, client.DeleteBlock(blockNumber, blockFormatJSON))
+	blocks := make([]string, 1000)
+	blocks[481] = testBlockReceipts
+	assert.NoError(t, client.StoreArchive(big.NewInt(8816000), len(blocks), blockFormatJSON, writeBlocks(big.NewInt(8816000), blocks)))
+
+	data, _, err := client.GetBlock(blockNumber)
+	assert.NoError(t, err)
+	assert.Equal(t, testBlockReceipts, data)
+	client.forgetArchive(archiveKey(big.NewInt(8816000), big.NewInt(8816999)))
+
+	archive := server.object(archiveKey(big.NewInt(8816000), big.NewInt(8816999)))
+	checksum := blockChecksum(testBlockReceipts)
+	assert.Equal(t, 1, bytes.Count(archive.body, checksum))
+	archive.body = bytes.Replace(archive.body, checksum, other[:], 1)
+
+	_, _, err = client.GetBlock(blockNumber)
+	assert.IsType(t, &corruptBlockError{}, err)
+	assert.Contains(t, err.Error(), "checksum does not match archive")
+}
+
+func TestMoveBlockAside(t *testing.T) {
+	client, server := testS3Client(t, compressionGzip, newEncryptor("", nil), 0)
+
+	blockNumber := big.NewInt(8816481)
+	assert.NoError(t, client.WriteBlock(blockNumber, blockFormatJSON, writeString(testBlockReceipts)))
+	assert.NoError(t, client.WriteBlock(blockNumber, blockFormatCBOR, writeString("cbor")))
+	stored := server.object(client.blockKey(blockNumber, blockFormatJSON))
+
+	moved, err := client.MoveBlockAside(blockNumber, verifyCorrupt)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, moved)
+
+	// The block is a cache miss, and the objects keep their metadata
+	_, _, err = client.GetBlock(blockNumber)
+	assert.True(t, isNoSuchKey(err))
+
+	object := server.object("orphans/8816481/corrupt")
+	assert.Equal(t, stored.body, object.body)
+	assert.Equal(t, stored.header.Get("X-Amz-Meta-Sha256"), object.header.Get("X-Amz-Meta-Sha256"))
+	assert.NotNil(t, server.object("orphans/8816481/corrupt.cbor"))
+
+	moved, err = client.MoveBlockAside(blockNumber, verifyCorrupt)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, moved)
+}
+
+func TestMoveArchivedBlockAside(t *testing.T) {
+	client, server := testS3Client(t, compressionGzip, newEncryptor("", nil), 1000)
+
+	blocks := make([]string, 1000)
+	blocks[481] = testBlockReceipts
+	assert.NoError(t, client.StoreArchive(big.NewInt(8816000), len(blocks), blockFormatJSON, writeBlocks(big.NewInt(8816000), blocks)))
+
+	// A block that is only in an archive is copied aside and marked, so that
+	// it is a cache miss without reading the archive
+	blockNumber := big.NewInt(8816481)
+	moved, err := client.MoveBlockAside(blockNumber, verifyInconsistent)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, moved)
+	assert.NotNil(t, server.object("orphans/8816481/inconsistent"))
+
+	client.forgetArchive(archiveKey(big.NewInt(8816000), big.NewInt(8816999)))
+	gets := server.count("GetObject")
+	_, _, err = client.ReadBlock(blockNumber)
+	assert.True(t, isNoSuchKey(err))
+	assert.Equal(t, gets+1, server.count("GetObject"))
+
+	_, _, err = client.GetBlock(blockNumber)
+	assert.True(t, isNoSuchKey(err))
+
+	// The block that is stored again replaces the mark
+	assert.NoError(t, client.WriteBlock(blockNumber, blockFormatJSON, writeString(testBlockReceipts)))
+	data, _, err := client.GetBlock(blockNumber)
+	assert.NoError(t, err)
+	assert.Equal(t, testBlockReceipts, data)
+
+	// A block that is stored on its own is moved aside, and marked because it
+	// is also in the archive
+	moved, err = client.MoveBlockAside(blockNumber, verifyCorrupt)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, moved)
+	_, _, err = client.GetBlock(blockNumber)
+	assert.True(t, isNoSuchKey(err))
+
+	// Blocks that are not archived are not marked
+	moved, err = client.MoveBlockAside(big.NewInt(8817481), verifyCorrupt)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, moved)
+	assert.Nil(t, server.object(client.blockKey(big.NewInt(8817481), blockFormatJSON)))
+}
+
+func TestOrphanBlock(t *testing.T) {
+	keys := keyfileKeys{"2020-01": make([]byte, dataKeySize)}
+	client, server := testS3Client(t, compressionZstd, newEncryptor("2020-01", keys), 0)
+
+	blockNumber := big.NewInt(8816481)
+	assert.NoError(t, client.WriteBlock(blockNumber, blockFormatJSON, writeString(testBlockReceipts)))
+	stored := server.object(client.blockKey(blockNumber, blockFormatJSON))
+	hash := "0x5715f190c16d0b954ee2741b255cdb5930b738ef7edba01852df8a721c81409b"
+
+	// The orphan is a server-side copy of the stored bytes and metadata
+	puts := server.count("PutObject")
+	assert.NoError(t, client.OrphanBlock(blockNumber, hash, blockFormatJSON))
+	assert.Equal(t, puts, server.count("PutObject"))
+	assert.Equal(t, 1, server.count("CopyObject"))
+	assert.Nil(t, server.object(client.blockKey(blockNumber, blockFormatJSON)))
+
+	object := server.object("orphans/8816481/" + hash)
+	assert.Equal(t, stored.body, object.body)
+	for _, name := range []string{"X-Amz-Meta-Sha256", "X-Amz-Meta-Encryption", "X-Amz-Meta-Encryption-Key-Id", "Content-Encoding"} {
+		assert.Equal(t, stored.header.Get(name), object.header.Get(name), name)
+	}
+
+	// A block that is not stored on its own is left alone
+	assert.NoError(t, client.OrphanBlock(big.NewInt(1), hash, blockFormatJSON))
+}
+
+func TestReadBlockRequests(t *testing.T) {
+	client, server := testS3Client(t, compressionGzip, newEncryptor("", nil), 1000)
+	blockNumber := big.NewInt(8816481)
+
+	// A miss looks up the configured format and the archive, and the missing
+	// archive is remembered
+	_, _, err := client.ReadBlock(blockNumber)
+	assert.True(t, isNoSuchKey(err))
+	assert.Equal(t, 2, server.count("GetObject"))
+
+	_, _, err = client.ReadBlock(big.NewInt(8816482))
+	assert.True(t, isNoSuchKey(err))
+	assert.Equal(t, 3, server.count("GetObject"))
+
+	// Blocks in other formats are only read by GetBlock, or while migrating
+	cbor, err := convertBlock(testBlockReceipts, blockFormatJSON, blockFormatCBOR)
+	assert.NoError(t, err)
+	assert.NoError(t, client.WriteBlock(blockNumber, blockFormatCBOR, writeString(cbor)))
+
+	_, _, err = client.ReadBlock(blockNumber)
+	assert.True(t, isNoSuchKey(err))
+
+	_, format, err := client.GetBlock(blockNumber)
+	assert.NoError(t, err)
+	assert.Equal(t, blockFormatCBOR, format)
+
+	client.allFormats = true
+	reader, format, err := client.ReadBlock(blockNumber)
+	assert.NoError(t, err)
+	assert.Equal(t, blockFormatCBOR, format)
+	reader.Close()
+
+	// Archives stored by the client are read at once
+	blocks := make([]string, 1000)
+	blocks[481] = testBlockReceipts
+	assert.NoError(t, client.StoreArchive(big.NewInt(8816000), len(blocks), blockFormatJSON, writeBlocks(big.NewInt(8816000), blocks)))
+	assert.NoError(t, client.DeleteBlock(blockNumber, blockFormatCBOR))
+
+	data, format, err := client.GetBlock(blockNumber)
+	assert.NoError(t, err)
+	assert.Equal(t, blockFormatJSON, format)
+	assert.Equal(t, testBlockReceipts, data)
+}
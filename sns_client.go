@@ -2,51 +2,42 @@ package main
 
 import (
 	"context"
+	"math/big"
+	"strconv"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws"
 	sns "github.com/aws/aws-sdk-go/service/sns"
 )
 
 type snsClient interface {
-	Publish(data string) error
+	Publish(data string, attributes map[string]string) error
 }
 
 type realSnsClient struct {
 	topic   string
+	chainID *big.Int
 	sns     *sns.SNS
 	timeout time.Duration
 }
 
-func createRealSnsClient(topic string, timeout time.Duration) snsClient {
-	// All clients require a Session. The Session provides the client with
-	// shared configuration such as region, endpoint, and credentials. A
-	// Session should be shared where possible to take advantage of
-	// configuration and credential caching. See the session package for
-	// more information.
-	sess := session.Must(session.NewSession())
-
-	// Create a new instance of the service's client with a Session.
-	// Optional aws.Config values can also be provided as variadic arguments
-	// to the New function. This option allows you to provide service
-	// specific configuration.
-	svc := sns.New(sess)
-
-	// Create a context with a timeout that will abort the upload if it takes
-	// more than the passed in timeout.
-	ctx := context.Background()
-	if timeout > 0 {
-		ctx, _ = context.WithTimeout(ctx, timeout)
-	}
+// createRealSnsClient creates an SNS client that connects as configured by
+// awsConfig. If chainID is not nil it is sent as the chainId attribute of
+// every message.
+func createRealSnsClient(awsConfig awsClientConfig, topic string, chainID *big.Int, timeout time.Duration) snsClient {
+	svc := sns.New(newAWSSession(awsConfig), awsConfig.serviceConfig())
 
 	return &realSnsClient{
 		sns:     svc,
 		timeout: timeout,
 		topic:   topic,
+		chainID: chainID,
 	}
 }
 
-func (client *realSnsClient) Publish(data string) error {
+// Publish sends data with the given message attributes. Numeric attributes are
+// sent as numbers so that subscription filter policies can compare them.
+func (client *realSnsClient) Publish(data string, attributes map[string]string) error {
 	ctx := context.Background()
 	ctx, cancelFn := context.WithTimeout(ctx, client.timeout)
 	defer cancelFn()
@@ -56,6 +47,26 @@ func (client *realSnsClient) Publish(data string) error {
 		TopicArn: &client.topic,
 	}
 
+	input.MessageAttributes = make(map[string]*sns.MessageAttributeValue)
+	for name, value := range attributes {
+		dataType := "String"
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			dataType = "Number"
+		}
+
+		input.MessageAttributes[name] = &sns.MessageAttributeValue{
+			DataType:    aws.String(dataType),
+			StringValue: aws.String(value),
+		}
+	}
+
+	if client.chainID != nil {
+		input.MessageAttributes["chainId"] = &sns.MessageAttributeValue{
+			DataType:    aws.String("Number"),
+			StringValue: aws.String(client.chainID.String()),
+		}
+	}
+
 	_, err := client.sns.PublishWithContext(ctx, input)
 	if err != nil {
 		return err
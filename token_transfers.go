@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Token standards of a token transfer.
+const (
+	tokenStandardERC20   = "erc20"
+	tokenStandardERC721  = "erc721"
+	tokenStandardERC1155 = "erc1155"
+)
+
+// tokenTransfersObject is the name of the objects that hold the token
+// transfers of a block.
+const tokenTransfersObject = "tokenTransfers"
+
+var (
+	transferTopic       = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+	transferSingleTopic = crypto.Keccak256Hash([]byte("TransferSingle(address,address,address,uint256,uint256)"))
+	transferBatchTopic  = crypto.Keccak256Hash([]byte("TransferBatch(address,address,address,uint256[],uint256[])"))
+)
+
+// tokenTransfer is a single ERC-20, ERC-721 or ERC-1155 transfer. Amounts and
+// token IDs are decimal strings. A TransferBatch log results in one transfer
+// per token, all with the log index of the batch.
+type tokenTransfer struct {
+	BlockNumber     uint64         `json:"blockNumber"`
+	TokenAddress    common.Address `json:"tokenAddress"`
+	Standard        string         `json:"standard"`
+	From            common.Address `json:"from"`
+	To              common.Address `json:"to"`
+	Value           string         `json:"value,omitempty"`
+	TokenID         string         `json:"tokenId,omitempty"`
+	TransactionHash common.Hash    `json:"transactionHash"`
+	LogIndex        uint           `json:"logIndex"`
+}
+
+// extractTokenTransfers decodes the token transfers from the logs of a block.
+// Logs that do not match a known transfer event are skipped.
+func extractTokenTransfers(block *receiptsBlock) []*tokenTransfer {
+	transfers := []*tokenTransfer{}
+	for _, receipt := range block.Receipts {
+		for _, l := range receipt.Logs {
+			if l.Removed {
+				continue
+			}
+			transfers = append(transfers, decodeTokenTransfers(l)...)
+		}
+	}
+
+	return transfers
+}
+
+func decodeTokenTransfers(l *types.Log) []*tokenTransfer {
+	if len(l.Topics) == 0 {
+		return nil
+	}
+
+	transfer := func(standard string, from common.Hash, to common.Hash) *tokenTransfer {
+		return &tokenTransfer{
+			BlockNumber:     l.BlockNumber,
+			TokenAddress:    l.Address,
+			Standard:        standard,
+			From:            common.BytesToAddress(from.Bytes()),
+			To:              common.BytesToAddress(to.Bytes()),
+			TransactionHash: l.TxHash,
+			LogIndex:        l.Index,
+		}
+	}
+
+	switch l.Topics[0] {
+	case transferTopic:
+		// ERC-20 and ERC-721 share the event signature. ERC-721 indexes the
+		// token ID, so it has one more topic.
+		if len(l.Topics) == 3 && len(l.Data) == 32 {
+			t := transfer(tokenStandardERC20, l.Topics[1], l.Topics[2])
+			t.Value = new(big.Int).SetBytes(l.Data).String()
+			return []*tokenTransfer{t}
+		}
+		if len(l.Topics) == 4 && len(l.Data) == 0 {
+			t := transfer(tokenStandardERC721, l.Topics[1], l.Topics[2])
+			t.TokenID = l.Topics[3].Big().String()
+			return []*tokenTransfer{t}
+		}
+	case transferSingleTopic:
+		if len(l.Topics) == 4 && len(l.Data) == 64 {
+			t := transfer(tokenStandardERC1155, l.Topics[2], l.Topics[3])
+			t.TokenID = new(big.Int).SetBytes(l.Data[:32]).String()
+			t.Value = new(big.Int).SetBytes(l.Data[32:]).String()
+			return []*tokenTransfer{t}
+		}
+	case transferBatchTopic:
+		if len(l.Topics) != 4 {
+			return nil
+		}
+		ids, ok := decodeUint256Array(l.Data, 0)
+		if !ok {
+			return nil
+		}
+		values, ok := decodeUint256Array(l.Data, 1)
+		if !ok || len(ids) != len(values) {
+			return nil
+		}
+
+		var transfers []*tokenTransfer
+		for i := range ids {
+			t := transfer(tokenStandardERC1155, l.Topics[2], l.Topics[3])
+			t.TokenID = ids[i].String()
+			t.Value = values[i].String()
+			transfers = append(transfers, t)
+		}
+		return transfers
+	}
+
+	return nil
+}
+
+// decodeUint256Array decodes the ABI encoded uint256[] that is the argument at
+// the given position of data. It returns false if data is malformed.
+func decodeUint256Array(data []byte, argument int) ([]*big.Int, bool) {
+	word := func(offset uint64) (*big.Int, bool) {
+		if offset+32 < offset || offset+32 > uint64(len(data)) {
+			return nil, false
+		}
+		return new(big.Int).SetBytes(data[offset : offset+32]), true
+	}
+
+	offset, ok := word(uint64(argument) * 32)
+	if !ok || !offset.IsUint64() {
+		return nil, false
+	}
+
+	length, ok := word(offset.Uint64())
+	if !ok || !length.IsUint64() || length.Uint64() > uint64(len(data))/32 {
+		return nil, false
+	}
+
+	values := make([]*big.Int, length.Uint64())
+	for i := range values {
+		values[i], ok = word(offset.Uint64() + 32 + uint64(i)*32)
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return values, true
+}
+
+// processTokenTransfers stores the token transfers of a block next to it and
+// publishes every transfer if a transfer topic is configured. Like block
+// numbers, transfers are published again when a block is processed again,
+// but not when it is retried after a later step failed.
+func processTokenTransfers(blockNumber *big.Int, block *receiptsBlock, hitFromCache bool, p *pipeline) ([]*tokenTransfer, error) {
+	transfers := extractTokenTransfers(block)
+
+	stored := ""
+	if hitFromCache {
+		var err error
+		stored, err = p.clients.s3.GetBlockObject(tokenTransfersObject, blockNumber)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if stored == "" {
+		data, err := json.Marshal(transfers)
+		if err != nil {
+			return nil, err
+		}
+
+		err = p.clients.s3.StoreBlockObject(tokenTransfersObject, blockNumber, string(data))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.clients.transferSns == nil {
+		return transfers, nil
+	}
+
+	for i, transfer := range transfers {
+		data, err := json.Marshal(transfer)
+		if err != nil {
+			return nil, err
+		}
+
+		err = p.publish(blockNumber, block, "transfer/"+strconv.Itoa(i), p.clients.transferSns, string(data), map[string]string{
+			"standard":     transfer.Standard,
+			"tokenAddress": transfer.TokenAddress.Hex(),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return transfers, nil
+}
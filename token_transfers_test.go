@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/prettymuchbryce/ingestr/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var (
+	testToken    = common.HexToAddress("0x6b175474e89094c44da98b954eedeac495271d0f")
+	testFrom     = common.HexToAddress("0x5a0b54d5dc17e0aadc383d2db43b0a0d3e029c4c")
+	testTo       = common.HexToAddress("0xea674fdde714fd979de3edf0f56aa9716b898ec8")
+	testOperator = common.HexToAddress("0x1111111111111111111111111111111111111111")
+)
+
+func testWord(value int64) []byte {
+	return common.BigToHash(big.NewInt(value)).Bytes()
+}
+
+func testTransferBlock(logs ...*types.Log) *receiptsBlock {
+	for i, l := range logs {
+		l.Address = testToken
+		l.Index = uint(i)
+	}
+
+	return &receiptsBlock{Receipts: []*types.Receipt{{Logs: logs}}}
+}
+
+func TestExtractTokenTransfers(t *testing.T) {
+	from := common.BytesToHash(testFrom.Bytes())
+	to := common.BytesToHash(testTo.Bytes())
+	operator := common.BytesToHash(testOperator.Bytes())
+
+	var batchData []byte
+	for _, word := range []int64{64, 160, 2, 7, 8, 2, 100, 200} {
+		batchData = append(batchData, testWord(word)...)
+	}
+
+	block := testTransferBlock(
+		&types.Log{Topics: []common.Hash{transferTopic, from, to}, Data: testWord(1000)},
+		&types.Log{Topics: []common.Hash{transferTopic, from, to, common.BigToHash(big.NewInt(42))}},
+		&types.Log{Topics: []common.Hash{transferSingleTopic, operator, from, to}, Data: append(testWord(5), testWord(3)...)},
+		&types.Log{Topics: []common.Hash{transferBatchTopic, operator, from, to}, Data: batchData},
+		// Malformed and unrelated logs are skipped
+		&types.Log{Topics: []common.Hash{transferTopic, from}, Data: testWord(1)},
+		&types.Log{Topics: []common.Hash{transferBatchTopic, operator, from, to}, Data: testWord(4096)},
+		&types.Log{Topics: []common.Hash{common.HexToHash("0x01")}},
+		&types.Log{Topics: []common.Hash{transferTopic, from, to}, Data: testWord(1), Removed: true},
+	)
+
+	transfers := extractTokenTransfers(block)
+	assert.Len(t, transfers, 5)
+
+	assert.Equal(t, tokenStandardERC20, transfers[0].Standard)
+	assert.Equal(t, testToken, transfers[0].TokenAddress)
+	assert.Equal(t, testFrom, transfers[0].From)
+	assert.Equal(t, testTo, transfers[0].To)
+	assert.Equal(t, "1000", transfers[0].Value)
+
+	assert.Equal(t, tokenStandardERC721, transfers[1].Standard)
+	assert.Equal(t, "42", transfers[1].TokenID)
+	assert.Equal(t, "", transfers[1].Value)
+
+	assert.Equal(t, tokenStandardERC1155, transfers[2].Standard)
+	assert.Equal(t, testFrom, transfers[2].From)
+	assert.Equal(t, "5", transfers[2].TokenID)
+	assert.Equal(t, "3", transfers[2].Value)
+
+	assert.Equal(t, "7", transfers[3].TokenID)
+	assert.Equal(t, "100", transfers[3].Value)
+	assert.Equal(t, "8", transfers[4].TokenID)
+	assert.Equal(t, "200", transfers[4].Value)
+	assert.Equal(t, uint(3), transfers[4].LogIndex)
+}
+
+func TestProcessTokenTransfers(t *testing.T) {
+	blockNumber := big.NewInt(8886217)
+	from := common.BytesToHash(testFrom.Bytes())
+	to := common.BytesToHash(testTo.Bytes())
+	block := testTransferBlock(&types.Log{Topics: []common.Hash{transferTopic, from, to}, Data: testWord(1)})
+
+	s3 := &mocks.S3Client{}
+	s3.On("GetBlockObject", tokenTransfersObject, blockNumber).Return("[]", nil)
+	sns := &mocks.SNSClient{}
+	sns.On("Publish", mock.Anything, map[string]string{"standard": tokenStandardERC20, "tokenAddress": testToken.Hex()}).Return(nil)
+
+	p := createPipeline(testConf)
+	p.clients = &clients{s3: s3, transferSns: sns}
+
+	// Stored transfers of a cached block are not stored again
+	transfers, err := processTokenTransfers(blockNumber, block, true, p)
+	assert.NoError(t, err)
+	assert.Len(t, transfers, 1)
+	s3.AssertNotCalled(t, "StoreBlockObject", mock.Anything, mock.Anything, mock.Anything)
+	sns.AssertNumberOfCalls(t, "Publish", 1)
+
+	// Transfers that were published are not published again when the block
+	// is retried
+	_, err = processTokenTransfers(blockNumber, block, true, p)
+	assert.NoError(t, err)
+	sns.AssertNumberOfCalls(t, "Publish", 1)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"time"
+)
+
+// Trace modes select the RPC call that traces a block.
+const (
+	traceModeNone  = "none"
+	traceModeDebug = "debug"
+	traceModeTrace = "trace"
+)
+
+// Names of the objects that are stored next to a block.
+const (
+	tracesObject     = "traces"
+	stateDiffsObject = "stateDiffs"
+)
+
+// processTraces stores the call traces of a block next to it, and returns
+// them.
+func processTraces(blockNumber *big.Int, hitFromCache bool, p *pipeline) (json.RawMessage, error) {
+	return processBlockObject(tracesObject, blockNumber, hitFromCache, p, func(ctx context.Context) (json.RawMessage, error) {
+		return p.clients.eth.TraceBlock(ctx, blockNumber, p.config.traceMode)
+	})
+}
+
+// processStateDiffs stores the state diff of every transaction in a block
+// next to it.
+func processStateDiffs(blockNumber *big.Int, hitFromCache bool, p *pipeline) error {
+	_, err := processBlockObject(stateDiffsObject, blockNumber, hitFromCache, p, func(ctx context.Context) (json.RawMessage, error) {
+		return p.clients.eth.StateDiffs(ctx, blockNumber, p.config.stateDiffMode)
+	})
+	return err
+}
+
+// processBlockObject fetches an object and stores it next to the block, and
+// returns it. For a cached block it is only fetched if it has not been stored
+// yet, so that enabling a stage later and requeueing a range backfills it.
+func processBlockObject(name string, blockNumber *big.Int, hitFromCache bool, p *pipeline, fetch func(ctx context.Context) (json.RawMessage, error)) (json.RawMessage, error) {
+	if hitFromCache {
+		stored, err := p.clients.s3.GetBlockObject(name, blockNumber)
+		if err != nil {
+			return nil, err
+		}
+		if stored != "" {
+			return json.RawMessage(stored), nil
+		}
+	}
+
+	data, err := fetchWithRetries(blockNumber, name, p, fetch)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, p.clients.s3.StoreBlockObject(name, blockNumber, string(data))
+}
+
+// fetchWithRetries runs a slow request such as a trace with the trace timeout,
+// and retries it TRACE_RETRIES times before giving up.
+func fetchWithRetries(blockNumber *big.Int, name string, p *pipeline, fetch func(ctx context.Context) (json.RawMessage, error)) (json.RawMessage, error) {
+	var err error
+	for attempt := 0; attempt <= p.config.traceRetries; attempt++ {
+		if attempt > 0 {
+			p.log.Warnf("Failed to get %s for block %s, retrying", name, blockNumber.String())
+			p.log.Warn(err)
+			time.Sleep(msToDuration(p.config.traceRetryDelayMS))
+		}
+
+		var result json.RawMessage
+		result, err = fetchWithTimeout(p.config.traceTimeoutMS, fetch)
+		if err == nil {
+			return result, nil
+		}
+	}
+
+	return nil, err
+}
+
+func fetchWithTimeout(timeoutMS int, fetch func(ctx context.Context) (json.RawMessage, error)) (json.RawMessage, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), msToDuration(timeoutMS))
+	defer cancelFn()
+
+	return fetch(ctx)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/prettymuchbryce/ingestr/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestProcessTracesRetries(t *testing.T) {
+	conf := *testConf
+	conf.traceMode = traceModeDebug
+	conf.traceRetries = 1
+	conf.traceRetryDelayMS = 0
+
+	blockNumber := big.NewInt(8886217)
+	traces := json.RawMessage(`[{"result":{"type":"CALL"}}]`)
+
+	eth := &mocks.EthClient{}
+	eth.On("TraceBlock", mock.Anything, blockNumber, traceModeDebug).Return(nil, errors.New("timeout")).Once()
+	eth.On("TraceBlock", mock.Anything, blockNumber, traceModeDebug).Return(traces, nil).Once()
+
+	s3 := &mocks.S3Client{}
+	s3.On("StoreBlockObject", tracesObject, blockNumber, string(traces)).Return(nil)
+
+	p := createPipeline(&conf)
+	p.clients = &clients{eth: eth, s3: s3}
+
+	result, err := processTraces(blockNumber, false, p)
+	assert.NoError(t, err)
+	assert.Equal(t, traces, result)
+
+	eth.AssertExpectations(t)
+	s3.AssertExpectations(t)
+}
+
+func TestProcessTracesCached(t *testing.T) {
+	conf := *testConf
+	conf.traceMode = traceModeTrace
+	conf.traceRetries = 0
+
+	blockNumber := big.NewInt(8886217)
+
+	eth := &mocks.EthClient{}
+	eth.On("TraceBlock", mock.Anything, blockNumber, traceModeTrace).Return(nil, errors.New("unsupported"))
+
+	s3 := &mocks.S3Client{}
+	s3.On("GetBlockObject", tracesObject, blockNumber).Return(`[]`, nil).Once()
+	s3.On("GetBlockObject", tracesObject, blockNumber).Return("", nil).Once()
+
+	p := createPipeline(&conf)
+	p.clients = &clients{eth: eth, s3: s3}
+
+	// Stored traces are not fetched again
+	result, err := processTraces(blockNumber, true, p)
+	assert.NoError(t, err)
+	assert.Equal(t, json.RawMessage(`[]`), result)
+	eth.AssertNotCalled(t, "TraceBlock", mock.Anything, mock.Anything, mock.Anything)
+
+	_, err = processTraces(blockNumber, true, p)
+	assert.EqualError(t, err, "unsupported")
+}
+
+func TestProcessStateDiffs(t *testing.T) {
+	conf := *testConf
+	conf.stateDiffMode = traceModeTrace
+
+	blockNumber := big.NewInt(8886217)
+	diffs := json.RawMessage(`[{"stateDiff":{}}]`)
+
+	eth := &mocks.EthClient{}
+	eth.On("StateDiffs", mock.Anything, blockNumber, traceModeTrace).Return(diffs, nil)
+
+	s3 := &mocks.S3Client{}
+	s3.On("StoreBlockObject", stateDiffsObject, blockNumber, string(diffs)).Return(nil)
+
+	p := createPipeline(&conf)
+	p.clients = &clients{eth: eth, s3: s3}
+
+	err := processStateDiffs(blockNumber, false, p)
+	assert.NoError(t, err)
+	s3.AssertExpectations(t)
+
+	attributes := notificationAttributes(&receiptsBlock{}, []string{stateDiffsObject})
+	assert.Equal(t, "true", attributes[stateDiffsObject])
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// transactionIndex is the name of the index of transactions by hash. Entries
+// are keyed by the 32 bytes of the hash and hold the block number and the
+// position of the transaction in its block, 12 bytes in all. The keys of a
+// block are not recorded, since a transaction that is not in the block of its
+// entry anymore, e.g. after a reorg, is not found. With redis every entry is
+// a field of a single hash in memory, so the index is opt-in.
+const transactionIndex = "transactions"
+
+// transactionLookup is a transaction and its receipt read from the cached
+// block that the transaction index points to.
+type transactionLookup struct {
+	BlockNumber *big.Int           `json:"blockNumber"`
+	Index       uint32             `json:"index"`
+	Transaction *types.Transaction `json:"transaction"`
+	Receipt     *types.Receipt     `json:"receipt"`
+}
+
+// indexTransactions adds the transactions of the block to the transaction
+// index.
+func indexTransactions(blockNumber *big.Int, block *receiptsBlock, p *pipeline) error {
+	entries := make(map[string][]byte)
+	for i, tx := range block.Transactions {
+		index := make([]byte, 4)
+		binary.BigEndian.PutUint32(index, uint32(i))
+		entries[string(tx.Hash().Bytes())] = index
+	}
+
+	return p.clients.redis.setIndexEntries(transactionIndex, blockNumber, entries)
+}
+
+// lookupTransaction returns nil if the transaction is not in the index, or
+// if the cached block of its entry does not have it anymore.
+func lookupTransaction(redisClient redisClient, s3Client s3Client, hash common.Hash) (*transactionLookup, error) {
+	entry, blockNumber, err := redisClient.getIndexEntry(transactionIndex, string(hash.Bytes()))
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	if len(entry) != 4 {
+		return nil, fmt.Errorf("invalid transaction index entry: %s", hash.Hex())
+	}
+	index := binary.BigEndian.Uint32(entry)
+
+	data, format, err := s3Client.GetBlock(blockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := decodeBlock(format, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if int(index) >= len(block.Transactions) || block.Transactions[index].Hash() != hash {
+		return nil, nil
+	}
+
+	lookup := &transactionLookup{
+		BlockNumber: blockNumber,
+		Index:       index,
+		Transaction: block.Transactions[index],
+	}
+
+	for _, receipt := range block.Receipts {
+		if receipt.TxHash == hash {
+			lookup.Receipt = receipt
+		}
+	}
+
+	return lookup, nil
+}
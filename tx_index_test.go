@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/prettymuchbryce/ingestr/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func testTransactionIndex(t *testing.T, redisClient redisClient) {
+	blockNumber := big.NewInt(8886217)
+	block, _, _ := testContractBlock(t, 0)
+	block.Version = receiptsBlockVersion
+	data, err := marshalReceiptBlock(block)
+	assert.NoError(t, err)
+
+	s3 := &mocks.S3Client{}
+	s3.On("GetBlock", blockNumber).Return(data, blockFormatJSON, nil).Once()
+
+	p := createPipeline(testConf)
+	p.clients = &clients{redis: redisClient, s3: s3}
+
+	err = indexTransactions(blockNumber, block, p)
+	assert.NoError(t, err)
+
+	hash := block.Transactions[0].Hash()
+	lookup, err := lookupTransaction(redisClient, s3, hash)
+	assert.NoError(t, err)
+	assert.Equal(t, blockNumber, lookup.BlockNumber)
+	assert.Equal(t, uint32(0), lookup.Index)
+	assert.Equal(t, hash, lookup.Transaction.Hash())
+	assert.Equal(t, hash, lookup.Receipt.TxHash)
+
+	entry, entryBlock, err := redisClient.getIndexEntry(transactionIndex, string(hash.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, blockNumber, entryBlock)
+	assert.Equal(t, []byte{0, 0, 0, 0}, entry)
+
+	lookup, err = lookupTransaction(redisClient, s3, common.HexToHash("0x01"))
+	assert.NoError(t, err)
+	assert.Nil(t, lookup)
+
+	// A transaction that the cached block does not have anymore is not found
+	s3.On("GetBlock", blockNumber).Return(testBlockReceipts, blockFormatJSON, nil).Once()
+	lookup, err = lookupTransaction(redisClient, s3, hash)
+	assert.NoError(t, err)
+	assert.Nil(t, lookup)
+
+	s3.AssertExpectations(t)
+}
+
+func TestTransactionIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingestr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	embedded := testCreateEmbeddedClient(t, dir, 60)
+	defer embedded.close()
+
+	testTransactionIndex(t, embedded)
+}
+
+func TestTransactionIndexRedis(t *testing.T) {
+	testTransactionIndex(t, testClients.redis)
+
+	// Entries are keyed by the bytes of the hash and nothing else is stored
+	fields, err := redisClientTest.HKeys(testConf.redisIndexKey + "/" + transactionIndex).Result()
+	assert.NoError(t, err)
+	assert.Len(t, fields, 1)
+	assert.Len(t, fields[0], common.HashLength)
+	value, err := redisClientTest.HGet(testConf.redisIndexKey+"/"+transactionIndex, fields[0]).Bytes()
+	assert.NoError(t, err)
+	assert.Len(t, value, 12)
+
+	keys, err := redisClientTest.Keys(testConf.redisIndexKey + "*").Result()
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+
+	testClearRedis(redisClientTest)
+}
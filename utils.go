@@ -14,6 +14,10 @@ func msToDuration(ms int) time.Duration {
 	return time.Duration(int64(ms) * millisecondNano)
 }
 
+// receiptsBlockVersion is the schema version of stored blocks. Version 0
+// blocks were stored without a version and without uncles.
+const receiptsBlockVersion = 1
+
 func marshalReceiptBlock(block *receiptsBlock) (string, error) {
 	resultBytes, err := json.Marshal(block)
 	if err != nil {
@@ -23,9 +27,33 @@ func marshalReceiptBlock(block *receiptsBlock) (string, error) {
 	return string(resultBytes), nil
 }
 
+func unmarshalReceiptBlock(data string) (*receiptsBlock, error) {
+	var block *receiptsBlock
+	err := json.Unmarshal([]byte(data), &block)
+	if err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
 type receiptsBlock struct {
+	Version      int                  `json:"version"`
 	Header       *types.Header        `json:"header"`
 	Receipts     []*types.Receipt     `json:"receipts"`
 	Hash         common.Hash          `json:"hash"`
 	Transactions []*types.Transaction `json:"transactions"`
+	Uncles       []*types.Header      `json:"uncles"`
+	DecodedLogs  []*decodedLog        `json:"decodedLogs,omitempty"`
+}
+
+// transactionSender recovers the sender of a transaction, with or without
+// replay protection.
+func transactionSender(tx *types.Transaction) (common.Address, error) {
+	var signer types.Signer = types.HomesteadSigner{}
+	if tx.Protected() {
+		signer = types.NewEIP155Signer(tx.ChainId())
+	}
+
+	return types.Sender(signer, tx)
 }
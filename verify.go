@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"text/tabwriter"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Kinds of problems found by verifying stored blocks.
+const (
+	// verifyMissing is a block that is not stored.
+	verifyMissing = "missing"
+
+	// verifyCorrupt is a block that cannot be decoded or does not match its
+	// own header.
+	verifyCorrupt = "corrupt"
+
+	// verifyInconsistent is a block whose parent hash does not match the hash
+	// of the stored block before it, e.g. because one of them was stored
+	// before a reorg.
+	verifyInconsistent = "inconsistent"
+)
+
+// verifyProblem is a stored block that failed verification.
+type verifyProblem struct {
+	block  *big.Int
+	kind   string
+	reason string
+}
+
+// verifyBlocks reads a range of stored blocks and checks every block against
+// its header and against the block before it. Errors other than missing
+// blocks stop the verification.
+func verifyBlocks(from *big.Int, to *big.Int, s3Client s3Client) ([]*verifyProblem, error) {
+	var problems []*verifyProblem
+	var previousHash *common.Hash
+	for n := new(big.Int).Set(from); n.Cmp(to) <= 0; n.Add(n, big.NewInt(1)) {
+		blockNumber := new(big.Int).Set(n)
+		parentHash := previousHash
+		previousHash = nil
+
+		data, format, err := s3Client.GetBlock(blockNumber)
+		if isNoSuchKey(err) {
+			problems = append(problems, &verifyProblem{blockNumber, verifyMissing, ""})
+			continue
+		}
+		if corrupt, ok := err.(*corruptBlockError); ok {
+			problems = append(problems, &verifyProblem{blockNumber, verifyCorrupt, corrupt.reason})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("block %s: %s", blockNumber, err)
+		}
+
+		block, err := decodeBlock(format, data)
+		if err == nil {
+			err = verifyBlock(blockNumber, block)
+		}
+		if err != nil {
+			problems = append(problems, &verifyProblem{blockNumber, verifyCorrupt, err.Error()})
+			continue
+		}
+
+		if parentHash != nil && block.Header.ParentHash != *parentHash {
+			reason := fmt.Sprintf("parent hash %s does not match block %s with hash %s", block.Header.ParentHash.Hex(), new(big.Int).Sub(blockNumber, big.NewInt(1)), parentHash.Hex())
+			problems = append(problems, &verifyProblem{blockNumber, verifyInconsistent, reason})
+		}
+		previousHash = &block.Hash
+	}
+
+	return problems, nil
+}
+
+// checkBlockHeader checks that a block is the requested block and that its
+// hash is the hash of its header.
+func checkBlockHeader(blockNumber *big.Int, block *receiptsBlock) error {
+	if block.Header == nil {
+		return errors.New("no header")
+	}
+	if block.Header.Number == nil || block.Header.Number.Cmp(blockNumber) != 0 {
+		return fmt.Errorf("header is of block %s", block.Header.Number)
+	}
+
+	if hash := block.Header.Hash(); hash != block.Hash {
+		return fmt.Errorf("header hash %s does not match hash %s", hash.Hex(), block.Hash.Hex())
+	}
+
+	return nil
+}
+
+// verifyBlock checks the header of a block and that its transactions and
+// receipts match the roots in its header.
+func verifyBlock(blockNumber *big.Int, block *receiptsBlock) error {
+	err := checkBlockHeader(blockNumber, block)
+	if err != nil {
+		return err
+	}
+
+	if root := types.DeriveSha(types.Transactions(block.Transactions)); root != block.Header.TxHash {
+		return fmt.Errorf("transactions root %s does not match header %s", root.Hex(), block.Header.TxHash.Hex())
+	}
+
+	if root := types.DeriveSha(types.Receipts(block.Receipts)); root != block.Header.ReceiptHash {
+		return fmt.Errorf("receipts root %s does not match header %s", root.Hex(), block.Header.ReceiptHash.Hex())
+	}
+
+	return nil
+}
+
+// writeVerifyReport writes a line for every problem and a summary of the
+// verified range.
+func writeVerifyReport(from *big.Int, to *big.Int, problems []*verifyProblem, out io.Writer) error {
+	counts := make(map[string]int)
+	writer := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for _, problem := range problems {
+		counts[problem.kind]++
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", problem.block, problem.kind, problem.reason)
+	}
+
+	count := new(big.Int).Sub(to, from)
+	fmt.Fprintf(writer, "verified %s blocks from %s to %s: %d %s, %d %s, %d %s\n",
+		count.Add(count, big.NewInt(1)), from, to,
+		counts[verifyMissing], verifyMissing,
+		counts[verifyCorrupt], verifyCorrupt,
+		counts[verifyInconsistent], verifyInconsistent)
+
+	return writer.Flush()
+}
+
+// requeueProblems requeues every block that failed verification. Either block
+// of an inconsistent pair may be the stale one, so the parent of an
+// inconsistent block is requeued too. The objects of the blocks are moved aside
+// first, and archived blocks are marked, otherwise processing a block would
+// read it from the cache again.
+func requeueProblems(problems []*verifyProblem, s3Client s3Client, redisClient redisClient, out io.Writer) error {
+	count := 0
+	moved := 0
+	for _, problem := range problems {
+		from := problem.block
+		if problem.kind == verifyInconsistent {
+			from = new(big.Int).Sub(problem.block, big.NewInt(1))
+		}
+
+		if problem.kind != verifyMissing {
+			for n := new(big.Int).Set(from); n.Cmp(problem.block) <= 0; n.Add(n, big.NewInt(1)) {
+				objects, err := s3Client.MoveBlockAside(new(big.Int).Set(n), problem.kind)
+				if err != nil {
+					return fmt.Errorf("block %s: %s", n, err)
+				}
+				moved += objects
+			}
+		}
+
+		err := redisClient.requeueBlocks(from, problem.block)
+		if err != nil {
+			return err
+		}
+		count += int(new(big.Int).Sub(problem.block, from).Int64()) + 1
+	}
+
+	fmt.Fprintf(out, "moved %d objects aside, requeued %d blocks\n", moved, count)
+	return nil
+}
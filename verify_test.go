@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/prettymuchbryce/ingestr/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// testChildBlock returns an empty block on top of a block with the given
+// parent hash, stored with the given hash.
+func testChildBlock(t *testing.T, parent *types.Header, parentHash common.Hash, hash *common.Hash) (*types.Header, string) {
+	header := types.CopyHeader(parent)
+	header.Number = new(big.Int).Add(parent.Number, big.NewInt(1))
+	header.ParentHash = parentHash
+	header.TxHash = types.EmptyRootHash
+	header.ReceiptHash = types.EmptyRootHash
+	if hash == nil {
+		headerHash := header.Hash()
+		hash = &headerHash
+	}
+
+	data, err := encodeBlock(blockFormatJSON, &receiptsBlock{
+		Version: receiptsBlockVersion,
+		Header:  header,
+		Hash:    *hash,
+	})
+	assert.NoError(t, err)
+
+	return header, data
+}
+
+func TestVerifyBlocks(t *testing.T) {
+	block, err := unmarshalReceiptBlock(testBlockReceipts)
+	assert.NoError(t, err)
+	assert.NoError(t, verifyBlock(block.Header.Number, block))
+
+	child, childData := testChildBlock(t, block.Header, block.Hash, nil)
+	orphan, orphanData := testChildBlock(t, child, common.HexToHash("0x01"), nil)
+	wrongHash := common.HexToHash("0x02")
+	_, corruptData := testChildBlock(t, orphan, orphan.Hash(), &wrongHash)
+
+	s3Client := &mocks.S3Client{}
+	s3Client.On("GetBlock", big.NewInt(8816480)).Return("", "", awserr.New(s3.ErrCodeNoSuchKey, "", nil))
+	s3Client.On("GetBlock", big.NewInt(8816481)).Return(testBlockReceipts, blockFormatJSON, nil)
+	s3Client.On("GetBlock", big.NewInt(8816482)).Return(childData, blockFormatJSON, nil)
+	s3Client.On("GetBlock", big.NewInt(8816483)).Return(orphanData, blockFormatJSON, nil)
+	s3Client.On("GetBlock", big.NewInt(8816484)).Return(corruptData, blockFormatJSON, nil)
+	s3Client.On("GetBlock", big.NewInt(8816485)).Return(testBlockReceipts, blockFormatJSON, nil)
+
+	from, to := big.NewInt(8816480), big.NewInt(8816485)
+	problems, err := verifyBlocks(from, to, s3Client)
+	assert.NoError(t, err)
+	assert.Len(t, problems, 4)
+
+	var out bytes.Buffer
+	err = writeVerifyReport(from, to, problems, &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "8816480  missing")
+	assert.Contains(t, out.String(), "8816483  inconsistent  parent hash 0x0000000000000000000000000000000000000000000000000000000000000001 does not match block 8816482 with hash "+child.Hash().Hex())
+	assert.Contains(t, out.String(), "8816484  corrupt       header hash")
+	assert.Contains(t, out.String(), "8816485  corrupt       header is of block 8816481")
+	assert.Contains(t, out.String(), "verified 6 blocks from 8816480 to 8816485: 1 missing, 2 corrupt, 1 inconsistent")
+
+	dir, err := ioutil.TempDir("", "ingestr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	embedded := testCreateEmbeddedClient(t, dir, 60)
+	defer embedded.close()
+
+	// The parent of the inconsistent block is requeued too, and the objects of
+	// every block that is stored are moved aside
+	s3Client.On("MoveBlockAside", mock.Anything, mock.Anything).Return(1, nil)
+	out.Reset()
+	err = requeueProblems(problems, s3Client, embedded, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "moved 4 objects aside, requeued 5 blocks\n", out.String())
+	s3Client.AssertNumberOfCalls(t, "MoveBlockAside", 4)
+	s3Client.AssertCalled(t, "MoveBlockAside", big.NewInt(8816482), verifyInconsistent)
+	s3Client.AssertCalled(t, "MoveBlockAside", big.NewInt(8816483), verifyInconsistent)
+	s3Client.AssertCalled(t, "MoveBlockAside", big.NewInt(8816485), verifyCorrupt)
+
+	for _, expected := range []int64{8816480, 8816482, 8816483, 8816484, 8816485} {
+		requeued, err := embedded.getNextWorkingBlock(big.NewInt(9000000))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, requeued.Int64())
+	}
+}
+
+func TestVerifyBlockRoots(t *testing.T) {
+	block, _ := testExportBlock(t)
+	block.Header.TxHash = types.DeriveSha(types.Transactions(block.Transactions))
+	block.Header.ReceiptHash = types.DeriveSha(types.Receipts(block.Receipts))
+	block.Hash = block.Header.Hash()
+	assert.NoError(t, verifyBlock(block.Header.Number, block))
+
+	block.Receipts[0].CumulativeGasUsed++
+	assert.Contains(t, verifyBlock(block.Header.Number, block).Error(), "receipts root")
+
+	block.Transactions = nil
+	assert.Contains(t, verifyBlock(block.Header.Number, block).Error(), "transactions root")
+}